@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+/*
+* AUTHENTICATION
+*
+* Once the game has started every packet is signed:
+*
+*   magic (1 byte), key id (uint16), sender pid (uint16), sequence number (uint64),
+*   the encoded message, then an HMAC-SHA256 of everything before it (32 bytes)
+*
+* Key id 0 is the group key every player gets with the game start. Any other key id is
+* the session token of that player, which only the player and the leader that issued it
+* know. Moves and everything else a player tells the leader are signed with the player's
+* own key, so nobody else can steer its cycle; messages between peers (elections) and
+* to or from a leader that never issued our token use the group key.
+*
+* The sender pid has to be the player at the address the packet came from (the leader's
+* own pid for its leader socket), so nobody can speak for anyone else with the group key.
+* Once the leader issued us our own key, whatever only the leader gets to say has to be
+* signed with it.
+*
+* Sequence numbers start at the time the node started, so a restarted node carries on
+* above where it left off, and every receiver keeps a window of the ones it has seen per
+* sender and key to throw away replays. A packet only counts towards a window once it
+* passed every other check, so a forged one can't push the window past a real sender.
+ */
+
+const (
+	signedMagic      = 0xA5
+	signedHeaderSize = 1 + 2 + 2 + 8
+)
+
+var errUnsigned = errors.New("unsigned packet")
+
+type authState struct {
+	mu               sync.Mutex
+	seq              uint64
+	windows          map[[2]int]*replayWindow // by sender pid and key id
+	leaderKnowsMyKey bool                     // the leader issued our session token, so we sign with it
+}
+
+// replayWindow remembers the last 64 sequence numbers of a sender, like IPsec does.
+type replayWindow struct {
+	highest uint64
+	seen    uint64 // bit i is set if highest-i has been seen
+}
+
+func (w *replayWindow) accept(seq uint64) bool {
+	switch {
+	case seq > w.highest:
+		if shift := seq - w.highest; shift < 64 {
+			w.seen <<= shift
+		} else {
+			w.seen = 0
+		}
+		w.seen |= 1
+		w.highest = seq
+		return true
+	case w.highest-seq >= 64:
+		return false
+	default:
+		bit := uint64(1) << (w.highest - seq)
+		if w.seen&bit != 0 {
+			return false
+		}
+		w.seen |= bit
+		return true
+	}
+}
+
+// keyFor looks up the key a key id stands for. Players only know the group key and their
+// own; the leader knows everyone's.
+func (n *Node) keyFor(keyID int) ([]byte, bool) {
+	if keyID == 0 {
+		return []byte(n.GroupKey), n.GroupKey != ""
+	}
+	if keyID == n.MyPid && n.SessionToken != "" {
+		return []byte(n.SessionToken), true
+	}
+	token, known := n.leaderState.Tokens[strconv.Itoa(keyID)]
+	return []byte(token), known
+}
+
+func (n *Node) nextSeq() uint64 {
+	n.auth.mu.Lock()
+	defer n.auth.mu.Unlock()
+	if n.auth.seq == 0 {
+		n.auth.seq = uint64(n.clock.Now().UnixNano()/int64(1e6)) << 20
+	}
+	n.auth.seq++
+	return n.auth.seq
+}
+
+func (n *Node) sign(payload []byte, keyID int) []byte {
+	key, _ := n.keyFor(keyID)
+	buf := make([]byte, signedHeaderSize, signedHeaderSize+len(payload)+sha256.Size)
+	buf[0] = signedMagic
+	binary.BigEndian.PutUint16(buf[1:], uint16(keyID))
+	binary.BigEndian.PutUint16(buf[3:], uint16(n.MyPid))
+	binary.BigEndian.PutUint64(buf[5:], n.nextSeq())
+	buf = append(buf, payload...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf)
+	return mac.Sum(buf)
+}
+
+// A signedPacket passed its signature check, but not yet its sequence number check.
+type signedPacket struct {
+	payload []byte
+	keyID   int
+	sender  int
+	seq     uint64
+}
+
+// verify checks the signature of a packet and returns what was signed.
+func (n *Node) verify(buf []byte) (signedPacket, error) {
+	if len(buf) < signedHeaderSize+sha256.Size || buf[0] != signedMagic {
+		return signedPacket{}, errUnsigned
+	}
+	keyID := int(binary.BigEndian.Uint16(buf[1:]))
+	sender := int(binary.BigEndian.Uint16(buf[3:]))
+	key, known := n.keyFor(keyID)
+	if !known {
+		return signedPacket{}, errors.New("signed with a key we don't have, " + strconv.Itoa(keyID))
+	}
+	signed := buf[:len(buf)-sha256.Size]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), buf[len(signed):]) {
+		return signedPacket{}, errors.New("bad signature from player " + strconv.Itoa(sender))
+	}
+	return signedPacket{payload: signed[signedHeaderSize:], keyID: keyID, sender: sender, seq: binary.BigEndian.Uint64(buf[5:])}, nil
+}
+
+// fresh checks a packet that passed every other check isn't a replay.
+func (n *Node) fresh(packet signedPacket) error {
+	n.auth.mu.Lock()
+	defer n.auth.mu.Unlock()
+	if n.auth.windows == nil {
+		n.auth.windows = make(map[[2]int]*replayWindow)
+	}
+	window, ok := n.auth.windows[[2]int{packet.sender, packet.keyID}]
+	if !ok {
+		window = &replayWindow{}
+		n.auth.windows[[2]int{packet.sender, packet.keyID}] = window
+	}
+	if !window.accept(packet.seq) {
+		return errors.New("replayed packet " + strconv.FormatUint(packet.seq, 10) + " from player " + strconv.Itoa(packet.sender))
+	}
+	return nil
+}
+
+// the key to sign a message to addr with: theirs if we issued it, the group's otherwise
+func (n *Node) keyIDFor(addr *net.UDPAddr) int {
+	pid := n.AddrToPid[addr.String()]
+	if _, known := n.leaderState.Tokens[pid]; known {
+		id, _ := strconv.Atoi(pid)
+		return id
+	}
+	return 0
+}
+
+func (n *Node) sendToLeader(message Message) error {
+	keyID := 0
+	if n.auth.leaderKnowsMyKey {
+		keyID = n.MyPid
+	}
+	n.attachGossip(message)
+	buf := n.sign(n.encode(message), keyID)
+	_, err := n.goConnection.WriteTo(n.Logger.PrepareSend("", buf), n.leaderUDPAddr)
+	n.recordWriteThroughput(len(buf))
+	if err != nil {
+		// a lost packet to the leader is no reason to quit, it's resent or times out like one
+		n.logClient("Could not send a " + message.header().MessageType + " message to the leader: " + err.Error())
+	}
+	return err
+}
+
+// openFromPlayer is how the leader reads a packet: it has to be signed with the sending
+// player's own key (or the group key, if we never issued it one), come from that
+// player's address and only speak for that player.
+func (n *Node) openFromPlayer(buf []byte, raddr *net.UDPAddr) (Message, string, error) {
+	packet, err := n.verify(buf)
+	if err != nil {
+		return nil, "", err
+	}
+	pid := strconv.Itoa(packet.sender)
+	_, issued := n.leaderState.Tokens[pid]
+	if (issued && packet.keyID != packet.sender) || (!issued && packet.keyID != 0) {
+		return nil, "", errors.New("player " + pid + " signed with key " + strconv.Itoa(packet.keyID))
+	}
+	message, err := decodeWireMessage(packet.payload)
+	if err != nil {
+		return nil, "", err
+	}
+	switch message := message.(type) {
+	case *RejoinMessage:
+		// the only way to come back from a new address is with your own key
+		if !issued || message.Pid != pid {
+			return nil, "", errors.New("player " + pid + " tried to rejoin as " + message.Pid)
+		}
+		if err := n.fresh(packet); err != nil {
+			return nil, "", err
+		}
+		return message, pid, nil
+	case *MyMoveMessage:
+		if message.Pid != pid {
+			return nil, "", errors.New("player " + pid + " sent a move for player " + message.Pid)
+		}
+	case *LeaveMessage:
+		if message.Pid != pid {
+			return nil, "", errors.New("player " + pid + " tried to make player " + message.Pid + " leave")
+		}
+	}
+	if n.AddrToPid[raddr.String()] != pid {
+		return nil, "", errors.New("player " + pid + " sent a packet from " + raddr.String() + ", which isn't theirs")
+	}
+	if err := n.fresh(packet); err != nil {
+		return nil, "", err
+	}
+	n.leaderState.Following[pid] = true
+	n.mergeGossip(message.header().Gossip, pid, false)
+	return message, pid, nil
+}
+
+// openGameStart is how a rejoining player reads the leader's answer: a game start signed
+// with our own key, which only a leader that knows our token has, from one of the
+// addresses we asked.
+func (n *Node) openGameStart(buf []byte, raddr *net.UDPAddr, asked []*net.UDPAddr) (*GameStartMessage, error) {
+	packet, err := n.verify(buf)
+	if err != nil {
+		return nil, err
+	}
+	if packet.keyID != n.MyPid {
+		return nil, errors.New("a packet signed with key " + strconv.Itoa(packet.keyID) + ", not ours")
+	}
+	leader := false
+	for _, addr := range asked {
+		leader = leader || addr.String() == raddr.String()
+	}
+	if !leader {
+		return nil, errors.New("a packet from " + raddr.String() + ", which we didn't ask to take us back")
+	}
+	message, err := decodeWireMessage(packet.payload)
+	if err != nil {
+		return nil, err
+	}
+	gameStart, ok := message.(*GameStartMessage)
+	if !ok {
+		return nil, errors.New("a " + message.header().MessageType + " message")
+	}
+	if gameStart.Pid != strconv.Itoa(n.MyPid) || gameStart.Leader != strconv.Itoa(packet.sender) {
+		return nil, errors.New("a game start for player " + gameStart.Pid + " from player " + strconv.Itoa(packet.sender))
+	}
+	if err := n.fresh(packet); err != nil {
+		return nil, err
+	}
+	return gameStart, nil
+}
+
+// openFromPeer is how a player reads a packet: signed with its own key or the group key,
+// by whoever sends from the address it came from. Anything only the leader gets to say
+// has to come from the leader we follow, of its term, and signed with our own key once it
+// has it. A leader of a newer term only becomes ours with a newleader, see election.go.
+func (n *Node) openFromPeer(buf []byte, raddr *net.UDPAddr) (Message, error) {
+	packet, err := n.verify(buf)
+	if err != nil {
+		return nil, err
+	}
+	sender := strconv.Itoa(packet.sender)
+	if packet.keyID != 0 && packet.keyID != n.MyPid {
+		return nil, errors.New("player " + sender + " signed with the key of player " + strconv.Itoa(packet.keyID))
+	}
+	fromLeader := n.leaderUDPAddr != nil && raddr.String() == n.leaderUDPAddr.String()
+	if (fromLeader && sender != n.leaderPid) || (!fromLeader && n.AddrToPid[raddr.String()] != sender) {
+		return nil, errors.New("player " + sender + " sent a packet from " + raddr.String() + ", which isn't theirs")
+	}
+	message, err := decodeWireMessage(packet.payload)
+	if err != nil {
+		return nil, err
+	}
+	switch message.(type) {
+	case *RoundStartMessage, *MovesMessage, *KillPlayerMessage, *GameOverMessage, *SnapshotMessage, *StepDownMessage,
+		*PlayerLeftMessage:
+		header := message.header()
+		switch {
+		case !fromLeader:
+			return nil, errors.New("a " + header.MessageType + " message from " + raddr.String() + ", which isn't the leader")
+		case header.Term != n.LeaderID:
+			return nil, errors.New("a " + header.MessageType + " message from the leader of term " + strconv.Itoa(header.Term) +
+				", we follow the leader of term " + strconv.Itoa(n.LeaderID))
+		case n.auth.leaderKnowsMyKey && packet.keyID != n.MyPid:
+			return nil, errors.New("a " + header.MessageType + " message from the leader signed with the group key, it has ours")
+		}
+		if err := n.fresh(packet); err != nil {
+			return nil, err
+		}
+		n.heardFromLeader()
+		if packet.keyID == n.MyPid {
+			// a new leader that got our token with our state report
+			n.auth.leaderKnowsMyKey = true
+		}
+	default:
+		if err := n.fresh(packet); err != nil {
+			return nil, err
+		}
+	}
+	n.mergeGossip(message.header().Gossip, sender, fromLeader)
+	return message, nil
+}
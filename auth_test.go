@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a window takes every sequence number once, in any order, as long as it isn't 64 or
+// more behind the highest one it took
+func TestReplayWindow(t *testing.T) {
+	window := &replayWindow{}
+	tests := []struct {
+		seq  uint64
+		want bool
+	}{
+		{100, true},
+		{100, false},
+		{101, true},
+		{99, true},
+		{99, false},
+		{110, true},
+		{105, true},
+		{105, false},
+		{47, true},  // 63 behind
+		{46, false}, // 64 behind
+		{47, false},
+		{174, true}, // 110 is now 64 behind
+		{110, false},
+		{111, true},
+		{300, true}, // a jump past the whole window forgets it
+		{236, false},
+		{237, true},
+		{237, false},
+		{299, true},
+		{300, false},
+	}
+	for _, test := range tests {
+		if got := window.accept(test.seq); got != test.want {
+			t.Errorf("accept(%d) after the highest was %d: got %v, want %v", test.seq, window.highest, got, test.want)
+		}
+	}
+}
+
+func newAuthNode(nickname string, pid int, token string) *Node {
+	n := NewNode(WithNickname(nickname), WithClock(NewSimClock(time.Unix(0, 0))))
+	n.MyPid, n.SessionToken, n.GroupKey = pid, token, "group key"
+	return n
+}
+
+// the leader only takes a packet signed with the sender's own key, from the sender's
+// address, that speaks for nobody but the sender, and only once
+func TestOpenFromPlayer(t *testing.T) {
+	leader := newAuthNode("authleader", 1, "token 1")
+	leader.leaderState.Tokens = map[string]string{"2": "token 2", "3": "token 3"}
+	leader.leaderState.Following = make(map[string]bool)
+	leader.AddrToPid = map[string]string{"10.0.0.2:7000": "2", "10.0.0.3:7000": "3"}
+
+	player := newAuthNode("authplayer", 2, "token 2")
+	thief := newAuthNode("auththief", 2, "not token 2")
+	// a player that got hold of someone else's token still can't sign as itself with it
+	player.leaderState.Tokens = map[string]string{"3": "token 3"}
+
+	move := player.sign(encodeMessage(newMyMoveMessage("UP", "2", 5)), 2)
+	rejoin := player.sign(encodeMessage(&RejoinMessage{Envelope: Envelope{MessageType: "rejoin"}, Pid: "2"}), 2)
+	tests := []struct {
+		name string
+		buf  []byte
+		from string
+		want string
+	}{
+		{"move", move, "10.0.0.2:7000", ""},
+		{"the same move again", move, "10.0.0.2:7000", "replayed packet"},
+		{"unsigned", encodeMessage(newMyMoveMessage("UP", "2", 6)), "10.0.0.2:7000", errUnsigned.Error()},
+		{"wrong token", thief.sign(encodeMessage(newMyMoveMessage("UP", "2", 6)), 2), "10.0.0.2:7000", "bad signature"},
+		{"group key", player.sign(encodeMessage(newMyMoveMessage("UP", "2", 6)), 0), "10.0.0.2:7000", "signed with key 0"},
+		{"someone else's key", player.sign(encodeMessage(newMyMoveMessage("UP", "2", 6)), 3), "10.0.0.2:7000", "signed with key 3"},
+		{"unknown key", player.sign(encodeMessage(newMyMoveMessage("UP", "2", 6)), 9), "10.0.0.2:7000", "key we don't have"},
+		{"move for someone else", player.sign(encodeMessage(newMyMoveMessage("UP", "3", 6)), 2), "10.0.0.2:7000", "sent a move for player 3"},
+		{"someone else's address", player.sign(encodeMessage(newMyMoveMessage("UP", "2", 6)), 2), "10.0.0.3:7000", "which isn't theirs"},
+		{"a stranger's address", player.sign(encodeMessage(newMyMoveMessage("UP", "2", 6)), 2), "10.0.0.9:7000", "which isn't theirs"},
+		{"rejoin from a new address", rejoin, "10.0.0.9:7000", ""},
+		{"the same rejoin again", rejoin, "10.0.0.9:7000", "replayed packet"},
+		{"rejoin as someone else", player.sign(encodeMessage(&RejoinMessage{Envelope: Envelope{MessageType: "rejoin"}, Pid: "3"}), 2), "10.0.0.9:7000", "tried to rejoin as 3"},
+		{"move after all that", player.sign(encodeMessage(newMyMoveMessage("LEFT", "2", 7)), 2), "10.0.0.2:7000", ""},
+	}
+	for _, test := range tests {
+		raddr, _ := net.ResolveUDPAddr("udp", test.from)
+		message, pid, err := leader.openFromPlayer(test.buf, raddr)
+		switch {
+		case test.want == "" && (err != nil || pid != "2"):
+			t.Errorf("%s: got %v from player %q, want it taken from player 2", test.name, err, pid)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: got %+v and %v, want an error with %q", test.name, message, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Wire encodings a game can be played in. JSON is what everyone understands, including
+// the java frontend; binary is much smaller but only the go clients speak it.
+const (
+	JSON_ENCODING   = "json"
+	BINARY_ENCODING = "binary"
+)
+
+var SUPPORTED_ENCODINGS = []string{BINARY_ENCODING, JSON_ENCODING}
+
+// Every binary packet starts with this byte, which can never start a json message.
+const binaryMagic = 0xB7
+
+/*
+* BINARY LAYOUT
+*
+* magic (1 byte), message type code (1 byte), round (uvarint), term (uvarint), then per type:
+*   roundstart:  number of successors (uvarint), their pids (uint16 each), then the same
+*                for the dropped players
+*   mymove:      pid (uint16), direction (1 byte), ack (uvarint)
+*   killplayer:  pid (uint16)
+*   moves:       moves round (uvarint), checksum (uint32), window length (uvarint), then per round in the window
+*                the number of players (uvarint), each player's pid, x, y (uint16 each) in pid
+*                order, then their directions packed four to a byte (2 bits each)
+*   gameOver:    number of players (uvarint), pids in order of death (uint16 each), then the
+*                number of players that left (uvarint), each one's pid (uint16) and reason
+*                (uvarint length, then the bytes) in pid order
+*   election:    leader id (uvarint), address (uvarint length, then the bytes)
+*   snapshot:    snapshot round, leader id, width, height (uvarint each), number of grid run
+*                numbers (uvarint), the runs (varint each), number alive (uvarint), their
+*                pids (uint16 each), then everyone's positions like a round of moves
+*   resync:      nothing
+*   heartbeat:   sent (uint64), echo (1 byte)
+*   inputs:      pid (uint16), checksum (uint32), number of rounds (uvarint), a direction
+*                (1 byte) for each, then the number of players dropped (uvarint), each one's
+*                pid (uint16) and round (uvarint) in pid order
+*
+* and every message ends with its gossip: the number of entries (uvarint), then each one's
+* pid (uint16), status (1 byte), incarnation (uvarint), address and nickname (uvarint
+* length, then the bytes).
+*
+* Messages without a binary layout (like startgame) are sent as json.
+ */
+
+var binaryTypeCodes = map[string]byte{
+	"roundstart":  1,
+	"mymove":      2,
+	"killplayer":  3,
+	"moves":       4,
+	"gameOver":    5,
+	"checkleader": 6,
+	"leaderalive": 7,
+	"leaderdead":  8,
+	"newleader":   9,
+	"snapshot":    10,
+	"resync":      11,
+	"heartbeat":   12,
+	"inputs":      13,
+}
+
+var binaryMessageTypes = func() map[byte]string {
+	types := make(map[byte]string)
+	for messageType, code := range binaryTypeCodes {
+		types[code] = messageType
+	}
+	return types
+}()
+
+func directionCode(direction string) (byte, error) {
+	for i, d := range DIRECTIONS {
+		if d == direction {
+			return byte(i), nil
+		}
+	}
+	return 0, errors.New("unknown direction " + direction)
+}
+
+func pidCode(pid string) (uint16, error) {
+	code, err := strconv.Atoi(pid)
+	if err != nil || code < 0 || code > 0xFFFF {
+		return 0, errors.New("pid " + pid + " does not fit in the binary encoding")
+	}
+	return uint16(code), nil
+}
+
+// chooseEncoding picks the encoding for a game: the one the leader prefers if every
+// player can speak it, json otherwise.
+func chooseEncoding(preferred string, supportedByPlayers [][]string) string {
+	for _, supported := range supportedByPlayers {
+		found := false
+		for _, encoding := range supported {
+			found = found || encoding == preferred
+		}
+		if !found {
+			return JSON_ENCODING
+		}
+	}
+	return preferred
+}
+
+// encodeWireMessage encodes a message for another go peer in the game's encoding.
+func encodeWireMessage(message Message, encoding string) []byte {
+	if encoding == BINARY_ENCODING {
+		if buf, err := encodeBinaryMessage(message); err == nil {
+			return buf
+		}
+	}
+	return encodeMessage(message)
+}
+
+// decodeWireMessage decodes a packet from a peer in whichever encoding it was sent.
+func decodeWireMessage(buf []byte) (Message, error) {
+	if len(buf) > 0 && buf[0] == binaryMagic {
+		return decodeBinaryMessage(buf)
+	}
+	return decodeMessage(buf)
+}
+
+func encodeBinaryMessage(message Message) ([]byte, error) {
+	header := message.header()
+	code, ok := binaryTypeCodes[header.MessageType]
+	if !ok {
+		return nil, errors.New("no binary layout for " + header.MessageType)
+	}
+	w := &binaryWriter{buf: []byte{binaryMagic, code}}
+	w.uvarint(header.Round)
+	w.uvarint(header.Term)
+	switch message := message.(type) {
+	case *RoundStartMessage:
+		w.uvarint(len(message.Succession))
+		for _, pid := range message.Succession {
+			w.pid(pid)
+		}
+		w.uvarint(len(message.Dropped))
+		for _, pid := range message.Dropped {
+			w.pid(pid)
+		}
+	case *MyMoveMessage:
+		w.pid(message.Pid)
+		w.direction(message.Direction)
+		w.uvarint(message.Ack)
+	case *KillPlayerMessage:
+		w.pid(message.PlayerPID)
+	case *MovesMessage:
+		w.uvarint(message.Moves.Round)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, message.Checksum)
+		w.uvarint(len(message.Moves.Moves))
+		for _, moves := range message.Moves.Moves {
+			w.moveMap(moves)
+		}
+	case *GameOverMessage:
+		w.uvarint(len(message.PidsInOrderOfDeath))
+		for _, pid := range message.PidsInOrderOfDeath {
+			w.pid(pid)
+		}
+		left := make([]string, 0, len(message.Left))
+		for pid := range message.Left {
+			left = append(left, pid)
+		}
+		sort.Slice(left, func(i, j int) bool {
+			a, _ := strconv.Atoi(left[i])
+			b, _ := strconv.Atoi(left[j])
+			return a < b
+		})
+		w.uvarint(len(left))
+		for _, pid := range left {
+			w.pid(pid)
+			w.string(message.Left[pid])
+		}
+	case *LeaderElectionMessage:
+		w.uvarint(message.LeaderID)
+		w.string(message.Address)
+	case *HeartbeatMessage:
+		w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(message.Sent))
+		if message.Echo {
+			w.buf = append(w.buf, 1)
+		} else {
+			w.buf = append(w.buf, 0)
+		}
+	case *InputsMessage:
+		w.pid(message.Pid)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, message.Checksum)
+		w.uvarint(len(message.Directions))
+		for _, direction := range message.Directions {
+			w.direction(direction)
+		}
+		dropped := make([]string, 0, len(message.Dropped))
+		for pid := range message.Dropped {
+			dropped = append(dropped, pid)
+		}
+		sort.Slice(dropped, func(i, j int) bool { return pidLess(dropped[i], dropped[j]) })
+		w.uvarint(len(dropped))
+		for _, pid := range dropped {
+			w.pid(pid)
+			w.uvarint(message.Dropped[pid])
+		}
+	case *SnapshotMessage:
+		w.uvarint(message.Snapshot.Round)
+		w.uvarint(message.LeaderID)
+		w.uvarint(message.Width)
+		w.uvarint(message.Height)
+		w.uvarint(len(message.Grid))
+		for _, value := range message.Grid {
+			w.varint(value)
+		}
+		w.uvarint(len(message.Alive))
+		for _, pid := range message.Alive {
+			w.pid(pid)
+		}
+		w.moveMap(message.Positions)
+	case *ResyncMessage:
+	default:
+		return nil, errors.New("no binary layout for " + header.MessageType)
+	}
+	w.gossip(header.Gossip)
+	return w.buf, w.err
+}
+
+func decodeBinaryMessage(buf []byte) (Message, error) {
+	if len(buf) < 2 {
+		return nil, errors.New("truncated binary message")
+	}
+	messageType, ok := binaryMessageTypes[buf[1]]
+	if !ok {
+		return nil, fmt.Errorf("unknown binary message type %d", buf[1])
+	}
+	r := &binaryReader{buf: buf[2:]}
+	round := r.uvarint()
+	term := r.uvarint()
+	var message Message
+	switch messageType {
+	case "roundstart":
+		roundStart := &RoundStartMessage{
+			Envelope:   Envelope{MessageType: messageType, EventName: "roundStart", Round: round},
+			RoundStart: RoundStart{Round: round},
+		}
+		count := r.uvarint()
+		if count > len(buf) {
+			return nil, errors.New("more successors than the message can hold")
+		}
+		for i := 0; i < count; i++ {
+			roundStart.Succession = append(roundStart.Succession, r.pid())
+		}
+		count = r.uvarint()
+		if count > len(buf) {
+			return nil, errors.New("more dropped players than the message can hold")
+		}
+		for i := 0; i < count; i++ {
+			roundStart.Dropped = append(roundStart.Dropped, r.pid())
+		}
+		message = roundStart
+	case "mymove":
+		pid := r.pid()
+		move := newMyMoveMessage(r.direction(), pid, round)
+		move.Ack = r.uvarint()
+		message = move
+	case "killplayer":
+		message = &KillPlayerMessage{
+			Envelope:  Envelope{MessageType: messageType, EventName: "killplayer", Round: round},
+			PlayerPID: r.pid(),
+		}
+	case "moves":
+		moves := &MovesMessage{Envelope: Envelope{MessageType: messageType, EventName: "moves", Round: round}}
+		moves.Moves.Round = r.uvarint()
+		moves.Checksum = binary.BigEndian.Uint32(r.bytes(4))
+		window := r.uvarint()
+		if window > len(buf) {
+			return nil, errors.New("moves window longer than the message")
+		}
+		moves.Moves.Moves = make([]map[string]Move, window)
+		for i := range moves.Moves.Moves {
+			moves.Moves.Moves[i] = r.moveMap()
+		}
+		message = moves
+	case "gameOver":
+		gameOver := &GameOverMessage{Envelope: Envelope{MessageType: messageType, EventName: "gameOver", Round: round}}
+		count := r.uvarint()
+		if count > len(buf) {
+			return nil, errors.New("more deaths than the message can hold")
+		}
+		gameOver.PidsInOrderOfDeath = make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			gameOver.PidsInOrderOfDeath = append(gameOver.PidsInOrderOfDeath, r.pid())
+		}
+		count = r.uvarint()
+		if count > len(buf) {
+			return nil, errors.New("more players left than the message can hold")
+		}
+		for i := 0; i < count; i++ {
+			if gameOver.Left == nil {
+				gameOver.Left = make(map[string]string)
+			}
+			pid := r.pid()
+			gameOver.Left[pid] = r.string()
+		}
+		message = gameOver
+	case "snapshot":
+		snapshot := &SnapshotMessage{Envelope: Envelope{MessageType: messageType, EventName: "snapshot", Round: round}}
+		snapshot.Snapshot.Round = r.uvarint()
+		snapshot.LeaderID = r.uvarint()
+		snapshot.Width = r.uvarint()
+		snapshot.Height = r.uvarint()
+		runs := r.uvarint()
+		if runs > len(buf) {
+			return nil, errors.New("more grid runs than the message can hold")
+		}
+		snapshot.Grid = make([]int, runs)
+		for i := range snapshot.Grid {
+			snapshot.Grid[i] = r.varint()
+		}
+		alive := r.uvarint()
+		if alive > len(buf) {
+			return nil, errors.New("more players alive than the message can hold")
+		}
+		snapshot.Alive = make([]string, alive)
+		for i := range snapshot.Alive {
+			snapshot.Alive[i] = r.pid()
+		}
+		snapshot.Positions = r.moveMap()
+		message = snapshot
+	case "resync":
+		message = &ResyncMessage{Envelope: Envelope{MessageType: messageType, EventName: "resync", Round: round}}
+	case "heartbeat":
+		sent := int64(binary.BigEndian.Uint64(r.bytes(8)))
+		message = &HeartbeatMessage{
+			Envelope:  Envelope{MessageType: messageType, EventName: "heartbeat", Round: round},
+			Heartbeat: Heartbeat{Sent: sent, Echo: r.bytes(1)[0] == 1},
+		}
+	case "inputs":
+		inputs := &InputsMessage{
+			Envelope: Envelope{MessageType: messageType, EventName: "inputs", Round: round},
+			Inputs:   Inputs{Pid: r.pid(), Checksum: binary.BigEndian.Uint32(r.bytes(4))},
+		}
+		count := r.uvarint()
+		if count > len(r.buf) {
+			return nil, errors.New("more rounds than the message can hold")
+		}
+		for i := 0; i < count; i++ {
+			inputs.Directions = append(inputs.Directions, r.direction())
+		}
+		dropped := r.uvarint()
+		if dropped*3 > len(r.buf) {
+			return nil, errors.New("more dropped players than the message can hold")
+		}
+		for i := 0; i < dropped; i++ {
+			if inputs.Dropped == nil {
+				inputs.Dropped = make(map[string]int)
+			}
+			pid := r.pid()
+			inputs.Dropped[pid] = r.uvarint()
+		}
+		message = inputs
+	default:
+		message = &LeaderElectionMessage{
+			Envelope: Envelope{MessageType: messageType, Round: round},
+			LeaderID: r.uvarint(),
+			Address:  r.string(),
+		}
+	}
+	gossip := r.gossip()
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed binary %s message: %v", messageType, r.err)
+	}
+	message.header().Term = term
+	message.header().Gossip = gossip
+	if v, ok := message.(validator); ok {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("invalid binary %s message: %v", messageType, err)
+		}
+	}
+	return message, nil
+}
+
+type binaryWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *binaryWriter) uvarint(value int) {
+	if value < 0 {
+		w.err = fmt.Errorf("can't write negative %d", value)
+		return
+	}
+	w.buf = binary.AppendUvarint(w.buf, uint64(value))
+}
+
+func (w *binaryWriter) varint(value int) {
+	w.buf = binary.AppendVarint(w.buf, int64(value))
+}
+
+func (w *binaryWriter) uint16(value uint16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, value)
+}
+
+func (w *binaryWriter) pid(pid string) {
+	code, err := pidCode(pid)
+	if err != nil {
+		w.err = err
+	}
+	w.uint16(code)
+}
+
+func (w *binaryWriter) string(value string) {
+	w.uvarint(len(value))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *binaryWriter) gossip(members []Member) {
+	w.uvarint(len(members))
+	for _, member := range members {
+		w.pid(member.Pid)
+		status := statusRank(member.Status)
+		if status < 0 {
+			w.err = errors.New("unknown member status " + member.Status)
+		}
+		w.buf = append(w.buf, byte(status))
+		w.uvarint(member.Incarnation)
+		w.string(member.Address)
+		w.string(member.Nickname)
+	}
+}
+
+func (w *binaryWriter) direction(direction string) {
+	code, err := directionCode(direction)
+	if err != nil {
+		w.err = err
+	}
+	w.buf = append(w.buf, code)
+}
+
+func (w *binaryWriter) coordinate(value int) {
+	if value < 0 || value > 0xFFFF {
+		w.err = fmt.Errorf("coordinate %d does not fit in the binary encoding", value)
+	}
+	w.uint16(uint16(value))
+}
+
+func (w *binaryWriter) moveMap(moves map[string]Move) {
+	pids := make([]string, 0, len(moves))
+	for pid := range moves {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool {
+		a, _ := strconv.Atoi(pids[i])
+		b, _ := strconv.Atoi(pids[j])
+		return a < b
+	})
+	w.uvarint(len(pids))
+	directions := make([]byte, (len(pids)+3)/4)
+	for i, pid := range pids {
+		move := moves[pid]
+		w.pid(pid)
+		w.coordinate(move.X)
+		w.coordinate(move.Y)
+		code, err := directionCode(move.Direction)
+		if err != nil {
+			w.err = err
+		}
+		directions[i/4] |= code << uint(2*(i%4))
+	}
+	w.buf = append(w.buf, directions...)
+}
+
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+var errTruncated = errors.New("truncated")
+
+func (r *binaryReader) uvarint() int {
+	if r.err != nil {
+		return 0
+	}
+	value, size := binary.Uvarint(r.buf)
+	if size <= 0 || value > 1<<31 {
+		r.err = errTruncated
+		return 0
+	}
+	r.buf = r.buf[size:]
+	return int(value)
+}
+
+func (r *binaryReader) varint() int {
+	if r.err != nil {
+		return 0
+	}
+	value, size := binary.Varint(r.buf)
+	if size <= 0 || value > 1<<31 || value < -1<<31 {
+		r.err = errTruncated
+		return 0
+	}
+	r.buf = r.buf[size:]
+	return int(value)
+}
+
+func (r *binaryReader) bytes(size int) []byte {
+	if r.err != nil {
+		return make([]byte, size)
+	}
+	if len(r.buf) < size {
+		r.err = errTruncated
+		return make([]byte, size)
+	}
+	out := r.buf[:size]
+	r.buf = r.buf[size:]
+	return out
+}
+
+func (r *binaryReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.bytes(2))
+}
+
+func (r *binaryReader) pid() string {
+	return strconv.Itoa(int(r.uint16()))
+}
+
+func (r *binaryReader) string() string {
+	size := r.uvarint()
+	if size > len(r.buf) {
+		r.err = errTruncated
+		return ""
+	}
+	return string(r.bytes(size))
+}
+
+func (r *binaryReader) gossip() []Member {
+	count := r.uvarint()
+	// every entry takes at least 6 bytes
+	if count*6 > len(r.buf) {
+		r.err = errTruncated
+		return nil
+	}
+	var members []Member
+	for i := 0; i < count; i++ {
+		member := Member{Pid: r.pid()}
+		if status := int(r.bytes(1)[0]); status < len(memberStatuses) {
+			member.Status = memberStatuses[status]
+		} else if r.err == nil {
+			r.err = fmt.Errorf("unknown member status %d", status)
+		}
+		member.Incarnation = r.uvarint()
+		member.Address = r.string()
+		member.Nickname = r.string()
+		members = append(members, member)
+	}
+	return members
+}
+
+func (r *binaryReader) direction() string {
+	code := int(r.bytes(1)[0])
+	if code >= len(DIRECTIONS) {
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown direction %d", code)
+		}
+		return DIRECTIONS[0]
+	}
+	return DIRECTIONS[code]
+}
+
+func (r *binaryReader) moveMap() map[string]Move {
+	count := r.uvarint()
+	// every player takes at least 6 bytes, so anything bigger is garbage
+	if count*6 > len(r.buf) {
+		r.err = errTruncated
+		return make(map[string]Move)
+	}
+	pids := make([]string, count)
+	moves := make(map[string]Move, count)
+	for i := range pids {
+		pids[i] = r.pid()
+		moves[pids[i]] = Move{X: int(r.uint16()), Y: int(r.uint16())}
+	}
+	directions := r.bytes((count + 3) / 4)
+	for i, pid := range pids {
+		move := moves[pid]
+		move.Direction = DIRECTIONS[(directions[i/4]>>uint(2*(i%4)))&3]
+		moves[pid] = move
+	}
+	return moves
+}
+
+// parseEncodings reads the comma separated encodings a peer says it speaks.
+func parseEncodings(list string) []string {
+	var encodings []string
+	for _, encoding := range strings.Split(list, ",") {
+		if encoding = strings.TrimSpace(encoding); encoding != "" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	return encodings
+}
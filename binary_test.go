@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// the messages that have a binary layout, as the decoder gives them back
+func binaryMessages() []Message {
+	gossip := []Member{{Pid: "2", Nickname: "bob", Address: "10.0.0.2:40000", Status: MemberSuspect, Incarnation: 3}}
+	move := newMyMoveMessage("RIGHT", "2", 7)
+	move.Ack = 6
+	return []Message{
+		&RoundStartMessage{
+			Envelope:   Envelope{MessageType: "roundstart", EventName: "roundStart", Round: 5, Term: 2},
+			RoundStart: RoundStart{Round: 5, Succession: []string{"3", "1"}, Dropped: []string{"4"}},
+		},
+		move,
+		&KillPlayerMessage{Envelope: Envelope{MessageType: "killplayer", EventName: "killplayer", Round: 3}, PlayerPID: "4"},
+		&MovesMessage{
+			Envelope: Envelope{MessageType: "moves", EventName: "moves", Round: 9, Term: 1, Gossip: gossip},
+			Moves: Moves{Round: 9, Checksum: 0xdeadbeef, Moves: []map[string]Move{
+				{"1": {X: 3, Y: 4, Direction: "LEFT"}, "2": {X: 10, Y: 11, Direction: "UP"}},
+				{"1": {X: 3, Y: 5, Direction: "DOWN"}},
+			}},
+		},
+		&GameOverMessage{
+			Envelope: Envelope{MessageType: "gameOver", EventName: "gameOver", Round: 40},
+			GameOver: GameOver{PidsInOrderOfDeath: []string{"3", "1"}, Left: map[string]string{"2": "kicked: rude", "5": "quit"}},
+		},
+		&LeaderElectionMessage{Envelope: Envelope{MessageType: "newleader", Round: 12, Term: 4}, LeaderID: 4, Address: "10.0.0.3:7000"},
+		&SnapshotMessage{
+			Envelope: Envelope{MessageType: "snapshot", EventName: "snapshot", Round: 20},
+			Snapshot: Snapshot{Round: 20, LeaderID: 3, Width: 30, Height: 30, Grid: []int{-1, 31, 0, 200, 2, 1},
+				Alive: []string{"1", "2"}, Positions: map[string]Move{"1": {X: 1, Y: 2, Direction: "UP"}}},
+		},
+		&ResyncMessage{Envelope: Envelope{MessageType: "resync", EventName: "resync", Round: 8}},
+		&HeartbeatMessage{Envelope: Envelope{MessageType: "heartbeat", EventName: "heartbeat"}, Heartbeat: Heartbeat{Sent: 1234567890123, Echo: true}},
+		&InputsMessage{
+			Envelope: Envelope{MessageType: "inputs", EventName: "inputs", Round: 6},
+			Inputs:   Inputs{Pid: "1", Checksum: 7, Directions: []string{"UP", "RIGHT", "DOWN"}, Dropped: map[string]int{"4": 5, "2": 6}},
+		},
+	}
+}
+
+// every message with a binary layout comes back as it went in
+func TestBinaryRoundTrip(t *testing.T) {
+	for _, message := range binaryMessages() {
+		buf, err := encodeBinaryMessage(message)
+		if err != nil {
+			t.Errorf("%s: %v", message.header().MessageType, err)
+			continue
+		}
+		decoded, err := decodeWireMessage(buf)
+		if err != nil {
+			t.Errorf("%s: %v", message.header().MessageType, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, message) {
+			t.Errorf("%s: got %+v back, sent %+v", message.header().MessageType, decoded, message)
+		}
+	}
+}
+
+// a message cut short anywhere is an error, never a crash
+func TestBinaryTruncated(t *testing.T) {
+	for _, message := range binaryMessages() {
+		buf, err := encodeBinaryMessage(message)
+		if err != nil {
+			t.Fatalf("%s: %v", message.header().MessageType, err)
+		}
+		for size := 0; size < len(buf); size++ {
+			if decoded, err := decodeBinaryMessage(buf[:size]); err == nil {
+				t.Errorf("%s cut to %d of %d bytes decoded to %+v", message.header().MessageType, size, len(buf), decoded)
+			}
+		}
+	}
+}
+
+func TestBinaryMalformed(t *testing.T) {
+	move, _ := encodeBinaryMessage(newMyMoveMessage("UP", "2", 7))
+	// magic, type, round, term, then the pid: the direction is the 7th byte
+	badDirection := append([]byte(nil), move...)
+	badDirection[6] = 7
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"unknown type", []byte{binaryMagic, 0xEE, 0, 0, 0}},
+		{"direction above 3", badDirection},
+		{"huge round", []byte{binaryMagic, binaryTypeCodes["resync"], 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01, 0, 0}},
+		{"more rounds than bytes", []byte{binaryMagic, binaryTypeCodes["inputs"], 1, 0, 0, 1, 0, 0, 0, 0, 0x7F, 0}},
+		{"more deaths than bytes", []byte{binaryMagic, binaryTypeCodes["gameOver"], 1, 0, 0x7F, 0, 1}},
+		{"more moves than bytes", []byte{binaryMagic, binaryTypeCodes["moves"], 1, 0, 1, 0, 0, 0, 0, 1, 0x7F, 0}},
+		{"unknown member status", append(append([]byte(nil), move[:len(move)-1]...), 1, 0, 2, 0xEE, 0, 0, 0)},
+	}
+	for _, test := range tests {
+		if decoded, err := decodeWireMessage(test.buf); err == nil {
+			t.Errorf("%s: decoded to %+v", test.name, decoded)
+		}
+	}
+}
+
+// a message the binary layout can't hold goes out as json instead
+func TestBinaryFallsBackToJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+	}{
+		{"no binary layout", &JoinMessage{Envelope: lobbyEnvelope("join"), Join: Join{Nickname: "carol"}}},
+		{"pid that isn't a number", newMyMoveMessage("UP", "carol", 1)},
+		{"unknown direction", newMyMoveMessage("SIDEWAYS", "2", 1)},
+	}
+	for _, test := range tests {
+		buf := encodeWireMessage(test.message, BINARY_ENCODING)
+		if len(buf) > 0 && buf[0] == binaryMagic {
+			t.Errorf("%s: went out in binary", test.name)
+		}
+	}
+}
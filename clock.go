@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Clock is where a node gets its time from and starts its goroutines. Everything a
+// node waits on goes through it, so a simulated clock knows when the whole node is idle.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	Go(f func())
+	NewMailbox() Mailbox
+}
+
+// A Mailbox passes messages between the goroutines of a node, like a buffered channel.
+type Mailbox interface {
+	Put(message interface{})
+	// Get blocks until a message arrives. It returns false once the mailbox is closed.
+	Get() (interface{}, bool)
+	Close()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+func (realClock) Go(f func())           { go f() }
+
+func (realClock) NewMailbox() Mailbox {
+	return &chanMailbox{ch: make(chan interface{}, 1)}
+}
+
+type chanMailbox struct {
+	mu     sync.Mutex
+	ch     chan interface{}
+	closed bool
+}
+
+func (m *chanMailbox) Put(message interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// nobody is listening to a closed mailbox any more, so there is nobody to tell
+	if !m.closed {
+		m.ch <- message
+	}
+}
+
+func (m *chanMailbox) Get() (interface{}, bool) {
+	message, ok := <-m.ch
+	return message, ok
+}
+
+func (m *chanMailbox) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.ch)
+	}
+}
+
+// rand.Rand is not safe for concurrent use, and a node draws from several goroutines
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func newLockedRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
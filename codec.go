@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Envelope is the header every message on the wire starts with. The messageType picks
+// the concrete message out of the registry.
+type Envelope struct {
+	MessageType string   `json:"messageType"`
+	EventName   string   `json:"eventName"`
+	Round       int      `json:"round"`
+	Term        int      `json:"term,omitempty"`   // of the leader that sent it, see election.go
+	Gossip      []Member `json:"gossip,omitempty"` // a few entries of the sender's membership table, see membership.go
+}
+
+func (e *Envelope) header() *Envelope {
+	return e
+}
+
+type Message interface {
+	header() *Envelope
+}
+
+// Messages that can be malformed in ways the json decoder doesn't catch check themselves.
+type validator interface {
+	validate() error
+}
+
+var messageRegistry = map[string]func() Message{
+	"roundstart":  func() Message { return &RoundStartMessage{} },
+	"mymove":      func() Message { return &MyMoveMessage{} },
+	"killplayer":  func() Message { return &KillPlayerMessage{} },
+	"moves":       func() Message { return &MovesMessage{} },
+	"startgame":   func() Message { return &GameStartMessage{} },
+	"gameOver":    func() Message { return &GameOverMessage{} },
+	"checkleader": func() Message { return &LeaderElectionMessage{} },
+	"leaderalive": func() Message { return &LeaderElectionMessage{} },
+	"leaderdead":  func() Message { return &LeaderElectionMessage{} },
+	"newleader":   func() Message { return &LeaderElectionMessage{} },
+	"snapshot":    func() Message { return &SnapshotMessage{} },
+	"resync":      func() Message { return &ResyncMessage{} },
+	"rejoin":      func() Message { return &RejoinMessage{} },
+	"statereport": func() Message { return &StateReportMessage{} },
+	"stepdown":    func() Message { return &StepDownMessage{} },
+	"stepdownack": func() Message { return &StepDownMessage{} },
+	"leave":       func() Message { return &LeaveMessage{} },
+	"playerleft":  func() Message { return &PlayerLeftMessage{} },
+	"heartbeat":   func() Message { return &HeartbeatMessage{} },
+	"inputs":      func() Message { return &InputsMessage{} },
+	"lobby":       func() Message { return &LobbyMessage{} },
+	"join":        func() Message { return &JoinMessage{} },
+	"accept":      func() Message { return &AcceptMessage{} },
+	"reject":      func() Message { return &RejectMessage{} },
+	"ready":       func() Message { return &ReadyMessage{} },
+	"start":       func() Message { return &StartMessage{} },
+	"roster":      func() Message { return &RosterMessage{} },
+	"kick":        func() Message { return &KickMessage{} },
+}
+
+func encodeMessage(message interface{}) []byte {
+	val, e := json.Marshal(message)
+	checkError(e)
+	return val
+}
+
+// decodeMessage turns a packet into its concrete message. Unknown or malformed packets
+// are an error, never a crash: anyone can send us anything.
+func decodeMessage(buf []byte) (Message, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(buf, &envelope); err != nil {
+		return nil, fmt.Errorf("malformed message %q: %v", buf, err)
+	}
+	newMessage, ok := messageRegistry[envelope.MessageType]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %q in %q", envelope.MessageType, buf)
+	}
+	message := newMessage()
+	if err := json.Unmarshal(buf, message); err != nil {
+		return nil, fmt.Errorf("malformed %s message %q: %v", envelope.MessageType, buf, err)
+	}
+	if v, ok := message.(validator); ok {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s message %q: %v", envelope.MessageType, buf, err)
+		}
+	}
+	return message, nil
+}
+
+// decodeFrontendMove reads the move the java frontend replies to a round start with.
+// The frontend doesn't speak the wire protocol, so it gets wrapped in a MyMoveMessage.
+func decodeFrontendMove(buf []byte) (*MyMoveMessage, error) {
+	var move struct {
+		EventName string `json:"eventName"`
+		Direction string `json:"direction"`
+		Pid       string `json:"pid"`
+		Round     int    `json:"round"`
+	}
+	if err := json.Unmarshal(buf, &move); err != nil {
+		return nil, fmt.Errorf("malformed move from the frontend %q: %v", buf, err)
+	}
+	if move.EventName != "myMove" {
+		return nil, fmt.Errorf("expected a myMove from the frontend, got %q", buf)
+	}
+	message := newMyMoveMessage(move.Direction, move.Pid, move.Round)
+	if err := message.validate(); err != nil {
+		return nil, fmt.Errorf("invalid move from the frontend %q: %v", buf, err)
+	}
+	return message, nil
+}
+
+func isDirection(direction string) bool {
+	for _, d := range DIRECTIONS {
+		if d == direction {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MyMoveMessage) validate() error {
+	if !isDirection(m.Direction) {
+		return errors.New("unknown direction " + m.Direction)
+	}
+	if m.Pid == "" {
+		return errors.New("missing pid")
+	}
+	return nil
+}
+
+func (m *KillPlayerMessage) validate() error {
+	if m.PlayerPID == "" {
+		return errors.New("missing pid")
+	}
+	return nil
+}
+
+func (m *MovesMessage) validate() error {
+	for _, moves := range m.Moves.Moves {
+		for pid, move := range moves {
+			if !isDirection(move.Direction) {
+				return errors.New("unknown direction " + move.Direction + " for player " + pid)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *GameStartMessage) validate() error {
+	if m.Pid == "" {
+		return errors.New("missing pid")
+	}
+	for pid, move := range m.StartingPositions {
+		if !isDirection(move.Direction) {
+			return errors.New("unknown direction " + move.Direction + " for player " + pid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// every kind of message comes back from its json as it went in
+func TestCodecRoundTrip(t *testing.T) {
+	gossip := []Member{{Pid: "2", Nickname: "bob", Address: "10.0.0.2:40000", Status: MemberAlive, Incarnation: 3}}
+	tests := []struct {
+		name    string
+		message Message
+	}{
+		{"mymove", newMyMoveMessage("UP", "2", 7)},
+		{"killplayer", &KillPlayerMessage{Envelope: Envelope{MessageType: "killplayer", EventName: "killPlayer", Round: 3}, PlayerPID: "4"}},
+		{"moves", &MovesMessage{
+			Envelope: Envelope{MessageType: "moves", EventName: "moves", Round: 9, Term: 2, Gossip: gossip},
+			Moves:    Moves{Moves: []map[string]Move{{"1": {X: 3, Y: 4, Direction: "LEFT"}}}, Round: 9, Checksum: 0xdeadbeef},
+		}},
+		{"gameOver", &GameOverMessage{
+			Envelope: Envelope{MessageType: "gameOver", EventName: "gameOver", Round: 40},
+			GameOver: GameOver{PidsInOrderOfDeath: []string{"3", "1"}, Left: map[string]string{"2": "kicked"}},
+		}},
+		{"newleader", &LeaderElectionMessage{Envelope: Envelope{MessageType: "newleader", EventName: "newLeader", Term: 4}, LeaderID: 4, Address: "10.0.0.3:7000"}},
+		{"leave", &LeaveMessage{Envelope: Envelope{MessageType: "leave", EventName: "leave", Round: 12}, Leave: Leave{Pid: "3", Reason: "quit"}}},
+		{"join", &JoinMessage{Envelope: lobbyEnvelope("join"), Join: Join{Nickname: "carol", Encodings: SUPPORTED_ENCODINGS, Spectate: true}}},
+		{"reject", &RejectMessage{Envelope: lobbyEnvelope("reject"), Reject: Reject{Reason: RejectBanned, RetryIn: 30}}},
+		{"inputs", &InputsMessage{
+			Envelope: Envelope{MessageType: "inputs", EventName: "inputs", Round: 6},
+			Inputs:   Inputs{Pid: "1", Checksum: 7, Directions: []string{"UP", "RIGHT"}, Dropped: map[string]int{"4": 5}},
+		}},
+	}
+	for _, test := range tests {
+		decoded, err := decodeMessage(encodeMessage(test.message))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, test.message) {
+			t.Errorf("%s: got %+v back, sent %+v", test.name, decoded, test.message)
+		}
+	}
+}
+
+// anything that isn't a whole, sensible message is an error, never a crash
+func TestCodecMalformed(t *testing.T) {
+	whole := string(encodeMessage(newMyMoveMessage("UP", "2", 7)))
+	tests := []struct {
+		name string
+		buf  string
+		want string
+	}{
+		{"empty", "", "malformed message"},
+		{"not json", "hello", "malformed message"},
+		{"truncated", whole[:len(whole)/2], "malformed message"},
+		{"no type", `{"round":1}`, "unknown message type"},
+		{"unknown type", `{"messageType":"teleport"}`, "unknown message type"},
+		{"field of the wrong type", `{"messageType":"mymove","myMove":{"pid":2}}`, "malformed mymove message"},
+		{"unknown direction", `{"messageType":"mymove","myMove":{"pid":"2","direction":"SIDEWAYS"}}`, "invalid mymove message"},
+		{"missing pid", `{"messageType":"killplayer"}`, "invalid killplayer message"},
+		{"bad direction in moves", `{"messageType":"moves","moves":{"moves":[{"1":{"direction":"NORTH"}}]}}`, "invalid moves message"},
+		{"unknown direction in inputs", `{"messageType":"inputs","inputs":{"pid":"1","directions":["UP","BACK"]}}`, "invalid inputs message"},
+		{"inputs without directions", `{"messageType":"inputs","inputs":{"pid":"1"}}`, "invalid inputs message"},
+	}
+	for _, test := range tests {
+		message, err := decodeMessage([]byte(test.buf))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v and %v, want an error with %q", test.name, message, err, test.want)
+		}
+	}
+}
+
+// the frontend's moves get wrapped up, anything else it sends is refused
+func TestDecodeFrontendMove(t *testing.T) {
+	tests := []struct {
+		buf  string
+		want *MyMoveMessage
+	}{
+		{`{"eventName":"myMove","direction":"LEFT","pid":"3","round":5}`, newMyMoveMessage("LEFT", "3", 5)},
+		{`{"eventName":"myMove","direction":"LEFT"}`, nil},
+		{`{"eventName":"myMove","direction":"BACK","pid":"3"}`, nil},
+		{`{"eventName":"ready","ready":true}`, nil},
+		{`{"eventName":"myMove"`, nil},
+	}
+	for _, test := range tests {
+		move, err := decodeFrontendMove([]byte(test.buf))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", test.buf, move)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(move, test.want) {
+			t.Errorf("%s: got %+v and %v, want %+v", test.buf, move, err, test.want)
+		}
+	}
+}
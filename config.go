@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Config holds everything needed to launch a node: where the frontend and leader are,
+// the player, and the game tunables. Values come from DefaultConfig, then an optional
+// JSON config file, then any flags given explicitly on the command line.
+type Config struct {
+	JavaPort string `json:"javaPort"`
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"isLeader"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Nickname string `json:"nickname"`
+	AI       bool   `json:"ai"`
+
+	DisableGameOver            bool           `json:"disableGameOver"` // to allow single player game for debugging
+	CollisionIsDeath           bool           `json:"collisionIsDeath"`
+	MinGameSpeed               time.Duration  `json:"minGameSpeed"`               // time between every new java move
+	FollowerResponseTime       time.Duration  `json:"followerResponseTime"`       // time for followers to respond
+	MaxAllowableMissedMessages int            `json:"maxAllowableMissedMessages"` // max number of consecutive missed messages
+	FollowerResponseFailRate   map[string]int `json:"followerResponseFailRate"`   // out of 1000, fail rate for responses not to be received
+	Metrics                    bool           `json:"metrics"`                    // enable metrics
+
+	RoundLatencyFilename    string `json:"roundLatencyFilename"`
+	ReadThroughputFilename  string `json:"readThroughputFilename"`
+	WriteThroughputFilename string `json:"writeThroughputFilename"`
+
+	AIStartDelay time.Duration `json:"aiStartDelay"` // how long an ai host waits for players before starting
+	WireEncoding string        `json:"wireEncoding"` // encoding the leader would like to play in, if every player speaks it
+	Rejoin       string        `json:"rejoin"`       // pid:token to get back into a running game with
+	Encrypt      bool          `json:"encrypt"`      // encrypt all traffic between players
+	Password     string        `json:"password"`     // players need it to join, implies encrypt
+	Invite       bool          `json:"invite"`       // the host makes up an invite code players need to join instead
+	TermDir      string        `json:"termDir"`      // where the election term is kept across restarts, nowhere if empty
+
+	HeartbeatInterval time.Duration `json:"heartbeatInterval"` // between heartbeats to and from the leader, none if 0
+	SuspectPhi        float64       `json:"suspectPhi"`        // how sure a follower has to be the leader is gone to stand for election
+	DropPhi           float64       `json:"dropPhi"`           // how sure the leader has to be a player is gone to drop it
+
+	Lockstep bool `json:"lockstep"` // nobody leads the game once it starts, only the host's counts
+
+	MinPlayers int           `json:"minPlayers"` // the game can't start with fewer
+	MaxPlayers int           `json:"maxPlayers"` // the lobby turns away any more
+	Countdown  time.Duration `json:"countdown"`  // from everyone being ready to the game starting
+
+	LobbyGroup string `json:"lobbyGroup"` // multicast ip:port lobbies are announced on, none if empty
+	Discover   bool   `json:"discover"`   // find the leader among the lobbies announced on the lan
+
+	Admin    bool `json:"admin"`    // take kick and ban commands on stdin
+	Spectate bool `json:"spectate"` // only watch the game
+
+	Simulate int   `json:"simulate"` // play a match of this many ai players on a simulated network instead
+	Seed     int64 `json:"seed"`     // seed for the simulation
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Width:                      200,
+		Height:                     200,
+		DisableGameOver:            false,
+		CollisionIsDeath:           true,
+		MinGameSpeed:               1000 / 40 * time.Millisecond,
+		FollowerResponseTime:       500 * 4 * time.Millisecond,
+		MaxAllowableMissedMessages: 5,
+		FollowerResponseFailRate:   map[string]int{"1": 0},
+		Metrics:                    false,
+		RoundLatencyFilename:       "round-latency.csv",
+		ReadThroughputFilename:     "read-throughput.csv",
+		WriteThroughputFilename:    "write-throughput.csv",
+		AIStartDelay:               2 * time.Second,
+		WireEncoding:               JSON_ENCODING,
+		TermDir:                    ".",
+		HeartbeatInterval:          250 * time.Millisecond,
+		SuspectPhi:                 8,
+		DropPhi:                    16,
+		MinPlayers:                 1,
+		MaxPlayers:                 8,
+		Countdown:                  3 * time.Second,
+		LobbyGroup:                 "239.255.53.8:5308",
+		Seed:                       1,
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Durations are written as strings such as "25ms" in the config file.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	t := reflect.TypeOf(*c)
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("json")
+		raw, ok := fields[name]
+		if t.Field(i).Type != durationType || !ok {
+			continue
+		}
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return fmt.Errorf("%s: durations are written like \"25ms\"", name)
+		}
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fields[name], _ = json.Marshal(int64(d))
+	}
+	data, _ = json.Marshal(fields)
+	type plain Config
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+func LoadConfigFile(path string, c *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// ParseConfig builds a Config from command line arguments (without the program name).
+// Flags override the config file, which overrides the defaults.
+func ParseConfig(args []string) (Config, error) {
+	c := DefaultConfig()
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to a JSON config file")
+	flags := DefaultConfig()
+	fs.StringVar(&flags.JavaPort, "java-port", "", "port the java frontend is listening on")
+	fs.StringVar(&flags.Leader, "leader", "", "ip:port of the leader to join, or to listen on when hosting")
+	fs.BoolVar(&flags.IsLeader, "host", false, "host the lobby and lead the game")
+	fs.IntVar(&flags.Width, "width", flags.Width, "grid width")
+	fs.IntVar(&flags.Height, "height", flags.Height, "grid height")
+	fs.StringVar(&flags.Nickname, "nickname", "", "player nickname")
+	fs.BoolVar(&flags.AI, "ai", false, "play with the built in ai instead of the java frontend")
+	fs.BoolVar(&flags.DisableGameOver, "disable-game-over", flags.DisableGameOver, "never end the game (single player debugging)")
+	fs.BoolVar(&flags.CollisionIsDeath, "collision-is-death", flags.CollisionIsDeath, "kill players that collide")
+	fs.DurationVar(&flags.MinGameSpeed, "min-game-speed", flags.MinGameSpeed, "time between every new move")
+	fs.DurationVar(&flags.FollowerResponseTime, "follower-response-time", flags.FollowerResponseTime, "time for followers to respond each round")
+	fs.IntVar(&flags.MaxAllowableMissedMessages, "max-missed-messages", flags.MaxAllowableMissedMessages, "consecutive missed rounds before a player is dropped")
+	fs.BoolVar(&flags.Metrics, "metrics", flags.Metrics, "record latency and throughput csv files")
+	fs.StringVar(&flags.Rejoin, "rejoin", "", "rejoin a running game as pid:token, printed when the game started")
+	fs.StringVar(&flags.WireEncoding, "wire-encoding", flags.WireEncoding, "encoding to play in when hosting if every player speaks it (json or binary)")
+	fs.BoolVar(&flags.Encrypt, "encrypt", false, "encrypt all traffic, every player has to pass it too")
+	fs.StringVar(&flags.Password, "password", "", "password of the game, or the invite code when joining one, implies -encrypt")
+	fs.BoolVar(&flags.Invite, "invite", false, "when hosting, make up an invite code players have to give as -password, implies -encrypt")
+	fs.StringVar(&flags.TermDir, "term-dir", flags.TermDir, "directory to keep the election term in across restarts, empty to keep it in memory")
+	fs.DurationVar(&flags.HeartbeatInterval, "heartbeat-interval", flags.HeartbeatInterval, "time between heartbeats, 0 to go by moves alone")
+	fs.Float64Var(&flags.SuspectPhi, "suspect-phi", flags.SuspectPhi, "phi at which a follower suspects the leader and stands for election")
+	fs.Float64Var(&flags.DropPhi, "drop-phi", flags.DropPhi, "phi at which the leader drops a player")
+	fs.BoolVar(&flags.Lockstep, "lockstep", false, "when hosting, play without a leader: everyone sends their moves to everyone")
+	fs.IntVar(&flags.MinPlayers, "min-players", flags.MinPlayers, "when hosting, players needed to start")
+	fs.IntVar(&flags.MaxPlayers, "max-players", flags.MaxPlayers, "when hosting, most players let in")
+	fs.DurationVar(&flags.Countdown, "countdown", flags.Countdown, "when hosting, time from everyone being ready to the game starting")
+	fs.StringVar(&flags.LobbyGroup, "lobby-group", flags.LobbyGroup, "multicast ip:port to announce lobbies on and find them, empty not to")
+	fs.BoolVar(&flags.Discover, "discover", false, "pick the lobby to join from those announced on the lan instead of giving -leader")
+	fs.BoolVar(&flags.Admin, "admin", false, "read kick and ban commands from stdin, the leader takes them from its own player")
+	fs.BoolVar(&flags.Spectate, "spectate", false, "join only to watch the game, even once it has started")
+	fs.IntVar(&flags.Simulate, "simulate", 0, "play a match of this many ai players on a simulated network and print the results")
+	fs.Int64Var(&flags.Seed, "seed", flags.Seed, "seed for -simulate")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if fs.NArg() > 0 {
+		return c, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if *configPath != "" {
+		if err := LoadConfigFile(*configPath, &c); err != nil {
+			return c, err
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "java-port":
+			c.JavaPort = flags.JavaPort
+		case "leader":
+			c.Leader = flags.Leader
+		case "host":
+			c.IsLeader = flags.IsLeader
+		case "width":
+			c.Width = flags.Width
+		case "height":
+			c.Height = flags.Height
+		case "nickname":
+			c.Nickname = flags.Nickname
+		case "ai":
+			c.AI = flags.AI
+		case "disable-game-over":
+			c.DisableGameOver = flags.DisableGameOver
+		case "collision-is-death":
+			c.CollisionIsDeath = flags.CollisionIsDeath
+		case "min-game-speed":
+			c.MinGameSpeed = flags.MinGameSpeed
+		case "follower-response-time":
+			c.FollowerResponseTime = flags.FollowerResponseTime
+		case "max-missed-messages":
+			c.MaxAllowableMissedMessages = flags.MaxAllowableMissedMessages
+		case "metrics":
+			c.Metrics = flags.Metrics
+		case "rejoin":
+			c.Rejoin = flags.Rejoin
+		case "wire-encoding":
+			c.WireEncoding = flags.WireEncoding
+		case "encrypt":
+			c.Encrypt = flags.Encrypt
+		case "password":
+			c.Password = flags.Password
+		case "invite":
+			c.Invite = flags.Invite
+		case "term-dir":
+			c.TermDir = flags.TermDir
+		case "heartbeat-interval":
+			c.HeartbeatInterval = flags.HeartbeatInterval
+		case "suspect-phi":
+			c.SuspectPhi = flags.SuspectPhi
+		case "drop-phi":
+			c.DropPhi = flags.DropPhi
+		case "lockstep":
+			c.Lockstep = flags.Lockstep
+		case "min-players":
+			c.MinPlayers = flags.MinPlayers
+		case "max-players":
+			c.MaxPlayers = flags.MaxPlayers
+		case "countdown":
+			c.Countdown = flags.Countdown
+		case "lobby-group":
+			c.LobbyGroup = flags.LobbyGroup
+		case "discover":
+			c.Discover = flags.Discover
+		case "admin":
+			c.Admin = flags.Admin
+		case "spectate":
+			c.Spectate = flags.Spectate
+		case "simulate":
+			c.Simulate = flags.Simulate
+		case "seed":
+			c.Seed = flags.Seed
+		}
+	})
+	return c, c.Validate()
+}
+
+// Validate reports every problem with the config at once.
+func (c Config) Validate() error {
+	var problems []string
+	// a simulation makes up its own players
+	if c.Simulate == 0 {
+		if c.Leader == "" && !c.Discover {
+			problems = append(problems, "a leader address is required (-leader or -discover)")
+		}
+		if c.Nickname == "" {
+			problems = append(problems, "a nickname is required (-nickname)")
+		}
+		if c.JavaPort == "" && !c.AI {
+			problems = append(problems, "a java port is required unless playing as the ai (-java-port or -ai)")
+		}
+	} else if c.Simulate < 0 {
+		problems = append(problems, "can't simulate a negative number of players")
+	}
+	// Give a small buffer so players don't spawn crashing into a wall
+	if c.Width < 30 || c.Height < 30 {
+		problems = append(problems, fmt.Sprintf("grid dimensions %dx%d are too small, need at least 30x30", c.Width, c.Height))
+	}
+	if c.Rejoin != "" {
+		if _, _, err := parseSession(c.Rejoin); err != nil {
+			problems = append(problems, "can't rejoin: "+err.Error())
+		}
+		if c.IsLeader {
+			problems = append(problems, "the leader can't rejoin its own game")
+		}
+	}
+	if c.Invite && (!c.IsLeader || c.Password != "") {
+		problems = append(problems, "only a host without a password makes up an invite code")
+	}
+	if c.MinPlayers < 1 || c.MaxPlayers < c.MinPlayers {
+		problems = append(problems, fmt.Sprintf("can't have between %d and %d players", c.MinPlayers, c.MaxPlayers))
+	}
+	if c.Countdown < 0 {
+		problems = append(problems, "countdown can't be negative")
+	}
+	if c.LobbyGroup != "" {
+		if group, err := net.ResolveUDPAddr("udp4", c.LobbyGroup); err != nil || !group.IP.IsMulticast() {
+			problems = append(problems, "lobby group "+c.LobbyGroup+" is not a multicast ip:port")
+		}
+	}
+	if c.Discover {
+		if c.LobbyGroup == "" {
+			problems = append(problems, "can't discover lobbies without a lobby group (-lobby-group)")
+		}
+		if c.IsLeader || c.Rejoin != "" || c.AI {
+			problems = append(problems, "only a player joining from the java frontend can discover lobbies")
+		}
+	}
+	if c.Spectate && c.IsLeader {
+		problems = append(problems, "the host can't only watch its own game")
+	}
+	if c.WireEncoding != JSON_ENCODING && c.WireEncoding != BINARY_ENCODING {
+		problems = append(problems, "unknown wire encoding "+c.WireEncoding+", expected json or binary")
+	}
+	if c.MinGameSpeed <= 0 {
+		problems = append(problems, "min game speed must be positive")
+	}
+	if c.FollowerResponseTime < c.MinGameSpeed {
+		problems = append(problems, "can't set follower response time to be less than min game speed")
+	}
+	// the leader continues a player's move from the round before, so it needs at least two rounds of history
+	if c.MaxAllowableMissedMessages < 2 {
+		problems = append(problems, "max allowable missed messages must be at least 2")
+	}
+	if c.HeartbeatInterval < 0 {
+		problems = append(problems, "heartbeat interval can't be negative")
+	}
+	if c.HeartbeatInterval > 0 && (c.SuspectPhi <= 0 || c.DropPhi <= 0) {
+		problems = append(problems, "suspect and drop phi must be positive")
+	}
+	for pid, rate := range c.FollowerResponseFailRate {
+		if rate < 0 || rate > 1000 {
+			problems = append(problems, fmt.Sprintf("fail rate %d for player %s is not out of 1000", rate, pid))
+		}
+	}
+	if c.Metrics && (c.RoundLatencyFilename == "" || c.ReadThroughputFilename == "" || c.WriteThroughputFilename == "") {
+		problems = append(problems, "metrics need all three csv file names")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Options turns the launch part of the config into node options.
+func (c Config) Options() []NodeOption {
+	opts := []NodeOption{
+		WithConfig(c),
+		WithJavaPort(c.JavaPort),
+		WithLeader(c.Leader, c.IsLeader),
+		WithGridSize(c.Width, c.Height),
+		WithNickname(c.Nickname),
+	}
+	if c.AI {
+		opts = append(opts, WithAI())
+	}
+	if pid, token, err := parseSession(c.Rejoin); err == nil {
+		opts = append(opts, WithSession(pid, token))
+	}
+	return opts
+}
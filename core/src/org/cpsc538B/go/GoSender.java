@@ -15,6 +15,7 @@ import org.cpsc538B.screens.GameScreen;
 import org.cpsc538B.utils.JSONUtils;
 
 import java.io.BufferedReader;
+import java.io.File;
 import java.io.IOException;
 import java.io.InputStreamReader;
 import java.io.PrintWriter;
@@ -41,11 +42,20 @@ public class GoSender implements Disposable {
             .put("moves", MovesEvent.class)
             .put("gameStart", GameStartEvent.class)
             .put("gameOver", GameOverEvent.class)
+            .put("playerLeft", PlayerLeftEvent.class)
+            .put("members", MembersEvent.class)
+            .put("prediction", PredictionEvent.class)
+            .put("lobbies", LobbiesEvent.class)
+            .put("roster", RosterEvent.class)
+            .put("reject", RejectEvent.class)
             .build();
     private BufferedReader goInputStream;
     private PrintWriter goOutputStream;
 
-    public void init(final String masterAddress, final String nickname, final boolean leader, GoInitializedCallback callback) {
+    // a null masterAddress has go look for lobbies on the lan, answer a LobbiesEvent with the leader to join
+    // an empty password joins or hosts an open game, except that a leader with invite makes up a code to join with
+    // a spectator only watches, and can join a game that is under way
+    public void init(final String masterAddress, final String nickname, final boolean leader, final String password, final boolean invite, final boolean spectate, GoInitializedCallback callback) {
         // spawn server
         try {
             serverSocket = new ServerSocket(0);
@@ -60,7 +70,28 @@ public class GoSender implements Disposable {
         new Thread(() -> {
             try {
                 Runtime r = Runtime.getRuntime();
-                final ProcessBuilder processBuilder = new ProcessBuilder("go", "run", "../../server.go", Integer.toString(serverSocket.getLocalPort()), masterAddress, Boolean.toString(leader), Integer.toString(GameScreen.GRID_WIDTH), Integer.toString(GameScreen.GRID_HEIGHT), nickname);
+                final List<String> command = new ArrayList<>(Arrays.asList("go", "run"));
+                command.addAll(goSources(new File("../..")));
+                command.addAll(Arrays.asList("-java-port", Integer.toString(serverSocket.getLocalPort())));
+                if (masterAddress == null) {
+                    command.add("-discover");
+                } else {
+                    command.addAll(Arrays.asList("-leader", masterAddress));
+                }
+                command.addAll(Arrays.asList(
+                        "-host=" + leader,
+                        "-width", Integer.toString(GameScreen.GRID_WIDTH),
+                        "-height", Integer.toString(GameScreen.GRID_HEIGHT),
+                        "-nickname", nickname));
+                if (leader && invite) {
+                    command.add("-invite");
+                } else if (!password.isEmpty()) {
+                    command.addAll(Arrays.asList("-password", password));
+                }
+                if (spectate) {
+                    command.add("-spectate");
+                }
+                final ProcessBuilder processBuilder = new ProcessBuilder(command);
                 Gdx.app.log(TronP2PGame.LOG_TAG, "Running the following command:" + System.lineSeparator() + processBuilder.command() + System.lineSeparator());
                 goProcess = processBuilder.start();
 
@@ -105,7 +136,13 @@ public class GoSender implements Disposable {
                     final String name = jsonNode.get("eventName").asText();
                     final int round = jsonNode.get("round").asInt();
                     Gdx.app.log(TronP2PGame.SERVER_TAG, "Event received is of type " + name + " for round " + round);
-                    final Object event = JSONUtils.getMapper().treeToValue(jsonNode.get(name), nameToEvent.get(name));
+                    if (!nameToEvent.containsKey(name)) {
+                        Gdx.app.log(TronP2PGame.SERVER_TAG, "Ignoring an event we don't know about");
+                        continue;
+                    }
+                    // events that are just a list (members, lobbies) are read from the whole message
+                    final JsonNode body = jsonNode.get(name).isArray() ? jsonNode : jsonNode.get(name);
+                    final Object event = JSONUtils.getMapper().treeToValue(body, nameToEvent.get(name));
                     // special case if a game start event is received
                     if (event instanceof GameStartEvent) {
                         GameStartEvent gameStartEvent = (GameStartEvent) event;
@@ -121,6 +158,18 @@ public class GoSender implements Disposable {
         }).start();
     }
 
+    // the go server is split over several files in the repository root, all of which go run needs
+    private static List<String> goSources(File directory) {
+        final List<String> sources = new ArrayList<>();
+        final File[] files = directory.listFiles((dir, name) -> name.endsWith(".go") && !name.endsWith("_test.go"));
+        Preconditions.checkNotNull(files, "Couldn't list go sources in " + directory);
+        for (File file : files) {
+            sources.add(file.getPath());
+        }
+        Collections.sort(sources);
+        return sources;
+    }
+
     public void sendToGo(Object event) {
         Preconditions.checkNotNull(goOutputStream != null, "Go output stream is null");
         Preconditions.checkNotNull(event, "Event is null");
@@ -134,6 +183,19 @@ public class GoSender implements Disposable {
         goOutputStream.println(string);
     }
 
+    // only the lobby's events, so the game's stay queued for the game screen
+    public Collection<Object> getLobbyEvents() {
+        List<Object> events = new ArrayList<>();
+        goEvents.removeIf(event -> {
+            final boolean lobby = event instanceof LobbiesEvent || event instanceof RosterEvent || event instanceof RejectEvent;
+            if (lobby) {
+                events.add(event);
+            }
+            return lobby;
+        });
+        return events;
+    }
+
     public Collection<Object> getGoEvents() {
         List<Object> events = new ArrayList<>();
         while (!goEvents.isEmpty()) {
@@ -211,4 +273,103 @@ public class GoSender implements Disposable {
     public static class GameOverEvent {
         List<String> pidsInOrderOfDeath;
     }
+
+    @Data
+    public static class PlayerLeftEvent {
+        String pid;
+        String reason;
+    }
+
+    @Data
+    public static class Member {
+        String pid;
+        String nickname;
+        String address;
+        String status;
+        int incarnation;
+    }
+
+    @Data
+    public static class MembersEvent {
+        List<Member> members;
+    }
+
+    @Data
+    public static class Lobby {
+        String name;
+        String leader;
+        int players;
+        int max;
+        int width;
+        int height;
+        boolean password;
+        boolean lockstep;
+    }
+
+    @Data
+    public static class LobbiesEvent {
+        List<Lobby> lobbies;
+    }
+
+    @Data
+    public static class LobbyPlayer {
+        String pid;
+        String nickname;
+        boolean ready;
+    }
+
+    @Data
+    public static class RosterEvent {
+        List<LobbyPlayer> players;
+        int min;
+        int max;
+        boolean starting;
+        int countdown;
+        String invite;
+        List<String> watching;
+    }
+
+    @Data
+    public static class RejectEvent {
+        String reason;
+        int retryIn;
+    }
+
+    @Data
+    @NoArgsConstructor
+    public static class ReadyEvent {
+        String eventName = "ready";
+        boolean ready;
+
+        public ReadyEvent(boolean ready) {
+            this.ready = ready;
+        }
+    }
+
+    @Data
+    public static class StartEvent {
+        String eventName = "start";
+    }
+
+    // only the leader's player gets to kick, player is a pid or a nickname
+    @Data
+    @NoArgsConstructor
+    public static class KickEvent {
+        String eventName = "kick";
+        String player;
+        String reason;
+        boolean ban;
+
+        public KickEvent(String player, String reason, boolean ban) {
+            this.player = player;
+            this.reason = reason;
+            this.ban = ban;
+        }
+    }
+
+    @Data
+    public static class PredictionEvent {
+        int confirmed;
+        List<Map<String, PositionAndDirection>> moves;
+    }
 }
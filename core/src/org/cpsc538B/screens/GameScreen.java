@@ -3,6 +3,7 @@ package org.cpsc538B.screens;
 import com.badlogic.gdx.Gdx;
 import com.badlogic.gdx.ScreenAdapter;
 import com.badlogic.gdx.graphics.Color;
+import com.badlogic.gdx.graphics.GL20;
 import com.badlogic.gdx.graphics.glutils.ShapeRenderer;
 import com.badlogic.gdx.math.Vector2;
 import com.badlogic.gdx.scenes.scene2d.Stage;
@@ -51,7 +52,12 @@ public class GameScreen extends ScreenAdapter {
     private final Map<String, PositionAndDirection> playerPositions;
     private final int[][] grid;
     private final String pid;
+    // who the camera follows, a spectator has no cycle so it follows the first player
+    private final String followed;
     private int round;
+    // what go expects to happen in the rounds after confirmedRound, until their moves arrive
+    private List<Map<String, PositionAndDirection>> predictedMoves = new ArrayList<>();
+    private int confirmedRound;
 
     private float accumulator;
 
@@ -72,6 +78,7 @@ public class GameScreen extends ScreenAdapter {
         this.pid = pid;
         grid = new int[GRID_WIDTH][GRID_HEIGHT];
         playerPositions = startingPositions;
+        followed = startingPositions.containsKey(pid) ? pid : new TreeSet<>(startingPositions.keySet()).first();
         tronInput = new TronInput(getPositionAndDirection().getDirection());
         viewport = new StretchViewport(V_WIDTH, V_HEIGHT);
         round = 0;
@@ -115,6 +122,11 @@ public class GameScreen extends ScreenAdapter {
                 final ImmutableMap<String, PositionAndDirection> oldPositions = ImmutableMap.copyOf(playerPositions);
                 final GoSender.MovesEvent movesEvent = (GoSender.MovesEvent) event;
                 final List<Map<String, PositionAndDirection>> moves = movesEvent.getMoves();
+                if (movesEvent.getRound() > confirmedRound) {
+                    // the prediction for these rounds is overtaken, go sends a new one if there are rounds left
+                    confirmedRound = movesEvent.getRound();
+                    predictedMoves = new ArrayList<>();
+                }
                 moves.forEach(roundMoves -> {
                     roundMoves.entrySet().forEach(entry -> {
                         final PositionAndDirection move = entry.getValue();
@@ -131,6 +143,30 @@ public class GameScreen extends ScreenAdapter {
                     }
                 });
 
+            } else if (event instanceof GoSender.PredictionEvent) {
+                final GoSender.PredictionEvent predictionEvent = (GoSender.PredictionEvent) event;
+                if (predictionEvent.getConfirmed() >= confirmedRound) {
+                    predictedMoves = predictionEvent.getMoves();
+                }
+            } else if (event instanceof GoSender.MembersEvent) {
+                // anyone that isn't just playing gets their status after their name
+                ((GoSender.MembersEvent) event).getMembers().forEach(member -> {
+                    final Label label = pidToLabel.get(member.getPid());
+                    final String nickname = game.getNicknames().get(member.getPid());
+                    if (label == null || nickname == null) {
+                        return;
+                    }
+                    String text = nickname;
+                    if (!"alive".equals(member.getStatus())) {
+                        text += " (" + member.getStatus().toUpperCase() + ")";
+                    }
+                    if (label.getText().toString().endsWith("(DEAD)")) {
+                        text += " (DEAD)";
+                    }
+                    label.setText(text);
+                });
+            } else if (event instanceof GoSender.PlayerLeftEvent) {
+                // the roster that follows it says so
             } else if (event instanceof GoSender.GameOverEvent) {
                 final List<String> pidsInOrderOfDeath = ((GoSender.GameOverEvent) event).getPidsInOrderOfDeath();
                 game.setScreen(new GameOverScreen(game, pidsInOrderOfDeath));
@@ -154,6 +190,7 @@ public class GameScreen extends ScreenAdapter {
 
         drawWalls(shapeRenderer);
         drawGrid(shapeRenderer);
+        drawPredictions(shapeRenderer);
         drawPlayers(shapeRenderer);
         hud.act(delta);
         hud.draw();
@@ -176,6 +213,22 @@ public class GameScreen extends ScreenAdapter {
         shapeRenderer.end();
     }
 
+    // predicted trails are drawn faded, and go away when the real moves arrive
+    private void drawPredictions(ShapeRenderer shapeRenderer) {
+        Gdx.gl.glEnable(GL20.GL_BLEND);
+        shapeRenderer.begin(ShapeRenderer.ShapeType.Filled);
+        predictedMoves.forEach(roundMoves -> roundMoves.entrySet().forEach(entry -> {
+            final Color color = pidToColor.get(entry.getKey());
+            if (color == null) {
+                return;
+            }
+            shapeRenderer.setColor(color.r, color.g, color.b, 0.5f);
+            shapeRenderer.rect(entry.getValue().getX() * GRID_SIZE, entry.getValue().getY() * GRID_SIZE, GRID_SIZE, GRID_SIZE);
+        }));
+        shapeRenderer.end();
+        Gdx.gl.glDisable(GL20.GL_BLEND);
+    }
+
     // debug
     private void printGrid() {
         for (int[] row : grid) {
@@ -183,8 +236,12 @@ public class GameScreen extends ScreenAdapter {
         }
     }
 
+    // where we are (or who we watch) as far as we know, predicted if go has a prediction
     private PositionAndDirection getPositionAndDirection() {
-        return playerPositions.get(pid);
+        if (!predictedMoves.isEmpty() && predictedMoves.get(predictedMoves.size() - 1).containsKey(followed)) {
+            return predictedMoves.get(predictedMoves.size() - 1).get(followed);
+        }
+        return playerPositions.get(followed);
     }
 
     private void drawGrid(ShapeRenderer shapeRenderer) {
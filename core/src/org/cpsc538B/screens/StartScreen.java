@@ -35,6 +35,14 @@ public class StartScreen extends ScreenAdapter {
     public static final String START_A_GAME = "START A GAME";
     public static final String JOIN_A_GAME = "JOIN A GAME";
     public static final String CREATE_A_GAME = "CREATE A GAME";
+    public static final String FIND_A_GAME = "FIND A GAME";
+    public static final String WATCH_A_GAME = "WATCH A GAME";
+    public static final String READY = "READY";
+    public static final String NOT_READY = "NOT READY";
+    public static final String OPEN_GAME = "ANYONE CAN JOIN";
+    public static final String INVITE_ONLY = "INVITE CODE ONLY";
+    public static final String KICK = "KICK";
+    public static final String BAN = "BAN";
     public static final String TRON = "TRON";
     private final Stage stage;
     private final Table rootTable;
@@ -42,6 +50,19 @@ public class StartScreen extends ScreenAdapter {
     private boolean readyToGo = false;
     private String pid;
     private Map<String, PositionAndDirection> startingPositions;
+    // the lobbies go found on the lan, until we pick one
+    private final Table lobbiesTable;
+    private boolean discovering = false;
+    // who is in the lobby we joined, and whether they are ready
+    private final Table rosterTable;
+    private final TextButton readyButton;
+    private boolean inLobby = false;
+    private boolean ready = false;
+    // whether a game we create makes up an invite code to join with
+    private boolean invite = false;
+    // the host can kick everyone else out of the lobby
+    private boolean hosting = false;
+    private String nickname;
     final List<String> sampleNames = ImmutableList.of("Blinky", "Pacman", "Robocop", "DemonSlayer", "HAL", "ChickenLittle", "HansSolo", "Yoshi", "EcologyFan", "Ghost", "GoLeafsGo", "Batman");
 
 
@@ -59,17 +80,30 @@ public class StartScreen extends ScreenAdapter {
         final TextField leaderIpField = new TextField(DEFAULT_IP, game.getAssets().getTextFieldStyle());
         final String defaultName = sampleNames.get(RandomUtils.nextInt(0, sampleNames.size()));
         final TextField nameField = new TextField(defaultName, game.getAssets().getTextFieldStyle());
+        final TextField passwordField = new TextField("", game.getAssets().getTextFieldStyle());
+        passwordField.setPasswordCharacter('*');
+        passwordField.setPasswordMode(true);
 
         final TextButton startAGame = new TextButton(START_A_GAME, game.getAssets().getTextButtonStyle());
         final TextButton joinAGame = new TextButton(JOIN_A_GAME, game.getAssets().getTextButtonStyle());
         final TextButton createAGame = new TextButton(CREATE_A_GAME, game.getAssets().getTextButtonStyle());
+        final TextButton findAGame = new TextButton(FIND_A_GAME, game.getAssets().getTextButtonStyle());
+        final TextButton watchAGame = new TextButton(WATCH_A_GAME, game.getAssets().getTextButtonStyle());
+        readyButton = new TextButton(READY, game.getAssets().getTextButtonStyle());
+        final TextButton inviteButton = new TextButton(OPEN_GAME, game.getAssets().getTextButtonStyle());
+        lobbiesTable = new Table();
+        lobbiesTable.defaults().pad(5f);
+        rosterTable = new Table();
+        rosterTable.defaults().pad(5f);
+        readyButton.setTouchable(Touchable.disabled);
+        readyButton.setDisabled(true);
         startAGame.setTouchable(Touchable.disabled);
         startAGame.setDisabled(true);
 
         createAGame.addListener(new ClickListener() {
             @Override
             public void clicked(InputEvent event, float x, float y) {
-                StartScreen.this.game.getGoSender().init(leaderIpField.getText(), nameField.getText(), true, (pid1, startingPositions1, nicknames) -> {
+                StartScreen.this.game.getGoSender().init(leaderIpField.getText(), nameField.getText(), true, passwordField.getText(), invite, false, (pid1, startingPositions1, nicknames) -> {
                     // need the actual switch to happpen on the thread in the render loop unfortunately
                     StartScreen.this.pid = pid1;
                     StartScreen.this.startingPositions = startingPositions1;
@@ -80,20 +114,32 @@ public class StartScreen extends ScreenAdapter {
                 joinAGame.setTouchable(Touchable.disabled);
                 createAGame.setDisabled(true);
                 createAGame.setTouchable(Touchable.disabled);
+                findAGame.setDisabled(true);
+                findAGame.setTouchable(Touchable.disabled);
+                watchAGame.setDisabled(true);
+                watchAGame.setTouchable(Touchable.disabled);
+                inviteButton.setDisabled(true);
+                inviteButton.setTouchable(Touchable.disabled);
                 startAGame.setDisabled(false);
                 startAGame.setTouchable(Touchable.enabled);
+                readyButton.setDisabled(false);
+                readyButton.setTouchable(Touchable.enabled);
+                inLobby = true;
+                hosting = true;
+                nickname = nameField.getText();
             }
         });
         startAGame.addListener(new ClickListener() {
             @Override
             public void clicked(InputEvent event, float x, float y) {
-                StartScreen.this.game.getGoSender().sendToGo("START");
+                // the game starts once everyone is ready
+                StartScreen.this.game.getGoSender().sendToGo(new GoSender.StartEvent());
             }
         });
         joinAGame.addListener(new ClickListener() {
             @Override
             public void clicked(InputEvent event, float x, float y) {
-                StartScreen.this.game.getGoSender().init(leaderIpField.getText(), nameField.getText(), false, (pid1, startingPositions1, nicknames) -> {
+                StartScreen.this.game.getGoSender().init(leaderIpField.getText(), nameField.getText(), false, passwordField.getText(), false, false, (pid1, startingPositions1, nicknames) -> {
                     // need the actual switch to happpen on the thread in the render loop unfortunately
                     StartScreen.this.pid = pid1;
                     StartScreen.this.startingPositions = startingPositions1;
@@ -104,6 +150,78 @@ public class StartScreen extends ScreenAdapter {
                 joinAGame.setTouchable(Touchable.disabled);
                 createAGame.setDisabled(true);
                 createAGame.setTouchable(Touchable.disabled);
+                findAGame.setDisabled(true);
+                findAGame.setTouchable(Touchable.disabled);
+                watchAGame.setDisabled(true);
+                watchAGame.setTouchable(Touchable.disabled);
+                inviteButton.setDisabled(true);
+                inviteButton.setTouchable(Touchable.disabled);
+                readyButton.setDisabled(false);
+                readyButton.setTouchable(Touchable.enabled);
+                inLobby = true;
+            }
+        });
+        findAGame.addListener(new ClickListener() {
+            @Override
+            public void clicked(InputEvent event, float x, float y) {
+                StartScreen.this.game.getGoSender().init(null, nameField.getText(), false, passwordField.getText(), false, false, (pid1, startingPositions1, nicknames) -> {
+                    // need the actual switch to happpen on the thread in the render loop unfortunately
+                    StartScreen.this.pid = pid1;
+                    StartScreen.this.startingPositions = startingPositions1;
+                    game.setNicknames(nicknames);
+                    StartScreen.this.readyToGo = true;
+                });
+                discovering = true;
+                lobbiesTable.add(new Label("Looking for games...", game.getAssets().getLabelStyle()));
+                joinAGame.setDisabled(true);
+                joinAGame.setTouchable(Touchable.disabled);
+                createAGame.setDisabled(true);
+                createAGame.setTouchable(Touchable.disabled);
+                findAGame.setDisabled(true);
+                findAGame.setTouchable(Touchable.disabled);
+                watchAGame.setDisabled(true);
+                watchAGame.setTouchable(Touchable.disabled);
+                inviteButton.setDisabled(true);
+                inviteButton.setTouchable(Touchable.disabled);
+            }
+        });
+        watchAGame.addListener(new ClickListener() {
+            @Override
+            public void clicked(InputEvent event, float x, float y) {
+                // no cycle and no ready, the game starts without us and we can join it once it has
+                StartScreen.this.game.getGoSender().init(leaderIpField.getText(), nameField.getText(), false, passwordField.getText(), false, true, (pid1, startingPositions1, nicknames) -> {
+                    // need the actual switch to happpen on the thread in the render loop unfortunately
+                    StartScreen.this.pid = pid1;
+                    StartScreen.this.startingPositions = startingPositions1;
+                    game.setNicknames(nicknames);
+                    StartScreen.this.readyToGo = true;
+                });
+                joinAGame.setDisabled(true);
+                joinAGame.setTouchable(Touchable.disabled);
+                createAGame.setDisabled(true);
+                createAGame.setTouchable(Touchable.disabled);
+                findAGame.setDisabled(true);
+                findAGame.setTouchable(Touchable.disabled);
+                watchAGame.setDisabled(true);
+                watchAGame.setTouchable(Touchable.disabled);
+                inviteButton.setDisabled(true);
+                inviteButton.setTouchable(Touchable.disabled);
+                inLobby = true;
+            }
+        });
+        inviteButton.addListener(new ClickListener() {
+            @Override
+            public void clicked(InputEvent event, float x, float y) {
+                invite = !invite;
+                inviteButton.setText(invite ? INVITE_ONLY : OPEN_GAME);
+            }
+        });
+        readyButton.addListener(new ClickListener() {
+            @Override
+            public void clicked(InputEvent event, float x, float y) {
+                ready = !ready;
+                readyButton.setText(ready ? NOT_READY : READY);
+                StartScreen.this.game.getGoSender().sendToGo(new GoSender.ReadyEvent(ready));
             }
         });
 
@@ -116,11 +234,26 @@ public class StartScreen extends ScreenAdapter {
         rootTable.add(new Label("Nickname", game.getAssets().getLabelStyle()));
         rootTable.add(nameField).width(800);
         rootTable.row();
+        rootTable.add(new Label("Password / invite code", game.getAssets().getLabelStyle()));
+        rootTable.add(passwordField).width(800);
+        rootTable.row();
+        rootTable.add(inviteButton).colspan(2);
+        rootTable.row();
         rootTable.add(createAGame).colspan(2);
         rootTable.row();
         rootTable.add(joinAGame).colspan(2);
         rootTable.row();
+        rootTable.add(findAGame).colspan(2);
+        rootTable.row();
+        rootTable.add(watchAGame).colspan(2);
+        rootTable.row();
+        rootTable.add(readyButton).colspan(2);
+        rootTable.row();
         rootTable.add(startAGame).colspan(2);
+        rootTable.row();
+        rootTable.add(lobbiesTable).colspan(2);
+        rootTable.row();
+        rootTable.add(rosterTable).colspan(2);
     }
 
     @Override
@@ -144,9 +277,93 @@ public class StartScreen extends ScreenAdapter {
     }
 
     protected void update(float delta) {
+        if ((discovering || inLobby) && !readyToGo) {
+            game.getGoSender().getLobbyEvents().forEach(event -> {
+                if (event instanceof GoSender.LobbiesEvent && discovering) {
+                    showLobbies(((GoSender.LobbiesEvent) event).getLobbies());
+                } else if (event instanceof GoSender.RosterEvent) {
+                    showRoster((GoSender.RosterEvent) event);
+                } else if (event instanceof GoSender.RejectEvent) {
+                    inLobby = false;
+                    rosterTable.clearChildren();
+                    final GoSender.RejectEvent reject = (GoSender.RejectEvent) event;
+                    rosterTable.add(new Label("The leader turned us away: " + reject.getReason()
+                            + (reject.getRetryIn() > 0 ? ", try again in " + reject.getRetryIn() + "s" : ""), game.getAssets().getLabelStyle()));
+                }
+            });
+        }
         stage.act(delta);
     }
 
+    private void showRoster(GoSender.RosterEvent roster) {
+        rosterTable.clearChildren();
+        roster.getPlayers().forEach(player -> {
+            rosterTable.add(new Label(player.getNickname(), game.getAssets().getLabelStyle()));
+            rosterTable.add(new Label(player.isReady() ? "READY" : "", game.getAssets().getLabelStyle()));
+            if (hosting && !player.getNickname().equalsIgnoreCase(nickname)) {
+                rosterTable.add(kickButton(player, KICK, false));
+                rosterTable.add(kickButton(player, BAN, true));
+            }
+            rosterTable.row();
+        });
+        final String status;
+        if (roster.getCountdown() > 0) {
+            status = "Starting in " + roster.getCountdown() + "...";
+        } else if (roster.getPlayers().size() < roster.getMin()) {
+            status = "Waiting for at least " + roster.getMin() + " players";
+        } else if (roster.isStarting()) {
+            status = "Starting once everyone is ready";
+        } else {
+            status = roster.getPlayers().size() + " of at most " + roster.getMax() + " players";
+        }
+        rosterTable.add(new Label(status, game.getAssets().getLabelStyle())).colspan(4);
+        if (roster.getWatching() != null) {
+            rosterTable.row();
+            rosterTable.add(new Label("Watching: " + String.join(", ", roster.getWatching()), game.getAssets().getLabelStyle())).colspan(4);
+        }
+        if (roster.getInvite() != null) {
+            rosterTable.row();
+            rosterTable.add(new Label("Invite code: " + roster.getInvite(), game.getAssets().getLabelStyle())).colspan(4);
+        }
+    }
+
+    private TextButton kickButton(GoSender.LobbyPlayer player, String text, boolean ban) {
+        final TextButton button = new TextButton(text, game.getAssets().getTextButtonStyle());
+        button.addListener(new ClickListener() {
+            @Override
+            public void clicked(InputEvent event, float x, float y) {
+                game.getGoSender().sendToGo(new GoSender.KickEvent(player.getPid(), "", ban));
+            }
+        });
+        return button;
+    }
+
+    private void showLobbies(List<GoSender.Lobby> lobbies) {
+        lobbiesTable.clearChildren();
+        if (lobbies.isEmpty()) {
+            lobbiesTable.add(new Label("Looking for games...", game.getAssets().getLabelStyle()));
+        }
+        for (GoSender.Lobby lobby : lobbies) {
+            final String text = lobby.getName() + "  " + lobby.getPlayers() + "/" + lobby.getMax() + " players  " + lobby.getWidth() + "x" + lobby.getHeight()
+                    + (lobby.isPassword() ? "  (password)" : "");
+            final TextButton join = new TextButton(text, game.getAssets().getTextButtonStyle());
+            join.addListener(new ClickListener() {
+                @Override
+                public void clicked(InputEvent event, float x, float y) {
+                    discovering = false;
+                    inLobby = true;
+                    readyButton.setDisabled(false);
+                    readyButton.setTouchable(Touchable.enabled);
+                    lobbiesTable.clearChildren();
+                    lobbiesTable.add(new Label("Joining " + lobby.getName() + "...", game.getAssets().getLabelStyle()));
+                    game.getGoSender().sendToGo(lobby.getLeader());
+                }
+            });
+            lobbiesTable.add(join);
+            lobbiesTable.row();
+        }
+    }
+
     @Override
     public void dispose() {
         stage.dispose();
@@ -1,6 +1,7 @@
 package org.cpsc538B.utils;
 
 import com.fasterxml.jackson.core.JsonProcessingException;
+import com.fasterxml.jackson.databind.DeserializationFeature;
 import com.fasterxml.jackson.databind.ObjectMapper;
 import com.fasterxml.jackson.datatype.guava.GuavaModule;
 import lombok.Getter;
@@ -18,6 +19,8 @@ public class JSONUtils {
     static {
         mapper = new ObjectMapper();
         mapper.registerModule(new GuavaModule());
+        // the go side may add fields we don't care about (like the wire encoding)
+        mapper.configure(DeserializationFeature.FAIL_ON_UNKNOWN_PROPERTIES, false);
     }
 
     public static <T> T toObject(String jsonString, Class<T> klazz) {
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* DISCOVERY
+*
+* So nobody has to type in the leader's address, a leader with its lobby open announces
+* it every second on a multicast group (-lobby-group, none if empty): its name, the address
+* to join, how many players are in, the grid and whether it takes a password.
+*
+* A player started with -discover instead of -leader listens on the group, and sends the
+* java frontend the lobbies it can hear whenever that changes. The frontend answers with
+* the address of the one the player picked, and the player joins it like any other.
+ */
+
+// how often a leader announces its lobby, and a lobby not heard from for three of these is gone
+const lobbyAnnounceInterval = time.Second
+
+type Lobby struct {
+	Name     string `json:"name"`   // the host's nickname
+	Leader   string `json:"leader"` // ip:port to join
+	Players  int    `json:"players"`
+	Max      int    `json:"max"` // players it lets in
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Password bool   `json:"password"` // players need one to join
+	Lockstep bool   `json:"lockstep,omitempty"`
+}
+
+type LobbyMessage struct {
+	Envelope
+	Lobby `json:"lobby"`
+}
+
+type LobbiesMessage struct {
+	Envelope
+	Lobbies []Lobby `json:"lobbies"`
+}
+
+func (m *LobbyMessage) validate() error {
+	if _, err := net.ResolveUDPAddr("udp", m.Leader); err != nil {
+		return errors.New("bad leader address " + m.Leader)
+	}
+	return nil
+}
+
+func (n *Node) lobbyMessage() *LobbyMessage {
+	addr := n.leaderState.leaderConnection.LocalAddr()
+	host := addr.IP.String()
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		host = n.localIP
+	}
+	return &LobbyMessage{
+		Envelope: Envelope{
+			MessageType: "lobby",
+			EventName:   "lobby",
+		},
+		Lobby: Lobby{
+			Name:     n.Nickname,
+			Leader:   net.JoinHostPort(host, strconv.Itoa(addr.Port)),
+			Players:  len(n.Alive),
+			Max:      n.config.MaxPlayers,
+			Width:    n.GridWidth,
+			Height:   n.GridHeight,
+			Password: n.config.Password != "",
+			Lockstep: n.config.Lockstep,
+		},
+	}
+}
+
+// announceLobby tells the lan about our lobby, if it is time to.
+func (n *Node) announceLobby() {
+	now := n.clock.Now()
+	if n.config.LobbyGroup == "" || now.Before(n.leaderState.nextAnnounce) {
+		return
+	}
+	n.leaderState.nextAnnounce = now.Add(lobbyAnnounceInterval)
+	group, err := net.ResolveUDPAddr("udp4", n.config.LobbyGroup)
+	if err != nil {
+		n.logLeader("Can't announce the lobby: " + err.Error())
+		return
+	}
+	// from the lobby's own socket, the lobby isn't encrypted yet
+	if _, err := n.leaderState.leaderConnection.WriteTo(encodeMessage(n.lobbyMessage()), group); err != nil {
+		n.logLeader("Can't announce the lobby: " + err.Error())
+	}
+}
+
+// discover shows the frontend the lobbies on the lan until the player picks one, which
+// becomes our leader.
+func (n *Node) discover() {
+	group, err := net.ResolveUDPAddr("udp4", n.config.LobbyGroup)
+	checkError(err)
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	checkError(err)
+	defer conn.Close()
+	n.logJava("Trying to connect to java on " + n.javaAddr)
+	n.javaConnection, err = net.Dial("tcp", n.javaAddr)
+	checkError(err)
+	n.connBuf = bufio.NewReader(n.javaConnection)
+
+	picked := make(chan string, 1)
+	n.clock.Go(func() {
+		line, err := n.connBuf.ReadString('\n')
+		if err != nil {
+			n.logJava("Lost the java frontend while looking for a lobby: " + err.Error())
+			picked <- ""
+			return
+		}
+		picked <- strings.TrimSpace(line)
+	})
+	n.logClient("Looking for lobbies on " + group.String())
+	lobbies := make(map[string]Lobby)
+	heard := make(map[string]time.Time)
+	buf := make([]byte, 2048)
+	for {
+		select {
+		case leader := <-picked:
+			if leader == "" {
+				checkError(errors.New("the frontend didn't pick a lobby"))
+			}
+			n.logClient("Joining the lobby at " + leader)
+			n.leaderAddr = leader
+			return
+		default:
+		}
+		changed := false
+		conn.SetReadDeadline(time.Now().Add(lobbyAnnounceInterval))
+		size, raddr, err := conn.ReadFromUDP(buf)
+		if err == nil {
+			if message, err := decodeMessage(buf[:size]); err != nil {
+				n.logClient("Ignoring a bad lobby announcement: " + err.Error())
+			} else if announcement, ok := message.(*LobbyMessage); ok {
+				lobby := reachableLobby(announcement.Lobby, raddr)
+				changed = lobbies[lobby.Leader] != lobby
+				lobbies[lobby.Leader] = lobby
+				heard[lobby.Leader] = n.clock.Now()
+			}
+		}
+		for leader, at := range heard {
+			if n.clock.Now().Sub(at) > 3*lobbyAnnounceInterval {
+				n.logClient("The lobby at " + leader + " is gone")
+				delete(lobbies, leader)
+				delete(heard, leader)
+				changed = true
+			}
+		}
+		if changed {
+			n.javaConnection.Write(append(encodeMessage(n.lobbiesMessage(lobbies)), '\n'))
+		}
+	}
+}
+
+// reachableLobby joins a leader that only knows itself by a loopback address at the
+// address its announcement came from instead.
+func reachableLobby(lobby Lobby, from *net.UDPAddr) Lobby {
+	host, port, _ := net.SplitHostPort(lobby.Leader)
+	if ip := net.ParseIP(host); ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		lobby.Leader = net.JoinHostPort(from.IP.String(), port)
+	}
+	return lobby
+}
+
+func (n *Node) lobbiesMessage(lobbies map[string]Lobby) *LobbiesMessage {
+	list := make([]Lobby, 0, len(lobbies))
+	for _, lobby := range lobbies {
+		list = append(list, lobby)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Leader < list[j].Leader
+	})
+	return &LobbiesMessage{
+		Envelope: Envelope{
+			MessageType: "lobbies",
+			EventName:   "lobbies",
+		},
+		Lobbies: list,
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+* LEADER ELECTION
+*
+* Elections work like raft's. Every leader is elected for a term, and terms only ever go
+* up. A follower that hasn't heard from its leader for its election timeout stands for
+* the next term: it votes for itself and sends everyone a checkleader. Every
+* node votes once per term (leaderdead grants the vote, leaderalive refuses it), and only
+* for a candidate with at least as many rounds of moves as itself. Whoever gets the votes
+* of a majority of the players still in the game, the leader it replaces included, leads
+* that term, and says so with a newleader. So of two halves of a game only one can elect.
+*
+* With two players that majority would take the leader's vote too, so the other player
+* wins on its own vote, but only once it hasn't heard from the leader for as long as the
+* leader takes to drop a player that went quiet (max-missed-messages follower response
+* times). If the two can't hear each other both play on alone, and once they can the newer
+* term wins.
+*
+* Every message a leader sends carries its term, and followers throw away anything from
+* a leader of an older term than the one they follow, so an old leader that comes back
+* from a partition can't keep running rounds. It steps down as soon as it hears of the
+* newer term. The current term and our vote are written to a file, so a node that restarts
+* and rejoins doesn't vote twice in a term.
+*
+* Who stands first isn't left to chance: see SUCCESSION below.
+ */
+
+type ElectionState int
+
+const (
+	FOLLOWER ElectionState = 1 + iota
+	CANDIDATE
+	LEADER
+)
+
+type savedTerm struct {
+	Token    string `json:"token"` // the game it is for
+	Term     int    `json:"term"`
+	VotedFor string `json:"votedFor"`
+	Leader   string `json:"leader"` // where to rejoin, the leader may have changed since -leader
+}
+
+func (n *Node) termFilename() string {
+	if n.config.TermDir == "" {
+		return ""
+	}
+	return filepath.Join(n.config.TermDir, "term-"+n.Nickname+".json")
+}
+
+func (n *Node) saveTerm() {
+	filename := n.termFilename()
+	if filename == "" || n.SessionToken == "" {
+		return
+	}
+	buf, err := json.Marshal(savedTerm{Token: n.SessionToken, Term: n.Term, VotedFor: n.VotedFor, Leader: n.leaderAddr})
+	checkError(err)
+	if err := os.WriteFile(filename, buf, 0600); err != nil {
+		n.logClient("Couldn't save term " + strconv.Itoa(n.Term) + ": " + err.Error())
+	}
+}
+
+// loadTerm picks up the term we were in before a restart, if it was this game.
+func (n *Node) loadTerm() {
+	filename := n.termFilename()
+	if filename == "" {
+		return
+	}
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	var saved savedTerm
+	if err := json.Unmarshal(buf, &saved); err != nil || saved.Token != n.SessionToken {
+		return
+	}
+	n.Term, n.VotedFor = saved.Term, saved.VotedFor
+	n.lastLeaderAddr = saved.Leader
+	n.logClient("Back in term " + strconv.Itoa(n.Term))
+}
+
+// setTerm moves us on to a newer term, where we haven't voted yet. Whatever we were
+// leading or standing for is over.
+func (n *Node) setTerm(term int) {
+	if n.electionState != FOLLOWER {
+		n.logClient("Heard of term " + strconv.Itoa(term) + ", stepping down from term " + strconv.Itoa(n.Term))
+	}
+	n.Term = term
+	n.VotedFor = ""
+	n.electionState = FOLLOWER
+	n.isLeader = false
+	n.saveTerm()
+}
+
+// steppedDown tells our leader routine to stop, once we heard of a newer term than ours.
+func (n *Node) steppedDown() bool {
+	if n.leaderState.Term >= n.Term {
+		return false
+	}
+	n.logLeader("There is a newer term than ours (" + strconv.Itoa(n.leaderState.Term) + "), stepping down")
+	return true
+}
+
+// A round can take up to a follower response time between two messages from the leader,
+// so the first successor gives it half as long again, and every successor after it a
+// stagger more than the one before, so followers don't all stand at once.
+func (n *Node) resetElectionTimer() {
+	timeout := n.config.FollowerResponseTime*3/2 + time.Duration(n.successionRank())*n.successionStagger()
+	n.electionDeadline = n.clock.Now().Add(timeout)
+}
+
+func (n *Node) heardFromLeader() {
+	n.lastHeard = n.clock.Now()
+	n.quietElections = 0
+	n.resetElectionTimer()
+}
+
+// A follower that heard from its leader less than the shortest election timeout ago
+// won't help anyone replace it. With heartbeats it goes by the failure detector instead.
+func (n *Node) heardFromLeaderRecently() bool {
+	if alive, known := n.leaderAlive(); known {
+		return alive
+	}
+	return !n.lastHeard.IsZero() && n.clock.Now().Before(n.lastHeard.Add(n.config.FollowerResponseTime))
+}
+
+// followLeader makes the leader of term at raddr ours, pid is the player it signs as.
+func (n *Node) followLeader(term int, raddr string, pid string) {
+	if term > n.Term {
+		n.setTerm(term)
+	}
+	if !n.isLeader || n.leaderState.Term != term {
+		n.isLeader = false
+		n.electionState = FOLLOWER
+	}
+	if n.LeaderID != term || n.leaderAddr != raddr {
+		n.logClient("Following the leader of term " + strconv.Itoa(term) + " at " + raddr)
+		n.leaderAddr = raddr
+		n.leaderPid = pid
+		n.initializeLeaderConnection()
+		// the new leader never issued our session token
+		n.auth.leaderKnowsMyKey = false
+		n.detector.forget(leaderPeer)
+		n.suspectedAt = time.Time{}
+		n.saveTerm()
+	}
+	n.LeaderID = term
+	n.heardFromLeader()
+}
+
+// Everyone whose cycle is still going gets a vote, the leader too, and so do we.
+func (n *Node) electorate() map[string]bool {
+	electorate := map[string]bool{strconv.Itoa(n.MyPid): true}
+	for pid, alive := range n.Alive {
+		if alive && n.isMember(pid) {
+			electorate[pid] = true
+		}
+	}
+	return electorate
+}
+
+// lastOfTwo says whether we are the only player left besides a leader that has been quiet
+// for as long as it would take to drop us, so we can take over on our own vote.
+func (n *Node) lastOfTwo(electorate map[string]bool) bool {
+	if len(electorate) != 2 || !electorate[n.leaderPid] || n.leaderPid == strconv.Itoa(n.MyPid) {
+		return false
+	}
+	quiet := n.config.FollowerResponseTime * time.Duration(n.config.MaxAllowableMissedMessages)
+	return n.lastHeard.IsZero() || !n.clock.Now().Before(n.lastHeard.Add(quiet))
+}
+
+func (n *Node) startElection() {
+	n.setTerm(n.Term + 1)
+	n.VotedFor = strconv.Itoa(n.MyPid)
+	n.saveTerm()
+	n.electionState = CANDIDATE
+	n.votes = map[string]bool{n.VotedFor: true}
+	n.quietElections++
+	n.resetElectionTimer()
+	n.logClient("Haven't heard from the leader of term " + strconv.Itoa(n.LeaderID) + ", standing for term " + strconv.Itoa(n.Term))
+	request := n.leaderElectionMessage("checkleader", n.Term)
+	// how far our game goes, like the last log index in raft
+	request.Round = n.AckedRound
+	n.broadcastMessage(n.goConnection, request)
+	n.countVotes()
+}
+
+// vote answers a checkleader from candidate.
+func (n *Node) vote(request *LeaderElectionMessage, candidate string) *LeaderElectionMessage {
+	term := request.LeaderID
+	if n.heardFromLeaderRecently() {
+		n.logClient("Not voting for player " + candidate + " in term " + strconv.Itoa(term) + ", the leader is alive")
+		return n.leaderElectionMessage("leaderalive", n.Term)
+	}
+	if term > n.Term {
+		n.setTerm(term)
+	}
+	if term < n.Term || (n.VotedFor != "" && n.VotedFor != candidate) || request.Round < n.AckedRound {
+		n.logClient(fmt.Sprintf("Not voting for player %s in term %d: we are in term %d, voted for %q, have round %d and they have %d",
+			candidate, term, n.Term, n.VotedFor, n.AckedRound, request.Round))
+		return n.leaderElectionMessage("leaderalive", n.Term)
+	}
+	n.VotedFor = candidate
+	n.saveTerm()
+	n.resetElectionTimer()
+	n.logClient("Voting for player " + candidate + " in term " + strconv.Itoa(term))
+	return n.leaderElectionMessage("leaderdead", n.Term)
+}
+
+func (n *Node) receiveVote(reply *LeaderElectionMessage, voter string) {
+	if voter != strconv.Itoa(n.MyPid) {
+		n.quietElections = 0
+	}
+	if reply.LeaderID > n.Term {
+		n.setTerm(reply.LeaderID)
+		return
+	}
+	if n.electionState != CANDIDATE || reply.LeaderID != n.Term || reply.MessageType != "leaderdead" {
+		return
+	}
+	n.votes[voter] = true
+	n.countVotes()
+}
+
+func (n *Node) countVotes() {
+	electorate := n.electorate()
+	granted := 0
+	for pid := range n.votes {
+		if electorate[pid] {
+			granted++
+		}
+	}
+	if granted > len(electorate)/2 || (granted == 1 && n.lastOfTwo(electorate)) {
+		n.logClient(fmt.Sprintf("Won term %d with %d of %d votes", n.Term, granted, len(electorate)))
+		n.electNewLeader(electorate)
+	}
+}
+
+func (n *Node) electNewLeader(electorate map[string]bool) {
+	// the leader we replace won't report its state, see STATE TRANSFER
+	if n.leaderPid != strconv.Itoa(n.MyPid) {
+		delete(electorate, n.leaderPid)
+	}
+	n.becomeLeader(func() { n.takeOver(electorate) })
+	fmt.Println("New leader elected")
+}
+
+// becomeLeader makes us the leader of our term, with lead running the game from now on.
+func (n *Node) becomeLeader(lead func()) {
+	n.initializeLeader(n.localIP + ":0")
+	// nobody joins in the middle of a game
+	n.closeLobby(n.leaderState.leaderConnection)
+	n.leaderState.Term = n.Term
+	n.leaderState.Pid = strconv.Itoa(n.MyPid)
+	n.Succession = withoutPid(n.Succession, n.leaderState.Pid)
+	n.LeaderID = n.Term
+	n.isLeader = true
+	n.electionState = LEADER
+	n.auth.leaderKnowsMyKey = false
+	n.leaderAddr = n.leaderState.leaderConnection.LocalAddr().String()
+	n.leaderPid = n.leaderState.Pid
+	n.initializeLeaderConnection()
+	n.announceLeader()
+	n.clock.Go(lead)
+	n.heardFromLeader()
+}
+
+// announceLeader tells everyone we haven't heard from since we took over that we lead
+// the game now, and where. It goes out from our own player's socket, so they know it's
+// us, and again every round in case they missed it: a player only follows a newer term
+// once it hears a newleader.
+func (n *Node) announceLeader() {
+	if n.leaderState.Term == 0 {
+		// everyone follows the host from the game start
+		return
+	}
+	announcement := n.leaderElectionMessage("newleader", n.leaderState.Term)
+	announcement.Address = n.leaderState.leaderConnection.LocalAddr().String()
+	for _, address := range n.addresses() {
+		pid := n.AddrToPid[address]
+		if n.isMember(pid) && !n.leaderState.Following[pid] && pid != n.leaderState.Pid {
+			n.sendMessage(n.goConnection, announcement, n.AddrToAddr[address])
+		}
+	}
+}
+
+/*
+* SUCCESSION
+*
+* The leader tells everyone the order it should be replaced in, with the game start and
+* again with every round start, leaving out itself and the players it dropped. When it
+* goes quiet the first player in the list stands after one follower response time, the
+* next one a stagger later in case the first is gone too, and so on. Whoever wins leads
+* the rest of the list.
+ */
+
+// long enough for the one before us to ask for votes and announce it won
+func (n *Node) successionStagger() time.Duration {
+	return n.config.FollowerResponseTime / 4
+}
+
+// successionRank is how many players stand before us, everyone if we aren't in the list.
+func (n *Node) successionRank() int {
+	me := strconv.Itoa(n.MyPid)
+	for rank, pid := range n.Succession {
+		if pid == me {
+			return rank
+		}
+	}
+	return len(n.Succession)
+}
+
+// the players in the order they joined, but us and the ones we dropped
+func (n *Node) successionOrder() []string {
+	var succession []string
+	for pid := range n.Alive {
+		if pid != n.leaderState.Pid && !n.DroppedForever[pid] && n.isMember(pid) {
+			succession = append(succession, pid)
+		}
+	}
+	sort.Slice(succession, func(i, j int) bool {
+		a, _ := strconv.Atoi(succession[i])
+		b, _ := strconv.Atoi(succession[j])
+		return a < b
+	})
+	return succession
+}
+
+func withoutPid(pids []string, pid string) []string {
+	var rest []string
+	for _, other := range pids {
+		if other != pid {
+			rest = append(rest, other)
+		}
+	}
+	return rest
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+* FRAGMENTS
+*
+* A snapshot, state report or handoff of a big grid doesn't fit in one datagram. Anything
+* bigger than a fragment goes out in numbered pieces, each its own datagram:
+*
+*   magic (1 byte), message id (uint32), index (1 byte), count (1 byte), piece
+*
+* The receiver puts a message back together once it has every piece. It keeps a few
+* messages of every sender apart by their id, so a stray piece of another message doesn't
+* throw away one it is halfway through, but no more than a few per sender and a few dozen
+* in all, and none for longer than a few seconds, so pieces that never complete can't eat
+* up its memory. Losing any piece loses the whole message, which is no worse than losing
+* the one datagram it would have been.
+ */
+
+const fragmentMagic = 0xF7
+
+const (
+	fragmentHeaderSize       = 7
+	fragmentSize             = 8 * 1024
+	maxFragments             = 64
+	maxReassemblies          = 64
+	maxReassembliesPerSender = 4
+	reassemblyTimeout        = 5 * time.Second
+)
+
+var errMessageTooBig = errors.New("message too big to send, even in fragments")
+
+type reassembly struct {
+	sender  string
+	id      uint32
+	pieces  [][]byte
+	got     int
+	started time.Time
+}
+
+type fragmentTransport struct {
+	Transport
+	clock   Clock
+	mu      sync.Mutex
+	nextID  uint32
+	pending []*reassembly // oldest first
+}
+
+func withFragments(t Transport, clock Clock) Transport {
+	return &fragmentTransport{Transport: t, clock: clock}
+}
+
+func (t *fragmentTransport) WriteTo(buf []byte, addr *net.UDPAddr) (int, error) {
+	// anything that could pass for a fragment goes out as one, even if it is small
+	if len(buf) <= fragmentSize && (len(buf) == 0 || buf[0] != fragmentMagic) {
+		return t.Transport.WriteTo(buf, addr)
+	}
+	count := (len(buf) + fragmentSize - 1) / fragmentSize
+	if count > maxFragments {
+		return 0, errMessageTooBig
+	}
+	t.mu.Lock()
+	t.nextID++
+	id := t.nextID
+	t.mu.Unlock()
+	for index := 0; index < count; index++ {
+		piece := buf[index*fragmentSize : min((index+1)*fragmentSize, len(buf))]
+		frame := make([]byte, fragmentHeaderSize, fragmentHeaderSize+len(piece))
+		frame[0] = fragmentMagic
+		binary.BigEndian.PutUint32(frame[1:5], id)
+		frame[5] = byte(index)
+		frame[6] = byte(count)
+		if _, err := t.Transport.WriteTo(append(frame, piece...), addr); err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil
+}
+
+func (t *fragmentTransport) ReadFrom(deadline time.Time) ([]byte, *net.UDPAddr, error) {
+	for {
+		buf, raddr, err := t.Transport.ReadFrom(deadline)
+		if err != nil || len(buf) == 0 || buf[0] != fragmentMagic {
+			return buf, raddr, err
+		}
+		if message := t.reassemble(buf, raddr.String()); message != nil {
+			return message, raddr, nil
+		}
+	}
+}
+
+// reassemble files a piece away, returning the whole message once the piece completes it.
+func (t *fragmentTransport) reassemble(frame []byte, sender string) []byte {
+	if len(frame) <= fragmentHeaderSize {
+		return nil
+	}
+	id := binary.BigEndian.Uint32(frame[1:5])
+	index, count := int(frame[5]), int(frame[6])
+	if count == 0 || count > maxFragments || index >= count {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	t.forgetExpired(now)
+	message := t.find(sender, id)
+	if message == nil {
+		t.makeRoom(sender)
+		message = &reassembly{sender: sender, id: id, pieces: make([][]byte, count), started: now}
+		t.pending = append(t.pending, message)
+	}
+	if len(message.pieces) != count {
+		// not a piece of the message we know by that id
+		return nil
+	}
+	if message.pieces[index] == nil {
+		message.pieces[index] = append([]byte(nil), frame[fragmentHeaderSize:]...)
+		message.got++
+	}
+	if message.got < count {
+		return nil
+	}
+	t.forget(message)
+	var whole []byte
+	for _, piece := range message.pieces {
+		whole = append(whole, piece...)
+	}
+	return whole
+}
+
+func (t *fragmentTransport) find(sender string, id uint32) *reassembly {
+	for _, message := range t.pending {
+		if message.sender == sender && message.id == id {
+			return message
+		}
+	}
+	return nil
+}
+
+func (t *fragmentTransport) forget(message *reassembly) {
+	for i, pending := range t.pending {
+		if pending == message {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *fragmentTransport) forgetExpired(now time.Time) {
+	kept := t.pending[:0]
+	for _, message := range t.pending {
+		if now.Sub(message.started) < reassemblyTimeout {
+			kept = append(kept, message)
+		}
+	}
+	t.pending = kept
+}
+
+// makeRoom forgets the oldest message of sender if it has too many on the way, and the
+// oldest of anyone's if everyone together has.
+func (t *fragmentTransport) makeRoom(sender string) {
+	var oldest *reassembly
+	mine := 0
+	for _, message := range t.pending {
+		if message.sender == sender {
+			if oldest == nil {
+				oldest = message
+			}
+			mine++
+		}
+	}
+	if mine >= maxReassembliesPerSender {
+		t.forget(oldest)
+	}
+	if len(t.pending) >= maxReassemblies {
+		t.pending = t.pending[1:]
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// a message many times the size of a datagram gets through pieces that arrive out of
+// order and twice, and one too big for every piece is refused instead of sent
+func TestFragments(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	network := NewSimNetwork(clock, 1, Latency{Jitter: 5 * time.Millisecond}, Duplication{Rate: 0.5})
+	sender, _ := network.Listen("10.0.0.1:7000")
+	receiver, _ := network.Listen("10.0.0.2:7000")
+	sender, receiver = withFragments(sender, clock), withFragments(receiver, clock)
+
+	message := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(message)
+	var received []byte
+	var sendErr, tooBigErr error
+	clock.AfterFunc(0, func() {
+		_, sendErr = sender.WriteTo(message, receiver.LocalAddr())
+		_, tooBigErr = sender.WriteTo(make([]byte, (maxFragments+1)*fragmentSize), receiver.LocalAddr())
+		received, _, _ = receiver.ReadFrom(clock.Now().Add(time.Second))
+	})
+	clock.mu.Lock()
+	clock.advance()
+	clock.mu.Unlock()
+	<-clock.Stalled()
+
+	if sendErr != nil {
+		t.Fatalf("sending %d bytes failed: %v", len(message), sendErr)
+	}
+	if !bytes.Equal(received, message) {
+		t.Errorf("got %d bytes back, sent %d", len(received), len(message))
+	}
+	if tooBigErr != errMessageTooBig {
+		t.Errorf("sending a message bigger than every fragment together gave %v", tooBigErr)
+	}
+}
+
+func fragmentFrame(id uint32, index, count int, piece string) []byte {
+	frame := []byte{fragmentMagic, 0, 0, 0, 0, byte(index), byte(count)}
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	return append(frame, piece...)
+}
+
+// a stray piece of another message doesn't throw away one that is halfway through, and
+// pieces that never complete are forgotten after a while
+func TestReassembly(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	receiver := withFragments(nil, clock).(*fragmentTransport)
+	tests := []struct {
+		name  string
+		frame []byte
+		after time.Duration
+		want  string
+	}{
+		{"first half of 1", fragmentFrame(1, 0, 2, "ab"), 0, ""},
+		{"stray piece of 9", fragmentFrame(9, 0, 3, "xx"), 0, ""},
+		{"first half of 2", fragmentFrame(2, 0, 2, "ef"), 0, ""},
+		{"piece of 1 with another count", fragmentFrame(1, 1, 3, "zz"), 0, ""},
+		{"second half of 1", fragmentFrame(1, 1, 2, "cd"), 0, "abcd"},
+		{"second half of 1 again", fragmentFrame(1, 1, 2, "cd"), 0, ""},
+		{"second half of 2 too late", fragmentFrame(2, 1, 2, "gh"), reassemblyTimeout, ""},
+		{"truncated", []byte{fragmentMagic, 0, 0}, 0, ""},
+		{"index past count", fragmentFrame(3, 2, 2, "ij"), 0, ""},
+	}
+	for _, test := range tests {
+		clock.now = clock.now.Add(test.after)
+		if got := receiver.reassemble(test.frame, "10.0.0.1:7000"); string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+	for i := 0; i < 2*maxReassembliesPerSender; i++ {
+		receiver.reassemble(fragmentFrame(uint32(100+i), 0, 2, "kl"), "10.0.0.1:7000")
+	}
+	if len(receiver.pending) > maxReassembliesPerSender {
+		t.Errorf("%d messages of one sender on the way, at most %d should be", len(receiver.pending), maxReassembliesPerSender)
+	}
+}
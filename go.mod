@@ -0,0 +1,3 @@
+module tronp2p
+
+go 1.21
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+/*
+* HANDOFF
+*
+* A leader that quits (SIGINT, SIGTERM or the java frontend going away) doesn't leave its
+* followers to time out. At the end of the round it tells everyone its successor, the
+* first player in the succession, and that the successor leads the next term. Everyone
+* votes for the successor in that term, so nobody else can win it, and the successor
+* gets the leader's whole state with its stepdown and starts the next round right away.
+*
+* The leader sends the successor its stepdown again until it acknowledges it, for up to a
+* follower response time. If it never gets through, the followers elect a new leader the
+* usual way.
+*
+* The session tokens only go with the handoff when the game is encrypted. Otherwise every
+* player sends the successor its own token with a state report, like after an election.
+ */
+
+type StepDown struct {
+	Successor string   `json:"successor"`
+	NextTerm  int      `json:"nextTerm"`          // the successor leads this term
+	Handoff   *Handoff `json:"handoff,omitempty"` // only in the one to the successor
+}
+
+// Handoff is everything the leader knows that its successor doesn't.
+type Handoff struct {
+	Round     int                 `json:"round"`
+	Positions []map[string]Move   `json:"positions"` // the leader's window
+	Acks      map[string]int      `json:"acks"`
+	Tokens    map[string]string   `json:"tokens"`
+	Encodings map[string][]string `json:"encodings"`
+	Grace     map[string]int      `json:"grace"`
+	Grid      []int               `json:"grid"` // run-length encoded, see encodeGrid
+	Alive     []string            `json:"alive"`
+	Finish    []string            `json:"finish"`
+	Dropped   []string            `json:"dropped"`
+	Left      map[string]string   `json:"left"`
+}
+
+type StepDownMessage struct {
+	Envelope
+	StepDown `json:"stepDown"`
+}
+
+func (m *StepDownMessage) validate() error {
+	if m.Successor == "" {
+		return errors.New("missing successor")
+	}
+	return nil
+}
+
+func (n *Node) stepDownMessage(successor string, handoff *Handoff) *StepDownMessage {
+	return &StepDownMessage{
+		Envelope: Envelope{
+			MessageType: "stepdown",
+			EventName:   "stepDown",
+			Round:       n.Round,
+			Term:        n.leaderState.Term,
+		},
+		StepDown: StepDown{
+			Successor: successor,
+			NextTerm:  n.leaderState.Term + 1,
+			Handoff:   handoff,
+		},
+	}
+}
+
+func (n *Node) stepDownAck(stepDown *StepDownMessage) *StepDownMessage {
+	return &StepDownMessage{
+		Envelope: Envelope{
+			MessageType: "stepdownack",
+			EventName:   "stepDownAck",
+			Round:       n.Round,
+			Term:        stepDown.Envelope.Term,
+		},
+		StepDown: StepDown{
+			Successor: strconv.Itoa(n.MyPid),
+			NextTerm:  stepDown.NextTerm,
+		},
+	}
+}
+
+func (n *Node) handoff() *Handoff {
+	var tokens map[string]string
+	if n.keys != nil {
+		// anyone could read them off the wire otherwise
+		tokens = n.leaderState.Tokens
+	}
+	return &Handoff{
+		Round:     n.Round,
+		Positions: n.leaderState.Positions,
+		Acks:      n.leaderState.Acks,
+		Tokens:    tokens,
+		Encodings: n.leaderState.Encodings,
+		Grace:     n.Grace,
+		Grid:      encodeGrid(n.Grid),
+		Alive:     n.alivePlayers(),
+		Finish:    n.Finish,
+		Dropped:   n.droppedPlayers(),
+		Left:      n.Left,
+	}
+}
+
+// Quit leaves the game, saying why. A leader hands it over at the end of the round
+// first; Quit returns once it has, or a couple of follower response times later if it can't.
+func (n *Node) Quit(reason string) {
+	if n.electionState != LEADER {
+		n.leave(reason)
+		return
+	}
+	n.logLeader("Quitting, handing the game over at the end of the round")
+	n.quitReason = reason
+	n.quitting.Store(true)
+	deadline := n.clock.Now().Add(2 * n.config.FollowerResponseTime)
+	for !n.handedOver.Load() && n.clock.Now().Before(deadline) {
+		n.clock.Sleep(n.config.MinGameSpeed)
+	}
+}
+
+// handOver sends the game to our successor. It returns false if there is nobody to
+// take it.
+func (n *Node) handOver() bool {
+	defer n.handedOver.Store(true)
+	if len(n.Succession) == 0 {
+		n.logLeader("Nobody to hand the game over to")
+		return false
+	}
+	successor := n.Succession[0]
+	// the successor and everyone else hear we left before we go
+	n.playerLeft(n.leaderState.Pid, n.quitReason)
+	n.logLeader("Handing the game over to player " + successor + " for term " + strconv.Itoa(n.leaderState.Term+1))
+	var successorAddr *net.UDPAddr
+	for _, address := range n.addresses() {
+		addr := n.AddrToAddr[address]
+		if n.AddrToPid[address] == successor {
+			successorAddr = addr
+			n.sendMessage(n.leaderState.leaderConnection, n.stepDownMessage(successor, n.handoff()), addr)
+		} else {
+			n.sendMessage(n.leaderState.leaderConnection, n.stepDownMessage(successor, nil), addr)
+		}
+	}
+	if successorAddr != nil {
+		n.awaitStepDownAck(successor, successorAddr)
+	}
+	return true
+}
+
+// awaitStepDownAck sends the successor our stepdown again until it says it got it, for
+// up to a follower response time, which is before anyone would stand for election.
+func (n *Node) awaitStepDownAck(successor string, addr *net.UDPAddr) {
+	deadline := n.clock.Now().Add(n.config.FollowerResponseTime)
+	resend := n.clock.Now().Add(n.config.FollowerResponseTime / 4)
+	for n.clock.Now().Before(deadline) {
+		buf, raddr, timedout := n.readFromUDPWithTimeout(n.leaderState.leaderConnection, resend)
+		if timedout {
+			n.logLeader("Player " + successor + " hasn't acknowledged our stepdown, sending it again")
+			n.sendMessage(n.leaderState.leaderConnection, n.stepDownMessage(successor, n.handoff()), addr)
+			resend = n.clock.Now().Add(n.config.FollowerResponseTime / 4)
+			continue
+		}
+		message, sender, err := n.openFromPlayer(buf, raddr)
+		if err != nil {
+			continue
+		}
+		ack, ok := message.(*StepDownMessage)
+		if ok && sender == successor && ack.MessageType == "stepdownack" && ack.NextTerm == n.leaderState.Term+1 {
+			n.logLeader("Player " + successor + " acknowledged our stepdown")
+			return
+		}
+	}
+	n.logLeader("Player " + successor + " never acknowledged our stepdown, the others will elect a leader")
+}
+
+// receiveStepDown votes for the successor of our leader, and takes over if that's us.
+func (n *Node) receiveStepDown(message *StepDownMessage) {
+	if message.NextTerm < n.Term || (message.NextTerm == n.Term && n.VotedFor != "" && n.VotedFor != message.Successor) {
+		n.logClient("Ignoring the stepdown of term " + strconv.Itoa(message.Envelope.Term) + ", we already voted in term " + strconv.Itoa(n.Term))
+		return
+	}
+	if message.NextTerm > n.Term {
+		n.setTerm(message.NextTerm)
+	}
+	n.VotedFor = message.Successor
+	n.saveTerm()
+	n.handoffTerm = message.NextTerm
+	n.logClient("The leader of term " + strconv.Itoa(message.Envelope.Term) + " stepped down, player " + message.Successor + " takes over")
+	if message.Successor != strconv.Itoa(n.MyPid) || message.Handoff == nil {
+		return
+	}
+	n.sendToLeader(n.stepDownAck(message))
+	if n.electionState == LEADER {
+		return
+	}
+	handoff := message.Handoff
+	n.becomeLeader(func() {
+		n.takeHandoff(handoff)
+		n.leaderListener()
+	})
+	n.logClient("Took over from the leader that quit")
+}
+
+func (n *Node) takeHandoff(handoff *Handoff) {
+	if grid, err := decodeGrid(handoff.Grid, n.GridWidth, n.GridHeight); err == nil {
+		n.Grid = grid
+	} else {
+		n.logLeader("Keeping our own grid, the handoff's is bad: " + err.Error())
+	}
+	alive := make(map[string]bool)
+	for _, pid := range handoff.Alive {
+		alive[pid] = true
+	}
+	for pid := range n.Alive {
+		n.Alive[pid] = alive[pid]
+	}
+	n.Finish = handoff.Finish
+	n.DroppedForever = make(map[string]bool)
+	for _, pid := range handoff.Dropped {
+		n.DroppedForever[pid] = true
+	}
+	// line the windows up at the newest round, in case they aren't the same length
+	window := n.leaderState.Positions
+	for i := 1; i <= len(window) && i <= len(handoff.Positions); i++ {
+		if handoff.Positions[len(handoff.Positions)-i] != nil {
+			window[len(window)-i] = handoff.Positions[len(handoff.Positions)-i]
+		}
+	}
+	if handoff.Acks != nil {
+		n.leaderState.Acks = handoff.Acks
+	}
+	if handoff.Tokens != nil {
+		n.leaderState.Tokens = handoff.Tokens
+	}
+	if handoff.Encodings != nil {
+		n.leaderState.Encodings = handoff.Encodings
+	}
+	n.Left = make(map[string]string)
+	for pid, reason := range handoff.Left {
+		n.Left[pid] = reason
+	}
+	n.markDeparted()
+	n.Grace = make(map[string]int)
+	for pid, missed := range handoff.Grace {
+		n.Grace[pid] = missed
+	}
+	n.Round = handoff.Round
+	n.Succession = n.successionOrder()
+	n.logLeader("Took the game over at round " + strconv.Itoa(n.Round))
+}
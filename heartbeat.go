@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+* HEARTBEATS
+*
+* Whether a move arrived in time says more about a player's frontend than about the
+* player, so liveness is tracked on its own. Every heartbeat interval the leader sends
+* every player a heartbeat (between moves, from its listener) and every player sends the
+* leader one (from a goroutine of its own), and whoever gets one echoes it back, which
+* also measures the round trip.
+*
+* A phi accrual failure detector turns the heartbeats into how sure we are a peer is
+* gone: phi is -log10 of the chance that a peer that is still there would have been
+* quiet this long, judging by the gaps between its heartbeats so far. A phi of 8 means
+* one chance in a hundred million. Followers stand for election once they suspect the
+* leader (-suspect-phi), in succession order; the leader drops players it is sure are
+* gone (-drop-phi), unless that would be most of them, and keeps the ones whose
+* heartbeats are fine even when their moves are late.
+ */
+
+// the key the leader is tracked under by its followers
+const leaderPeer = "leader"
+
+// how many gaps between heartbeats the detector remembers per peer
+const heartbeatWindow = 100
+
+type Heartbeat struct {
+	Sent int64 `json:"sent"`           // when the first heartbeat was sent, in unix nanoseconds
+	Echo bool  `json:"echo,omitempty"` // this is the echo of one of ours
+}
+
+type HeartbeatMessage struct {
+	Envelope
+	Heartbeat `json:"heartbeat"`
+}
+
+type peerHistory struct {
+	last      time.Time
+	intervals []float64 // in seconds, a ring of the last heartbeatWindow gaps
+	next      int
+	rtt       time.Duration // smoothed like tcp's srtt
+}
+
+type failureDetector struct {
+	mu        sync.Mutex
+	minStdDev float64 // so a peer with clockwork heartbeats isn't suspected for a little jitter
+	peers     map[string]*peerHistory
+}
+
+func newFailureDetector(interval time.Duration) *failureDetector {
+	return &failureDetector{minStdDev: interval.Seconds(), peers: make(map[string]*peerHistory)}
+}
+
+func (d *failureDetector) heard(peer string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	history, ok := d.peers[peer]
+	if !ok {
+		d.peers[peer] = &peerHistory{last: now}
+		return
+	}
+	if gap := now.Sub(history.last).Seconds(); gap > 0 {
+		if len(history.intervals) < heartbeatWindow {
+			history.intervals = append(history.intervals, gap)
+		} else {
+			history.intervals[history.next] = gap
+			history.next = (history.next + 1) % heartbeatWindow
+		}
+	}
+	history.last = now
+}
+
+func (d *failureDetector) roundTrip(peer string, rtt time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if history, ok := d.peers[peer]; ok {
+		if history.rtt == 0 {
+			history.rtt = rtt
+		} else {
+			history.rtt = (7*history.rtt + rtt) / 8
+		}
+	}
+}
+
+func (d *failureDetector) rtt(peer string) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if history, ok := d.peers[peer]; ok {
+		return history.rtt
+	}
+	return 0
+}
+
+// phi is how sure we are that peer is gone. It returns false until the peer has sent
+// a few heartbeats, there is nothing to judge by before that.
+func (d *failureDetector) phi(peer string, now time.Time) (float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	history, ok := d.peers[peer]
+	if !ok || len(history.intervals) < 3 {
+		return 0, false
+	}
+	mean, variance := 0.0, 0.0
+	for _, gap := range history.intervals {
+		mean += gap
+	}
+	mean /= float64(len(history.intervals))
+	for _, gap := range history.intervals {
+		variance += (gap - mean) * (gap - mean)
+	}
+	stdDev := math.Max(math.Sqrt(variance/float64(len(history.intervals))), d.minStdDev)
+	// the logistic approximation of the normal distribution akka's detector uses
+	y := (now.Sub(history.last).Seconds() - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e)), true
+	}
+	return -math.Log10(1 - 1/(1+e)), true
+}
+
+func (d *failureDetector) forget(peer string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.peers, peer)
+}
+
+func (n *Node) heartbeatMessage(sent int64, echo bool) *HeartbeatMessage {
+	return &HeartbeatMessage{
+		Envelope: Envelope{
+			MessageType: "heartbeat",
+			EventName:   "heartbeat",
+			Round:       n.Round,
+		},
+		Heartbeat: Heartbeat{Sent: sent, Echo: echo},
+	}
+}
+
+func (n *Node) heartbeating() bool {
+	return n.config.HeartbeatInterval > 0
+}
+
+// heartbeats sends ours to the leader for as long as we play. It has a goroutine of its
+// own, so a frontend that is slow to move doesn't hold them up.
+func (n *Node) heartbeats() {
+	for !n.stopped.Load() {
+		n.clock.Sleep(n.config.HeartbeatInterval)
+		if n.leaderUDPAddr != nil && !n.stopped.Load() {
+			n.sendToLeader(n.heartbeatMessage(n.clock.Now().UnixNano(), false))
+		}
+	}
+}
+
+// pingPlayers sends every player the leader's heartbeat, if it is time to.
+func (n *Node) pingPlayers() {
+	now := n.clock.Now()
+	if !n.heartbeating() || now.Before(n.leaderState.nextPing) {
+		return
+	}
+	n.leaderState.nextPing = now.Add(n.config.HeartbeatInterval)
+	for _, address := range n.addresses() {
+		if !n.DroppedForever[n.AddrToPid[address]] {
+			n.sendMessage(n.leaderState.leaderConnection, n.heartbeatMessage(now.UnixNano(), false), n.AddrToAddr[address])
+		}
+	}
+}
+
+// leaderWakeup is how long the leader waits for a move before it has to send heartbeats.
+func (n *Node) leaderWakeup(roundDeadline time.Time) time.Time {
+	if n.heartbeating() && n.leaderState.nextPing.Before(roundDeadline) {
+		return n.leaderState.nextPing
+	}
+	return roundDeadline
+}
+
+// receiveHeartbeat notes a heartbeat from peer, echoing it back unless it is an echo itself.
+func (n *Node) receiveHeartbeat(message *HeartbeatMessage, peer string, echo func(Message)) {
+	now := n.clock.Now()
+	n.detector.heard(peer, now)
+	if message.Echo {
+		n.detector.roundTrip(peer, now.Sub(time.Unix(0, message.Sent)))
+		return
+	}
+	echo(n.heartbeatMessage(message.Sent, true))
+}
+
+// the leader's end of a heartbeat from player pid
+func (n *Node) playerHeartbeat(message *HeartbeatMessage, pid string, raddr *net.UDPAddr) {
+	n.receiveHeartbeat(message, pid, func(reply Message) {
+		n.sendMessage(n.leaderState.leaderConnection, reply, raddr)
+	})
+}
+
+// a follower's end of a heartbeat from the leader
+func (n *Node) leaderHeartbeat(message *HeartbeatMessage) {
+	n.receiveHeartbeat(message, leaderPeer, func(reply Message) { n.sendToLeader(reply) })
+	n.heardFromLeader()
+}
+
+// suspectLeader says whether it is our turn to stand for election, because the detector
+// is sure enough the leader is gone and everyone before us in the succession had their chance.
+func (n *Node) suspectLeader() bool {
+	if !n.heartbeating() || n.electionState != FOLLOWER {
+		return false
+	}
+	now := n.clock.Now()
+	phi, known := n.detector.phi(leaderPeer, now)
+	if !known || phi < n.config.SuspectPhi {
+		n.suspectedAt = time.Time{}
+		return false
+	}
+	if n.suspectedAt.IsZero() {
+		n.suspectedAt = now
+		n.logClient(fmt.Sprintf("Suspecting the leader of term %d is gone (phi %.1f, round trip %v)", n.LeaderID, phi, n.detector.rtt(leaderPeer)))
+	}
+	return !now.Before(n.suspectedAt.Add(time.Duration(n.successionRank()) * n.successionStagger()))
+}
+
+// dropSuspects drops every player the detector is sure is gone.
+func (n *Node) dropSuspects() {
+	if !n.heartbeating() {
+		return
+	}
+	now := n.clock.Now()
+	players := 0
+	gone := make(map[string]float64)
+	for _, pid := range n.playerPids() {
+		if n.DroppedForever[pid] {
+			continue
+		}
+		players++
+		phi, known := n.detector.phi(pid, now)
+		if !known || pid == n.leaderState.Pid {
+			continue
+		}
+		if phi >= n.config.SuspectPhi && n.markMember(pid, MemberSuspect) {
+			n.logLeader(fmt.Sprintf("Suspecting player %s is gone (phi %.1f)", pid, phi))
+		}
+		if phi >= n.config.DropPhi {
+			gone[pid] = phi
+		}
+	}
+	// if most of the game went quiet at once, it's more likely us that got cut off
+	if len(gone) > 0 && players-len(gone) <= players/2 {
+		n.logLeader(fmt.Sprintf("Can't hear %d of %d players, not dropping anyone", len(gone), players))
+		return
+	}
+	for _, pid := range n.playerPids() {
+		if phi, ok := gone[pid]; ok {
+			n.logLeader(fmt.Sprintf("Player %s stopped sending heartbeats (phi %.1f, round trip %v), dropping them", pid, phi, n.detector.rtt(pid)))
+			n.dropPlayer(pid)
+		}
+	}
+}
+
+// heartbeatsFine says whether a player that hasn't moved in a while is still there, just slow.
+func (n *Node) heartbeatsFine(pid string) bool {
+	if !n.heartbeating() {
+		return false
+	}
+	phi, known := n.detector.phi(pid, n.clock.Now())
+	if known && phi < n.config.SuspectPhi {
+		n.logLeader("Player " + pid + " hasn't moved for " + strconv.Itoa(n.Grace[pid]) + " rounds, but its heartbeats are fine")
+		return true
+	}
+	return false
+}
+
+// leaderAlive says whether we would still rather keep the leader than vote for a
+// candidate. A voter only needs to be half as sure the leader is gone as a candidate,
+// or the first candidate would usually find the others just short of the threshold.
+func (n *Node) leaderAlive() (alive bool, known bool) {
+	if !n.heartbeating() {
+		return false, false
+	}
+	phi, known := n.detector.phi(leaderPeer, n.clock.Now())
+	return phi < n.config.SuspectPhi/2, known
+}
+
+// nextWakeup is how long a follower waits for a packet before checking on the leader.
+func (n *Node) nextWakeup() time.Time {
+	wakeup := n.electionDeadline
+	if n.heartbeating() && n.clock.Now().Add(n.config.HeartbeatInterval).Before(wakeup) {
+		wakeup = n.clock.Now().Add(n.config.HeartbeatInterval)
+	}
+	if !n.rejoinRetry.IsZero() && n.rejoinRetry.Before(wakeup) {
+		wakeup = n.rejoinRetry
+	}
+	return wakeup
+}
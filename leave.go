@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+/*
+* LEAVING
+*
+* A follower that quits (SIGINT, SIGTERM or the java frontend going away) says so with a
+* leave, so the leader drops it right away instead of steering its cycle until its
+* grace period runs out. The leader tells everyone with a playerleft, and why every
+* player that left did goes in the game over. A leader that quits leaves the same way,
+* just before it hands the game over (see handoff.go).
+ */
+
+type Leave struct {
+	Pid    string `json:"pid"`
+	Reason string `json:"reason"`
+}
+
+type LeaveMessage struct {
+	Envelope
+	Leave `json:"leave"`
+}
+
+type PlayerLeftMessage struct {
+	Envelope
+	Leave `json:"playerLeft"`
+}
+
+func (m *LeaveMessage) validate() error {
+	if m.Pid == "" {
+		return errors.New("missing pid")
+	}
+	return nil
+}
+
+func (m *PlayerLeftMessage) validate() error {
+	if m.Pid == "" {
+		return errors.New("missing pid")
+	}
+	return nil
+}
+
+func (n *Node) leaveMessage(reason string) *LeaveMessage {
+	return &LeaveMessage{
+		Envelope: Envelope{
+			MessageType: "leave",
+			EventName:   "leave",
+			Round:       n.Round,
+		},
+		Leave: Leave{Pid: strconv.Itoa(n.MyPid), Reason: reason},
+	}
+}
+
+func (n *Node) playerLeftMessage(pid, reason string) *PlayerLeftMessage {
+	return &PlayerLeftMessage{
+		Envelope: Envelope{
+			MessageType: "playerleft",
+			EventName:   "playerLeft",
+			Round:       n.Round,
+			Term:        n.leaderState.Term,
+		},
+		Leave: Leave{Pid: pid, Reason: reason},
+	}
+}
+
+// leave tells the leader we are going.
+func (n *Node) leave(reason string) {
+	if n.leaderUDPAddr == nil {
+		return
+	}
+	n.logClient("Leaving the game: " + reason)
+	if n.Lockstep {
+		n.leaveLockstep(reason)
+		return
+	}
+	n.sendToLeader(n.leaveMessage(reason))
+}
+
+// revoked says whether a player left or was kicked. Either way it is gone for good, and
+// no token of its counts anymore.
+func (n *Node) revoked(pid string) bool {
+	_, left := n.Left[pid]
+	return left
+}
+
+// playerLeft drops a player that told us it is going, and tells everyone.
+func (n *Node) playerLeft(pid, reason string) {
+	if _, left := n.Left[pid]; left {
+		return
+	}
+	n.logLeader("Player " + pid + " left: " + reason)
+	n.Left[pid] = reason
+	n.dropPlayer(pid)
+	n.killPlayer(pid)
+	n.markMember(pid, MemberLeft)
+	n.broadcastMessage(n.leaderState.leaderConnection, n.playerLeftMessage(pid, reason))
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+* LOBBY
+*
+* Until the game starts, players and the leader talk in plain json (sealed with the key of
+* the player's join once the leader has it, in an encrypted game):
+*
+*   player -> leader    join: nickname, the encodings it speaks, and its public key and
+*                       password proof in an encrypted game. Again every second until the
+*                       leader answers.
+*   leader -> player    accept, with its pid, or reject, with why: the lobby is full, the
+*                       nickname is taken, the password is wrong, the game is under way or
+*                       the player is banned.
+*                       Three wrong passwords from an ip within 30s and the leader doesn't
+*                       check any more from it until the first is 30s old.
+*   player -> leader    ready, whenever the player toggles it.
+*   host   -> leader    start, and kicks (see moderation.go).
+*   leader -> players   the roster, whenever it changes and every second of the countdown.
+*
+* Once the host asked to start, at least -min-players are in (at most -max-players get in)
+* and all of them are ready, the leader counts down -countdown and everyone gets the game
+* start. A player joining or getting unready calls the countdown off until everyone is
+* ready again. Players send their ready and start again every second until the roster
+* shows the leader got them.
+ */
+
+const (
+	RejectFull       = "full"
+	RejectNickname   = "duplicate nickname"
+	RejectPassword   = "wrong password"
+	RejectInProgress = "game in progress"
+	RejectTooMany    = "too many wrong passwords"
+	RejectLockstep   = "nobody leads a lockstep game to watch it through"
+)
+
+// a player that got the password wrong this often within the window is turned away
+// without being heard until the oldest of its attempts is out of it
+const (
+	maxFailedJoins    = 3
+	failedJoinsWindow = 30 * time.Second
+)
+
+// how often a player says again what the leader hasn't heard yet
+const lobbyRetry = time.Second
+
+type Join struct {
+	Nickname  string   `json:"nickname"`
+	Encodings []string `json:"encodings,omitempty"`
+	PublicKey string   `json:"publicKey,omitempty"` // hex, in an encrypted game
+	Proof     string   `json:"proof,omitempty"`     // hex, that the player knows the password
+	Spectate  bool     `json:"spectate,omitempty"`  // only watch, see spectate.go
+}
+
+type JoinMessage struct {
+	Envelope
+	Join `json:"join"`
+}
+
+type Accept struct {
+	Pid string `json:"pid"`
+}
+
+type AcceptMessage struct {
+	Envelope
+	Accept `json:"accept"`
+}
+
+type Reject struct {
+	Reason  string `json:"reason"`
+	RetryIn int    `json:"retryIn,omitempty"` // seconds until the leader hears the player out again
+}
+
+type RejectMessage struct {
+	Envelope
+	Reject `json:"reject"`
+}
+
+type ReadyMessage struct {
+	Envelope
+	Ready bool `json:"ready"`
+}
+
+type StartMessage struct {
+	Envelope
+}
+
+type LobbyPlayer struct {
+	Pid      string `json:"pid"`
+	Nickname string `json:"nickname"`
+	Ready    bool   `json:"ready"`
+}
+
+type Roster struct {
+	Players   []LobbyPlayer `json:"players"`
+	Min       int           `json:"min"`
+	Max       int           `json:"max"`
+	Starting  bool          `json:"starting"`  // the host asked to start
+	Countdown int           `json:"countdown"` // seconds until the game starts, 0 unless counting down
+	Invite    string        `json:"invite,omitempty"`
+	Watching  []string      `json:"watching,omitempty"` // the nicknames of the spectators
+}
+
+type RosterMessage struct {
+	Envelope
+	Roster `json:"roster"`
+}
+
+func (m *JoinMessage) validate() error {
+	if m.Nickname == "" {
+		return errors.New("missing nickname")
+	}
+	return nil
+}
+
+func (m *AcceptMessage) validate() error {
+	if _, err := strconv.Atoi(m.Pid); err != nil {
+		return errors.New("bad pid " + m.Pid)
+	}
+	return nil
+}
+
+// the player's end of the lobby
+type lobbyState struct {
+	wantReady atomic.Bool
+	wantStart atomic.Bool
+	joined    atomic.Bool // the leader let us in
+	over      atomic.Bool // we got the game start, or never were in the lobby
+	roster    Roster      // the last one we got
+}
+
+func lobbyEnvelope(messageType string) Envelope {
+	return Envelope{MessageType: messageType, EventName: messageType}
+}
+
+func (n *Node) joinMessage() *JoinMessage {
+	join := Join{Nickname: n.Nickname, Encodings: SUPPORTED_ENCODINGS, Spectate: n.config.Spectate}
+	n.joinKeys(&join)
+	return &JoinMessage{Envelope: lobbyEnvelope("join"), Join: join}
+}
+
+func (n *Node) rosterMessage() *RosterMessage {
+	roster := Roster{
+		Min:      n.config.MinPlayers,
+		Max:      n.config.MaxPlayers,
+		Starting: n.leaderState.starting,
+	}
+	if n.config.Invite {
+		// everyone that got in knows it anyway, the host's frontend shows it to hand out
+		roster.Invite = n.config.Password
+	}
+	for _, pid := range n.playerPids() {
+		roster.Players = append(roster.Players, LobbyPlayer{Pid: pid, Nickname: n.PidToNickname[pid], Ready: n.leaderState.Ready[pid]})
+	}
+	sort.Slice(roster.Players, func(i, j int) bool { return pidLess(roster.Players[i].Pid, roster.Players[j].Pid) })
+	for _, nickname := range n.Spectators {
+		roster.Watching = append(roster.Watching, nickname)
+	}
+	sort.Strings(roster.Watching)
+	if !n.leaderState.countdown.IsZero() {
+		left := n.leaderState.countdown.Sub(n.clock.Now())
+		roster.Countdown = int((left + time.Second - 1) / time.Second)
+	}
+	return &RosterMessage{Envelope: lobbyEnvelope("roster"), Roster: roster}
+}
+
+/*
+* LEADER SIDE
+ */
+
+// lobbyPacket handles whatever a player sent the open lobby.
+func (n *Node) lobbyPacket(buf []byte, raddr *net.UDPAddr) {
+	message, err := decodeMessage(buf)
+	if err != nil {
+		n.logLeader("Ignoring a bad lobby message from " + raddr.String() + ": " + err.Error())
+		return
+	}
+	pid, joined := n.AddrToPid[raddr.String()]
+	switch message := message.(type) {
+	case *JoinMessage:
+		if joined {
+			// our accept got lost
+			n.sendLobby(&AcceptMessage{Envelope: lobbyEnvelope("accept"), Accept: Accept{Pid: pid}}, raddr, pid)
+			return
+		}
+		n.admit(message.Join, raddr)
+	case *ReadyMessage:
+		if !joined || n.isSpectator(pid) {
+			n.logLeader("Ignoring a ready from " + raddr.String() + ", which isn't playing")
+			return
+		}
+		if n.leaderState.Ready[pid] != message.Ready {
+			n.leaderState.Ready[pid] = message.Ready
+			n.logLeader(fmt.Sprintf("Player %s is ready: %t", pid, message.Ready))
+			n.broadcastRoster()
+		}
+	case *StartMessage:
+		if !joined || pid != n.leaderState.Pid {
+			n.logLeader("Ignoring a start from " + raddr.String() + ", only the host starts the game")
+			return
+		}
+		if !n.leaderState.starting {
+			n.logLeader("The host wants to start once everyone is ready")
+			n.leaderState.starting = true
+			n.leaderState.Ready[pid] = true
+			n.broadcastRoster()
+		}
+	case *KickMessage:
+		if !joined {
+			n.logLeader("Ignoring a kick from " + raddr.String() + ", which never joined")
+			return
+		}
+		n.kickFromLobby(message.Kick, pid)
+	default:
+		n.logLeader("Ignoring a " + message.header().MessageType + " message, the game hasn't started")
+	}
+}
+
+// admit lets a player into the lobby, or tells it why not.
+func (n *Node) admit(join Join, raddr *net.UDPAddr) {
+	publicKey, reject := n.screenJoin(join, raddr)
+	if reject.Reason != "" {
+		n.logLeader("Turning away " + join.Nickname + " from " + raddr.String() + ": " + reject.Reason)
+		n.reject(raddr, reject)
+		return
+	}
+	var pid string
+	if join.Spectate {
+		pid = n.registerSpectator(raddr, join, publicKey)
+	} else {
+		pid = n.registerNewPlayer(raddr, join, publicKey)
+	}
+	n.sendLobby(&AcceptMessage{Envelope: lobbyEnvelope("accept"), Accept: Accept{Pid: pid}}, raddr, pid)
+	n.broadcastRoster()
+}
+
+// screenJoin checks a join, and gives the key it came with or why the player can't join.
+func (n *Node) screenJoin(join Join, raddr *net.UDPAddr) ([]byte, Reject) {
+	if n.leaderState.failedJoins == nil {
+		// a leader elected in the middle of the game never opened a lobby
+		n.leaderState.failedJoins = make(map[string][]time.Time)
+	}
+	if wait := n.joinLockout(raddr); wait > 0 {
+		return nil, Reject{Reason: RejectTooMany, RetryIn: int((wait + time.Second - 1) / time.Second)}
+	}
+	reason := ""
+	publicKey, err := n.checkJoinKeys(join)
+	switch {
+	case n.banned(join, raddr):
+		reason = RejectBanned
+	case err == errWrongPassword:
+		reason = RejectPassword
+		ip := raddr.IP.String()
+		n.leaderState.failedJoins[ip] = append(n.leaderState.failedJoins[ip], n.clock.Now())
+	case err != nil:
+		reason = err.Error()
+	case join.Spectate && (n.config.Lockstep || n.Lockstep):
+		reason = RejectLockstep
+	case join.Spectate:
+		// watching takes no cycle
+	case len(n.Alive) >= n.config.MaxPlayers:
+		reason = RejectFull
+	case n.nicknameTaken(join.Nickname):
+		reason = RejectNickname
+	}
+	return publicKey, Reject{Reason: reason}
+}
+
+func (n *Node) nicknameTaken(nickname string) bool {
+	for _, taken := range n.PidToNickname {
+		if strings.EqualFold(taken, nickname) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinLockout says how long until the leader checks a password from the ip of raddr again,
+// 0 if it still does.
+func (n *Node) joinLockout(raddr *net.UDPAddr) time.Duration {
+	ip := raddr.IP.String()
+	now := n.clock.Now()
+	recent := n.leaderState.failedJoins[ip][:0]
+	for _, at := range n.leaderState.failedJoins[ip] {
+		if now.Sub(at) < failedJoinsWindow {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) == 0 {
+		delete(n.leaderState.failedJoins, ip)
+		return 0
+	}
+	n.leaderState.failedJoins[ip] = recent
+	if len(recent) < maxFailedJoins {
+		return 0
+	}
+	return recent[len(recent)-maxFailedJoins].Add(failedJoinsWindow).Sub(now)
+}
+
+func (n *Node) reject(raddr *net.UDPAddr, reject Reject) {
+	buf := encodeMessage(&RejectMessage{Envelope: lobbyEnvelope("reject"), Reject: reject})
+	// we have no key of theirs, so in the clear
+	if _, err := n.writeClear(n.leaderState.leaderConnection, n.Logger.PrepareSend("", buf), raddr); err != nil {
+		n.logLeader("Can't tell " + raddr.String() + " it was turned away: " + err.Error())
+	}
+}
+
+// turnAwayLate tells a player that wants to join once the game is under way that it is too
+// late, unless it only wants to watch.
+func (n *Node) turnAwayLate(buf []byte, raddr *net.UDPAddr) bool {
+	message, err := decodeMessage(buf)
+	join, ok := message.(*JoinMessage)
+	if err != nil || !ok {
+		return false
+	}
+	if join.Spectate {
+		n.watchLate(join.Join, raddr)
+		return true
+	}
+	n.logLeader("Turning away a player from " + raddr.String() + ": " + RejectInProgress)
+	n.reject(raddr, Reject{Reason: RejectInProgress})
+	return true
+}
+
+// sendLobby sends a joined player a lobby message, sealed with its key if the game is encrypted.
+func (n *Node) sendLobby(message Message, raddr *net.UDPAddr, pid string) {
+	buf := encodeMessage(message)
+	if _, err := n.writeHandshake(n.leaderState.leaderConnection, n.Logger.PrepareSend("", buf), raddr, pid); err != nil {
+		n.logLeader("Can't send player " + pid + " a " + message.header().MessageType + " message: " + err.Error())
+	}
+}
+
+func (n *Node) broadcastRoster() {
+	roster := n.rosterMessage()
+	for address, pid := range n.AddrToPid {
+		n.sendLobby(roster, n.AddrToAddr[address], pid)
+	}
+}
+
+// startProblem says why the game can't start yet, or "" if it can.
+func (n *Node) startProblem() string {
+	if !n.leaderState.starting {
+		return "the host hasn't started it"
+	}
+	if len(n.Alive) < n.config.MinPlayers {
+		return fmt.Sprintf("only %d of at least %d players are in", len(n.Alive), n.config.MinPlayers)
+	}
+	var waiting []string
+	for _, pid := range n.playerPids() {
+		if !n.leaderState.Ready[pid] {
+			waiting = append(waiting, pid)
+		}
+	}
+	if len(waiting) > 0 {
+		sort.Slice(waiting, func(i, j int) bool { return pidLess(waiting[i], waiting[j]) })
+		return "waiting for " + strings.Join(waiting, ", ") + " to get ready"
+	}
+	return ""
+}
+
+// tickCountdown starts the countdown once the game can start, calls it off when it can't
+// any more, and tells everyone how long is left every second. It says whether the
+// countdown is over.
+func (n *Node) tickCountdown() bool {
+	now := n.clock.Now()
+	problem := n.startProblem()
+	switch {
+	case n.leaderState.countdown.IsZero() && problem == "":
+		n.logLeader("Everyone is ready, the game starts in " + n.config.Countdown.String())
+		n.leaderState.countdown = now.Add(n.config.Countdown)
+		n.leaderState.nextTick = now
+	case n.leaderState.countdown.IsZero():
+		return false
+	case problem != "":
+		n.logLeader("Calling off the countdown, " + problem)
+		n.leaderState.countdown = time.Time{}
+		n.broadcastRoster()
+		return false
+	}
+	if !now.Before(n.leaderState.countdown) {
+		return true
+	}
+	if !now.Before(n.leaderState.nextTick) {
+		n.leaderState.nextTick = now.Add(time.Second)
+		n.broadcastRoster()
+	}
+	return false
+}
+
+// lobbyWakeup is how long the leader waits for a player before it has to announce the
+// lobby or tick the countdown.
+func (n *Node) lobbyWakeup() time.Time {
+	wakeup := n.clock.Now().Add(lobbyAnnounceInterval)
+	if n.config.LobbyGroup != "" && n.leaderState.nextAnnounce.Before(wakeup) {
+		wakeup = n.leaderState.nextAnnounce
+	}
+	if !n.leaderState.countdown.IsZero() && n.leaderState.nextTick.Before(wakeup) {
+		wakeup = n.leaderState.nextTick
+	}
+	if !n.leaderState.countdown.IsZero() && n.leaderState.countdown.Before(wakeup) {
+		wakeup = n.leaderState.countdown
+	}
+	return wakeup
+}
+
+/*
+* PLAYER SIDE
+ */
+
+// joinLobby joins the leader's lobby and waits in it for the game start, passing the
+// frontend's ready and start on to the leader and the roster back. It returns nil if the
+// leader turned us away.
+func (n *Node) joinLobby() *GameStartMessage {
+	join := n.joinMessage()
+	pid := ""
+	retry := n.clock.Now()
+	for {
+		if !n.clock.Now().Before(retry) {
+			retry = n.clock.Now().Add(lobbyRetry)
+			if pid == "" {
+				n.logClient("Asking the leader at " + n.leaderAddr + " to join as " + n.Nickname)
+				n.sendToLobby(join)
+			} else {
+				n.resendLobbyCommands(pid)
+			}
+		}
+		buf, raddr, timedout := n.readFromUDPWithTimeout(n.goConnection, retry)
+		if timedout {
+			continue
+		}
+		if raddr.String() != n.leaderUDPAddr.String() {
+			n.logClient("Ignoring a packet from " + raddr.String() + " while waiting for the game to start, it isn't the leader")
+			continue
+		}
+		message, err := decodeWireMessage(buf)
+		if err != nil {
+			n.logClient("Ignoring bad message while waiting for the game to start: " + err.Error())
+			continue
+		}
+		switch message := message.(type) {
+		case *AcceptMessage:
+			if pid == "" {
+				pid = message.Pid
+				n.lobby.joined.Store(true)
+				n.logClient("The leader let us in as player " + pid)
+				n.resendLobbyCommands(pid)
+			}
+		case *RejectMessage:
+			if message.RetryIn > 0 {
+				n.logClient(fmt.Sprintf("The leader turned us away: %s, try again in %ds", message.Reason, message.RetryIn))
+			} else {
+				n.logClient("The leader turned us away: " + message.Reason)
+			}
+			n.recvChan.Put(message)
+			return nil
+		case *RosterMessage:
+			n.lobby.roster = message.Roster
+			n.recvChan.Put(message)
+		case *GameStartMessage:
+			return message
+		default:
+			n.logClient("Ignoring a " + message.header().MessageType + " message while waiting for the game to start")
+		}
+	}
+}
+
+// resendLobbyCommands says again whatever the last roster shows the leader didn't get.
+func (n *Node) resendLobbyCommands(pid string) {
+	for _, player := range n.lobby.roster.Players {
+		if player.Pid == pid && player.Ready != n.lobby.wantReady.Load() {
+			n.sendToLobby(&ReadyMessage{Envelope: lobbyEnvelope("ready"), Ready: n.lobby.wantReady.Load()})
+		}
+	}
+	if n.lobby.wantStart.Load() && !n.lobby.roster.Starting {
+		n.sendToLobby(&StartMessage{Envelope: lobbyEnvelope("start")})
+	}
+}
+
+// forwardLobbyCommands passes the frontend's ready and start on to the leader until the
+// game starts.
+func (n *Node) forwardLobbyCommands() {
+	for {
+		command, ok := n.lobbyChan.Get()
+		if !ok {
+			return
+		}
+		switch command := command.(type) {
+		case *ReadyMessage:
+			n.lobby.wantReady.Store(command.Ready)
+		case *StartMessage:
+			n.lobby.wantStart.Store(true)
+		}
+		// until the leader lets us in, it goes with the first roster
+		if n.lobby.joined.Load() && !n.lobby.over.Load() {
+			n.sendToLobby(command.(Message))
+		}
+	}
+}
+
+// sendToLobby sends the leader a lobby message, in the clear since it has no key of ours
+// yet. The lobby resends what matters, so a failed send is only logged.
+func (n *Node) sendToLobby(message Message) {
+	_, err := n.goConnection.WriteTo(n.Logger.PrepareSend("", encodeMessage(message)), n.leaderUDPAddr)
+	if err != nil {
+		n.logClient("Failed to send the leader a " + message.header().MessageType + " message: " + err.Error())
+	}
+}
+
+// decodeLobbyCommand reads a ready or start from the frontend, which sends them flat like
+// its moves.
+func decodeLobbyCommand(buf []byte) (Message, bool) {
+	var command struct {
+		EventName string `json:"eventName"`
+		Ready     bool   `json:"ready"`
+	}
+	if err := json.Unmarshal(buf, &command); err != nil {
+		return nil, false
+	}
+	switch command.EventName {
+	case "ready":
+		return &ReadyMessage{Envelope: lobbyEnvelope("ready"), Ready: command.Ready}, true
+	case "start":
+		return &StartMessage{Envelope: lobbyEnvelope("start")}, true
+	}
+	return nil, false
+}
+
+// anyLobbyMessage is what the leader takes in the clear while the lobby is open.
+func anyLobbyMessage(buf []byte) bool {
+	return true
+}
+
+func isRejectMessage(buf []byte) bool {
+	message, err := decodeMessage(buf)
+	if err != nil {
+		return false
+	}
+	_, ok := message.(*RejectMessage)
+	return ok
+}
+
+func isJoinMessage(buf []byte) bool {
+	message, err := decodeMessage(buf)
+	if err != nil {
+		return false
+	}
+	_, ok := message.(*JoinMessage)
+	return ok
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// onClock runs f on the virtual clock and returns once there is nothing left to happen.
+func onClock(clock *SimClock, f func()) {
+	clock.AfterFunc(0, f)
+	clock.mu.Lock()
+	clock.advance()
+	clock.mu.Unlock()
+	<-clock.Stalled()
+}
+
+// a lobby on a simulated network, with its leader at 10.0.0.1:7000
+type testLobby struct {
+	clock   *SimClock
+	network *SimNetwork
+	leader  *Node
+}
+
+func newTestLobby(config Config) *testLobby {
+	clock := NewSimClock(time.Unix(0, 0))
+	network := NewSimNetwork(clock, 1)
+	leader := NewNode(WithConfig(config), WithGridSize(config.Width, config.Height), WithNickname("lobbyhost"),
+		WithLeader("10.0.0.1:7000", true), WithClock(clock), WithNetwork(network))
+	leader.initializeLeader("10.0.0.1:7000")
+	leader.leaderState.Ready = make(map[string]bool)
+	leader.leaderState.failedJoins = make(map[string][]time.Time)
+	return &testLobby{clock: clock, network: network, leader: leader}
+}
+
+// join asks to join from addr with the password, and says what the leader answered: the
+// pid it was given, or why it was turned away.
+func (l *testLobby) join(addr, nickname, password string, spectate bool) string {
+	config := DefaultConfig()
+	config.Password, config.Spectate = password, spectate
+	player := NewNode(WithConfig(config), WithNickname(nickname), WithClock(l.clock), WithNetwork(l.network))
+	conn, _ := l.network.Listen(addr)
+	conn = player.secure(conn, isRejectMessage)
+	l.leader.lobbyPacket(encodeMessage(player.joinMessage()), conn.LocalAddr())
+	for {
+		buf, _, err := conn.ReadFrom(l.clock.Now().Add(time.Second))
+		if err != nil {
+			return "no answer"
+		}
+		message, _ := decodeMessage(buf)
+		switch message := message.(type) {
+		case *AcceptMessage:
+			return "pid " + message.Pid
+		case *RejectMessage:
+			if message.RetryIn > 0 {
+				return message.Reason + " for " + strconv.Itoa(message.RetryIn) + "s"
+			}
+			return message.Reason
+		}
+	}
+}
+
+type lobbyJoin struct {
+	name     string
+	addr     string
+	nickname string
+	password string
+	spectate bool
+	after    time.Duration
+	want     string
+}
+
+func (l *testLobby) play(t *testing.T, joins []lobbyJoin) {
+	onClock(l.clock, func() {
+		for _, join := range joins {
+			l.clock.Sleep(join.after)
+			if got := l.join(join.addr, join.nickname, join.password, join.spectate); got != join.want {
+				t.Errorf("%s: got %q, want %q", join.name, got, join.want)
+			}
+		}
+	})
+}
+
+// the lobby lets in at most -max-players, under nicknames nobody else has
+func TestLobbyCapacity(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxPlayers = 2
+	lobby := newTestLobby(config)
+	lobby.play(t, []lobbyJoin{
+		{name: "first", addr: "10.0.0.2:7000", nickname: "alice", want: "pid 1"},
+		{name: "same nickname", addr: "10.0.0.3:7000", nickname: "ALICE", want: RejectNickname},
+		{name: "second", addr: "10.0.0.3:7001", nickname: "bob", want: "pid 2"},
+		{name: "third", addr: "10.0.0.4:7000", nickname: "carol", want: RejectFull},
+		{name: "spectator", addr: "10.0.0.5:7000", nickname: "dave", spectate: true, want: "pid 3"},
+	})
+	if len(lobby.leader.Alive) != 2 || len(lobby.leader.Spectators) != 1 {
+		t.Errorf("%d players and %d spectators got in, want 2 and 1", len(lobby.leader.Alive), len(lobby.leader.Spectators))
+	}
+}
+
+// a lobby with a password only lets in players that know it, and stops listening to an ip
+// that got it wrong three times for 30 seconds after the first
+func TestLobbyPassword(t *testing.T) {
+	config := DefaultConfig()
+	config.Password = "secret"
+	lobby := newTestLobby(config)
+	lobby.play(t, []lobbyJoin{
+		{name: "right password", addr: "10.0.0.2:7000", nickname: "alice", password: "secret", want: "pid 1"},
+		{name: "no password", addr: "10.0.0.3:7000", nickname: "bob", want: "this game is encrypted, but the player sent no key"},
+		{name: "first wrong password", addr: "10.0.0.3:7001", nickname: "bob", password: "Secret", want: RejectPassword},
+		{name: "second wrong password", addr: "10.0.0.3:7002", nickname: "bob", password: "secret ", after: 10 * time.Second, want: RejectPassword},
+		{name: "another ip", addr: "10.0.0.4:7000", nickname: "carol", password: "guess", want: RejectPassword},
+		{name: "third wrong password", addr: "10.0.0.3:7003", nickname: "bob", password: "hunter2", after: 10 * time.Second, want: RejectPassword},
+		{name: "right password too late", addr: "10.0.0.3:7004", nickname: "bob", password: "secret", want: RejectTooMany + " for 10s"},
+		{name: "the other ip still gets checked", addr: "10.0.0.4:7001", nickname: "carol", password: "secret", want: "pid 2"},
+		{name: "first out of the window", addr: "10.0.0.3:7005", nickname: "bob", password: "secret", after: 10 * time.Second, want: "pid 3"},
+	})
+}
+
+// an invite code is 20 symbols anyone can read out, and players join with it like with a
+// password
+func TestLobbyInvite(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code := newInviteCode()
+		groups := strings.Split(code, "-")
+		if len(groups) != inviteGroups {
+			t.Fatalf("%s is in %d groups, want %d", code, len(groups), inviteGroups)
+		}
+		for _, group := range groups {
+			if len(group) != inviteGroupSize || strings.Trim(group, inviteAlphabet) != "" {
+				t.Fatalf("%s has a group %q that isn't %d symbols of %s", code, group, inviteGroupSize, inviteAlphabet)
+			}
+		}
+	}
+
+	config := DefaultConfig()
+	config.Invite = true
+	lobby := newTestLobby(config)
+	code := lobby.leader.config.Password
+	if roster := lobby.leader.rosterMessage(); roster.Invite != code || len(code) != 24 {
+		t.Fatalf("the roster shows the invite code %q, the lobby has %q", roster.Invite, code)
+	}
+	lobby.play(t, []lobbyJoin{
+		{name: "with the code", addr: "10.0.0.2:7000", nickname: "alice", password: code, want: "pid 1"},
+		{name: "with the code in lower case", addr: "10.0.0.3:7000", nickname: "bob", password: strings.ToLower(code), want: RejectPassword},
+		{name: "with another code", addr: "10.0.0.4:7000", nickname: "carol", password: newInviteCode(), want: RejectPassword},
+	})
+}
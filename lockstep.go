@@ -0,0 +1,557 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+* LOCKSTEP
+*
+* With -lockstep the host only runs the lobby. Once the game starts nobody leads: every
+* player sends its move for the round to everyone else, waits until it has the move of
+* every cycle still in the game, and works the round out itself. Everyone works it out
+* the same way from the same moves, so everyone ends up with the same game:
+*
+*   every cycle that is still alive moves one cell, in pid order; a cycle that moves onto
+*   a wall or a trail dies, and so do cycles that move onto the same cell.
+*
+* Nobody works a round out without a move it is missing, however late it is. Every move
+* message carries the player's moves of the last few rounds and the checksum of its game
+* up to the round before, so a lost packet is made up for by the next one. Only the
+* player itself is taken for its moves: everyone signs with the same group key, so a move
+* passed on by someone else could be made up. A player we have no move from for
+* max-missed-messages follower response times is dropped from that round on, and the
+* drop goes round with every move message. Everyone else drops it too once most of the
+* players still in the game did, or once they timed it out themselves, from the earliest
+* round anyone dropped it from. One that quits is dropped the round after its last move.
+*
+* A player whose checksum disagrees with the one of the player with the lowest pid still in
+* the game asks that player for its state and carries on from there. So does a player
+* someone else says was dropped; it only stops if that state says so too.
+ */
+
+type Inputs struct {
+	Pid        string         `json:"pid"`
+	Checksum   uint32         `json:"checksum"`          // of the sender's game up to the round before
+	Directions []string       `json:"directions"`        // the sender's last rounds, oldest first, ending on the envelope's round
+	Dropped    map[string]int `json:"dropped,omitempty"` // players dropped, and the first round they are gone for
+}
+
+type InputsMessage struct {
+	Envelope
+	Inputs `json:"inputs"`
+}
+
+func (m *InputsMessage) validate() error {
+	if m.Pid == "" {
+		return errors.New("missing pid")
+	}
+	if len(m.Directions) == 0 {
+		return errors.New("no directions")
+	}
+	for _, direction := range m.Directions {
+		if !isDirection(direction) {
+			return errors.New("unknown direction " + direction)
+		}
+	}
+	return nil
+}
+
+type lockstepState struct {
+	inputs   map[int]map[string]string // every direction we have, by round then pid
+	sent     []string                  // ours, oldest first, ending on round through
+	through  int
+	leaving  map[string]int            // players that quit, and the first round they are gone for
+	dropped  map[string]int            // players nobody had a move from, and the first round they are gone for
+	claims   map[string]map[string]int // drops we heard of, by dropped player then who dropped it
+	asked    string                    // the player we asked for its state
+	out      bool                      // everyone else dropped us
+	checksum uint32                    // of our game up to MovesRound
+	base     uint32                    // of our game up to the round before through
+}
+
+func (n *Node) inputsMessage() *InputsMessage {
+	dropped := make(map[string]int)
+	for pid, round := range n.steps.dropped {
+		dropped[pid] = round
+	}
+	return &InputsMessage{
+		Envelope: Envelope{
+			MessageType: "inputs",
+			EventName:   "inputs",
+			Round:       n.steps.through,
+		},
+		Inputs: Inputs{
+			Pid:        strconv.Itoa(n.MyPid),
+			Checksum:   n.steps.base,
+			Directions: n.steps.sent,
+			Dropped:    dropped,
+		},
+	}
+}
+
+// playLockstep plays the whole game without a leader.
+func (n *Node) playLockstep() {
+	n.logClient("Playing in lockstep, nobody leads the game")
+	// the host only ran the lobby
+	n.isLeader = false
+	n.electionState = FOLLOWER
+	n.steps = lockstepState{
+		inputs:   make(map[int]map[string]string),
+		leaving:  make(map[string]int),
+		dropped:  make(map[string]int),
+		claims:   make(map[string]map[string]int),
+		checksum: n.stateChecksum(),
+	}
+	me := strconv.Itoa(n.MyPid)
+	for !n.gameOver() && !n.steps.out {
+		n.Round = n.MovesRound + 1
+		direction := n.askFrontend()
+		n.steps.sent = append(n.steps.sent, direction)
+		if len(n.steps.sent) > len(n.Positions) {
+			n.steps.sent = n.steps.sent[1:]
+		}
+		n.steps.through = n.Round
+		n.steps.base = n.steps.checksum
+		n.addInput(n.Round, me, direction)
+		n.sendToPeers(n.inputsMessage())
+		n.predictRound(n.Round, direction)
+		n.awaitInputs()
+		if n.steps.out {
+			break
+		}
+		// unless we caught up with someone else's state meanwhile
+		if n.MovesRound < n.Round {
+			n.resolveRound()
+		}
+		n.recvChan.Put(&MovesMessage{
+			Envelope: Envelope{
+				MessageType: "moves",
+				EventName:   "moves",
+				Round:       n.MovesRound,
+			},
+			Moves: Moves{
+				Moves: []map[string]Move{n.getCurrentMoveMap()},
+				Round: n.MovesRound,
+			},
+		})
+		n.rollback()
+	}
+	if n.steps.out {
+		n.logClient("Everyone else dropped us from the game")
+		n.recvChan.Put(n.endGameMessage())
+		return
+	}
+	// everyone else may still be waiting on our last move
+	n.sendToPeers(n.inputsMessage())
+	n.lingerLockstep()
+	n.logClient("Game over, dead in order: " + fmt.Sprint(n.Finish))
+	n.recvChan.Put(n.endGameMessage())
+}
+
+// askFrontend gets our move for the round, or keeps us going straight if the frontend
+// has nothing sensible to say.
+func (n *Node) askFrontend() string {
+	previous := n.getCurrentMoveMap()[strconv.Itoa(n.MyPid)].Direction
+	if !isDirection(previous) {
+		previous = DIRECTIONS[0]
+	}
+	n.recvChan.Put(&RoundStartMessage{
+		Envelope:   Envelope{MessageType: "roundstart", EventName: "roundStart", Round: n.Round},
+		RoundStart: RoundStart{Round: n.Round},
+	})
+	reply, _ := n.sendChan.Get()
+	if reply == nil {
+		return previous
+	}
+	return reply.(*MyMoveMessage).Direction
+}
+
+func (n *Node) addInput(round int, pid, direction string) {
+	if from, dropped := n.steps.dropped[pid]; dropped && round >= from {
+		return
+	}
+	if n.steps.inputs[round] == nil {
+		n.steps.inputs[round] = make(map[string]string)
+	}
+	if _, known := n.steps.inputs[round][pid]; !known {
+		n.steps.inputs[round][pid] = direction
+	}
+}
+
+// awaitInputs reads moves until everyone still playing sent theirs for the round, and
+// drops whoever nobody heard from for max-missed-messages follower response times. Ours
+// goes out again every game tick meanwhile, in case it got lost.
+func (n *Node) awaitInputs() {
+	deadline := n.clock.Now().Add(n.config.FollowerResponseTime * time.Duration(n.config.MaxAllowableMissedMessages))
+	resend := n.clock.Now().Add(n.config.MinGameSpeed)
+	for n.MovesRound < n.Round && !n.haveInputs() && !n.steps.out {
+		wakeup := deadline
+		if resend.Before(wakeup) {
+			wakeup = resend
+		}
+		buf, raddr, timedout := n.readFromUDPWithTimeout(n.goConnection, wakeup)
+		if timedout {
+			if !n.clock.Now().Before(deadline) {
+				n.dropMissing()
+			}
+			n.sendToPeers(n.inputsMessage())
+			resend = n.clock.Now().Add(n.config.MinGameSpeed)
+			continue
+		}
+		message, err := n.openFromPeer(buf, raddr)
+		if err != nil {
+			n.logClient("Ignoring message: " + err.Error())
+			continue
+		}
+		sender := n.AddrToPid[raddr.String()]
+		switch message := message.(type) {
+		case *InputsMessage:
+			n.receiveInputs(message, sender)
+		case *ResyncMessage:
+			n.sendState(sender, raddr)
+		case *StateReportMessage:
+			n.catchUp(message, sender)
+		case *LeaveMessage:
+			if message.Pid != sender {
+				n.logClient("Ignoring a leave for player " + message.Pid + " from player " + sender)
+				break
+			}
+			if _, known := n.steps.leaving[sender]; !known {
+				n.logClient("Player " + sender + " left: " + message.Reason)
+				n.Left[sender] = message.Reason
+				n.steps.leaving[sender] = message.Envelope.Round
+			}
+		default:
+			n.logClient("Ignoring a " + message.header().MessageType + " message, nobody leads a lockstep game")
+		}
+	}
+}
+
+func (n *Node) receiveInputs(message *InputsMessage, sender string) {
+	if message.Pid != sender {
+		n.logClient("Ignoring the moves of player " + message.Pid + " from player " + sender)
+		return
+	}
+	for pid, round := range message.Dropped {
+		n.claimDrop(pid, round, sender)
+	}
+	last := message.Envelope.Round
+	first := last - len(message.Directions) + 1
+	for i, direction := range message.Directions {
+		if round := first + i; round > n.MovesRound {
+			n.addInput(round, sender, direction)
+		}
+	}
+	if last == n.MovesRound+1 && message.Checksum != n.steps.checksum && sender == n.referencePlayer() && n.divergedRound != n.MovesRound {
+		n.logClient(fmt.Sprintf("Our game diverged from player %s's on round %d (checksum %08x, theirs is %08x), asking for its state",
+			sender, n.MovesRound, n.steps.checksum, message.Checksum))
+		n.askForState(sender)
+	}
+}
+
+// askForState asks a player for its game, at most once a round.
+func (n *Node) askForState(pid string) {
+	if n.divergedRound == n.MovesRound {
+		return
+	}
+	n.divergedRound = n.MovesRound
+	n.steps.asked = pid
+	n.sendMessage(n.goConnection, n.resyncMessage(), n.addrOf(pid))
+}
+
+// dropMissing drops everyone we still have no move from for the round.
+func (n *Node) dropMissing() {
+	for _, pid := range n.playerPids() {
+		if n.waitingFor(pid) {
+			n.logClient("Nobody had a move from player " + pid + " for round " + strconv.Itoa(n.Round) + ", dropping it")
+			n.agreeToDrop(pid, n.earliestClaim(pid, n.Round))
+		}
+	}
+}
+
+// claimDrop notes that sender dropped pid from round on, and drops it too once most of the
+// players still in the game did. Nobody drops us on someone else's word, we ask the
+// reference player for the game instead.
+func (n *Node) claimDrop(pid string, round int, sender string) {
+	me := strconv.Itoa(n.MyPid)
+	if pid == me {
+		reference := n.referencePlayer()
+		if reference == me {
+			reference = sender
+		}
+		if n.divergedRound != n.MovesRound {
+			n.logClient("Player " + sender + " says we were dropped from round " + strconv.Itoa(round) + ", asking player " + reference + " for its state")
+		}
+		n.askForState(reference)
+		return
+	}
+	if n.steps.claims[pid] == nil {
+		n.steps.claims[pid] = make(map[string]int)
+	}
+	if from, claimed := n.steps.claims[pid][sender]; !claimed || round < from {
+		n.steps.claims[pid][sender] = round
+	}
+	if _, dropped := n.steps.dropped[pid]; dropped {
+		// we agreed already, everyone just has to settle on the earliest round
+		n.agreeToDrop(pid, round)
+		return
+	}
+	players, agreed := 0, 0
+	for _, player := range n.playerPids() {
+		if player == pid || !n.stillPlaying(player) {
+			continue
+		}
+		players++
+		if _, claimed := n.steps.claims[pid][player]; claimed {
+			agreed++
+		}
+	}
+	if 2*agreed > players {
+		n.logClient(fmt.Sprintf("Most players dropped player %s, so do we", pid))
+		n.agreeToDrop(pid, n.earliestClaim(pid, round))
+	}
+}
+
+// earliestClaim is the earliest round, round or one anyone dropped pid from.
+func (n *Node) earliestClaim(pid string, round int) int {
+	for _, from := range n.steps.claims[pid] {
+		if from < round {
+			round = from
+		}
+	}
+	return round
+}
+
+// agreeToDrop drops pid from round on, or from an earlier round if someone else dropped it
+// from there.
+func (n *Node) agreeToDrop(pid string, round int) {
+	if from, dropped := n.steps.dropped[pid]; dropped && from <= round {
+		return
+	}
+	if round <= n.MovesRound {
+		// we already played that round with its move, the checksums will tell
+		n.logClient(fmt.Sprintf("Player %s was dropped from round %d, we are already past it", pid, round))
+	}
+	n.steps.dropped[pid] = round
+	for r := range n.steps.inputs {
+		if r >= round {
+			delete(n.steps.inputs[r], pid)
+		}
+	}
+}
+
+// haveInputs says whether every cycle still in the game has a move for the round.
+func (n *Node) haveInputs() bool {
+	for _, pid := range n.playerPids() {
+		if n.waitingFor(pid) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *Node) waitingFor(pid string) bool {
+	_, moved := n.steps.inputs[n.Round][pid]
+	return !moved && n.Alive[pid] && !n.DroppedForever[pid] && !n.goneBy(pid, n.Round)
+}
+
+func (n *Node) goneBy(pid string, round int) bool {
+	from, leaving := n.steps.leaving[pid]
+	dropped, drop := n.steps.dropped[pid]
+	return (leaving && round >= from) || (drop && round >= dropped)
+}
+
+// referencePlayer is the player whose game everyone else's has to agree with: the one
+// with the lowest pid that is still in it.
+func (n *Node) referencePlayer() string {
+	pids := n.playerPids()
+	sort.Slice(pids, func(i, j int) bool { return pidLess(pids[i], pids[j]) })
+	for _, pid := range pids {
+		if n.stillPlaying(pid) {
+			return pid
+		}
+	}
+	return ""
+}
+
+func (n *Node) stillPlaying(pid string) bool {
+	return n.isMember(pid) && !n.DroppedForever[pid] && !n.goneBy(pid, n.Round)
+}
+
+// sendState answers a player whose game went wrong with ours.
+func (n *Node) sendState(pid string, raddr *net.UDPAddr) {
+	report := n.stateReport()
+	// there is no leader to tell, and nobody else needs it
+	report.Token = ""
+	n.logClient("Sending player " + pid + " our state of round " + strconv.Itoa(report.Snapshot.Round))
+	n.sendMessage(n.goConnection, report, raddr)
+}
+
+// catchUp carries on from the state of the player we asked, if it's no older than ours.
+// If it dropped us, we are out.
+func (n *Node) catchUp(message *StateReportMessage, sender string) {
+	report := message.StateReport
+	if sender != n.steps.asked || report.Round < n.MovesRound {
+		n.logClient("Ignoring the state of round " + strconv.Itoa(report.Round) + " from player " + sender)
+		return
+	}
+	if report.Width != n.GridWidth || report.Height != n.GridHeight {
+		n.logClient("Ignoring the state of player " + sender + ", it is for another grid")
+		return
+	}
+	grid, err := decodeGrid(report.Grid, report.Width, report.Height)
+	if err != nil {
+		n.logClient("Ignoring the state of player " + sender + ": " + err.Error())
+		return
+	}
+	n.Grid = grid
+	alive := make(map[string]bool)
+	for _, pid := range report.Alive {
+		alive[pid] = true
+	}
+	for pid := range n.Alive {
+		n.Alive[pid] = alive[pid]
+	}
+	n.Finish = append([]string(nil), report.Finish...)
+	dropped := make(map[string]bool)
+	for _, pid := range report.Dropped {
+		dropped[pid] = true
+		n.DroppedForever[pid] = true
+	}
+	for pid := range n.DroppedForever {
+		if !dropped[pid] {
+			// we dropped it on our own, it is still playing
+			delete(n.DroppedForever, pid)
+			n.markMember(pid, MemberAlive)
+		}
+	}
+	for pid, reason := range report.Left {
+		n.Left[pid] = reason
+	}
+	n.markDeparted()
+	for i := range n.Positions {
+		n.Positions[i] = make(map[string]Move)
+	}
+	positions := n.Positions[len(n.Positions)-1]
+	for pid, move := range report.Positions {
+		positions[pid] = move
+	}
+	n.MovesRound = report.Round
+	n.steps.checksum = n.stateChecksum()
+	n.divergedRound = 0
+	n.steps.asked = ""
+	n.steps.out = n.DroppedForever[strconv.Itoa(n.MyPid)]
+	// a drop it didn't go along with is off
+	for pid, from := range n.steps.dropped {
+		if from <= n.MovesRound && !n.DroppedForever[pid] {
+			delete(n.steps.dropped, pid)
+		}
+	}
+	for round := range n.steps.inputs {
+		if round <= n.MovesRound {
+			delete(n.steps.inputs, round)
+		}
+	}
+	n.logClient("Caught up with player " + sender + "'s game of round " + strconv.Itoa(n.MovesRound))
+}
+
+// lingerLockstep answers anyone still waiting on our moves of the last round for a
+// follower response time, before we go. Everyone gets an answer at most once a game tick,
+// so two players lingering at once don't keep answering each other.
+func (n *Node) lingerLockstep() {
+	deadline := n.clock.Now().Add(n.config.FollowerResponseTime)
+	answered := make(map[string]time.Time)
+	for {
+		buf, raddr, timedout := n.readFromUDPWithTimeout(n.goConnection, deadline)
+		if timedout {
+			return
+		}
+		message, err := n.openFromPeer(buf, raddr)
+		if err != nil {
+			continue
+		}
+		switch message := message.(type) {
+		case *InputsMessage:
+			last, known := answered[raddr.String()]
+			if message.Envelope.Round <= n.steps.through && (!known || !n.clock.Now().Before(last.Add(n.config.MinGameSpeed))) {
+				answered[raddr.String()] = n.clock.Now()
+				n.sendMessage(n.goConnection, n.inputsMessage(), raddr)
+			}
+		case *ResyncMessage:
+			n.sendState(n.AddrToPid[raddr.String()], raddr)
+		}
+	}
+}
+
+// resolveRound moves everyone, the same way on every player.
+func (n *Node) resolveRound() {
+	round := n.Round
+	for _, pid := range n.playerPids() {
+		if n.goneBy(pid, round) && !n.DroppedForever[pid] {
+			n.dropPlayer(pid)
+			n.killPlayer(pid)
+			if _, left := n.steps.leaving[pid]; left {
+				n.markMember(pid, MemberLeft)
+			}
+		}
+	}
+	previous := n.getCurrentMoveMap()
+	next := make(map[string]Move)
+	cells := make(map[[2]int]int)
+	pids := n.playerPids()
+	sort.Slice(pids, func(i, j int) bool { return pidLess(pids[i], pids[j]) })
+	for _, pid := range pids {
+		move, known := previous[pid]
+		if !known {
+			continue
+		}
+		if !n.Alive[pid] {
+			next[pid] = move
+			continue
+		}
+		direction, moved := n.steps.inputs[round][pid]
+		if !moved {
+			// only the moves of players that are gone can be missing, and those died above
+			direction = move.Direction
+		}
+		next[pid] = n.createContinuedMove(direction, move)
+		cells[[2]int{next[pid].X, next[pid].Y}]++
+	}
+	for _, pid := range pids {
+		move, known := next[pid]
+		if !known || !n.Alive[pid] {
+			continue
+		}
+		if n.isCollision(move.X, move.Y) || cells[[2]int{move.X, move.Y}] > 1 {
+			n.logClient("Player " + pid + " crashed in round " + strconv.Itoa(round))
+			n.killPlayer(pid)
+			next[pid] = previous[pid]
+		}
+	}
+	n.applyMoves(Moves{Moves: []map[string]Move{next}, Round: round})
+	n.steps.checksum = n.stateChecksum()
+	// the last few rounds stay, for whoever missed a move of them
+	delete(n.steps.inputs, round-len(n.Positions))
+}
+
+// sendToPeers sends a message to every other player still in the game.
+func (n *Node) sendToPeers(message Message) {
+	for _, address := range n.addresses() {
+		if address != n.goConnection.LocalAddr().String() && n.isMember(n.AddrToPid[address]) {
+			n.sendMessage(n.goConnection, message, n.AddrToAddr[address])
+		}
+	}
+}
+
+// leaveLockstep tells everyone we are gone from the round after the last one we moved in.
+func (n *Node) leaveLockstep(reason string) {
+	message := n.leaveMessage(reason)
+	message.Envelope.Round = n.steps.through + 1
+	n.sendToPeers(message)
+}
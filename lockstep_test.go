@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oneWayCut loses everything from one host to another once it is on, but nothing the
+// other way.
+type oneWayCut struct {
+	from, to string
+	on       bool
+}
+
+func (c *oneWayCut) Apply(p *Packet, rng *rand.Rand) {
+	if c.on && hostOf(p.From) == c.from && hostOf(p.To) == c.to {
+		p.Deliveries = nil
+	}
+}
+
+func newLockstepSimulation(seed int64) *Simulation {
+	config := DefaultConfig()
+	config.Width, config.Height = 60, 60
+	config.Lockstep = true
+	return NewSimulation(seed, 4, config, Latency{Base: 5 * time.Millisecond, Jitter: 5 * time.Millisecond},
+		Loss{Rate: 0.05}, Reordering{Rate: 0.1, Delay: 20 * time.Millisecond})
+}
+
+// once the game is a few rounds in
+func (s *Simulation) whenPlaying(f func()) {
+	s.Clock.AfterFunc(0, func() {
+		for s.Nodes[0].Round < 5 {
+			s.Clock.Sleep(10 * time.Millisecond)
+		}
+		f()
+	})
+}
+
+// agreedFinish checks every player but the ones that may be dropped finished the game
+// most of them did, and says who was dropped: the first to die in it, if that is one of
+// them.
+func agreedFinish(t *testing.T, seed int64, results []SimulationResult, mayDrop ...string) string {
+	finishes := make(map[string]int)
+	agreed := results[0]
+	for _, result := range results {
+		finish := strings.Join(result.Finish, " ")
+		if finishes[finish]++; finishes[finish] > finishes[strings.Join(agreed.Finish, " ")] {
+			agreed = result
+		}
+	}
+	dropped := ""
+	if len(agreed.Finish) > 0 && strings.Contains(" "+strings.Join(mayDrop, " ")+" ", " "+agreed.Finish[0]+" ") {
+		dropped = agreed.Finish[0]
+	}
+	for _, result := range results {
+		if strconv.Itoa(result.Pid) == dropped {
+			continue
+		}
+		if !result.Finished || strings.Join(result.Finish, " ") != strings.Join(agreed.Finish, " ") {
+			t.Errorf("seed %d: %v finished differently from %v", seed, result, agreed)
+		}
+	}
+	return dropped
+}
+
+// everyone works out the same game from the same moves, lost and out of order as they are
+func TestLockstepConverges(t *testing.T) {
+	for seed := int64(1); seed <= 4; seed++ {
+		agreedFinish(t, seed, newLockstepSimulation(seed).Run(2*time.Minute))
+	}
+}
+
+// a player that crashes is dropped by everyone else from the same round
+func TestLockstepDropsCrashedPlayer(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		sim := newLockstepSimulation(seed)
+		sim.whenPlaying(func() { sim.Network.Isolate(sim.Host(4)) })
+		if dropped := agreedFinish(t, seed, sim.Run(2*time.Minute), "4"); dropped != "4" {
+			t.Errorf("seed %d: the others never dropped player 4", seed)
+		}
+	}
+}
+
+// a player that stops hearing another can't drop it on its own say: one of the two goes,
+// whichever the rest time out, and the rest agree on it
+func TestLockstepOneWayPartition(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		sim := newLockstepSimulation(seed)
+		cut := &oneWayCut{from: sim.Host(4), to: sim.Host(1)}
+		sim.Network.faults = append(sim.Network.faults, cut)
+		sim.whenPlaying(func() { cut.on = true })
+		results := sim.Run(2 * time.Minute)
+		deaf, unheard := strconv.Itoa(results[0].Pid), strconv.Itoa(results[3].Pid)
+		if dropped := agreedFinish(t, seed, results, deaf, unheard); dropped == "" {
+			t.Errorf("seed %d: neither player %s nor player %s was dropped", seed, deaf, unheard)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/*
+* MEMBERSHIP
+*
+* Every peer keeps a table of who is in the game: each player's pid, address, status and
+* incarnation. Nobody sends the table on its own; every message carries a few of its
+* entries, the ones sent least often first, so whatever changed spreads with the next few
+* messages and the rest keeps going round until every table is the same.
+*
+* An entry with a higher incarnation replaces ours. At the same incarnation the worse
+* status wins (left over dropped over suspect over alive), so only the player itself can
+* clear a suspicion, by coming back with the next incarnation, and only the leader can
+* bring back a dropped player, when it rejoins. A player that hears it was dropped while
+* it is still here asks to rejoin.
+*
+* Only the leader's gossip can change what we know of anyone else. What a player says
+* about itself can only raise its incarnation, clearing a suspicion, and nothing it says
+* about anyone else counts, so nobody can make another player leave or move.
+*
+* Broadcasts, elections and the succession go to the players that are neither dropped
+* nor gone, and the frontend gets the roster whenever it changes.
+ */
+
+const (
+	MemberAlive   = "alive"
+	MemberSuspect = "suspect"
+	MemberDropped = "dropped"
+	MemberLeft    = "left"
+	// only watching, see spectate.go
+	MemberSpectator = "spectator"
+)
+
+// in order of precedence, the index is also the binary code
+var memberStatuses = []string{MemberAlive, MemberSuspect, MemberDropped, MemberLeft, MemberSpectator}
+
+// how many entries of the table every message carries
+const gossipPerMessage = 3
+
+type Member struct {
+	Pid         string `json:"pid"`
+	Nickname    string `json:"nickname,omitempty"`
+	Address     string `json:"address"`
+	Status      string `json:"status"`
+	Incarnation int    `json:"incarnation"`
+}
+
+type MembersMessage struct {
+	Envelope
+	Members []Member `json:"members"`
+}
+
+type memberEntry struct {
+	Member
+	sends int // how many messages carried it since it last changed
+}
+
+type membership struct {
+	mu      sync.Mutex
+	members map[string]*memberEntry
+	changed bool // since the frontend last got the roster
+}
+
+func newMembership() *membership {
+	return &membership{members: make(map[string]*memberEntry)}
+}
+
+func statusRank(status string) int {
+	if status == MemberSpectator {
+		// nobody suspects a spectator, but it can still be dropped or leave
+		return 0
+	}
+	for i, s := range memberStatuses {
+		if s == status {
+			return i
+		}
+	}
+	return -1
+}
+
+func supersedes(a, b Member) bool {
+	if a.Incarnation != b.Incarnation {
+		return a.Incarnation > b.Incarnation
+	}
+	return statusRank(a.Status) > statusRank(b.Status)
+}
+
+// update takes what we heard about a member if it is newer than what we have, and says
+// whether it was.
+func (m *membership) update(member Member) bool {
+	if statusRank(member.Status) < 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, known := m.members[member.Pid]
+	if known && !supersedes(member, entry.Member) {
+		return false
+	}
+	if !known {
+		entry = &memberEntry{}
+		m.members[member.Pid] = entry
+	} else if member.Nickname == "" {
+		member.Nickname = entry.Nickname
+	}
+	entry.Member = member
+	entry.sends = 0
+	m.changed = true
+	return true
+}
+
+func (m *membership) get(pid string) (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.members[pid]
+	if !ok {
+		return Member{}, false
+	}
+	return entry.Member, true
+}
+
+// piggyback picks the entries the next message carries.
+func (m *membership) piggyback() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]*memberEntry, 0, len(m.members))
+	for _, entry := range m.members {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].sends != entries[j].sends {
+			return entries[i].sends < entries[j].sends
+		}
+		return pidLess(entries[i].Pid, entries[j].Pid)
+	})
+	var gossip []Member
+	for i := 0; i < len(entries) && i < gossipPerMessage; i++ {
+		entries[i].sends++
+		gossip = append(gossip, entries[i].Member)
+	}
+	return gossip
+}
+
+func (m *membership) list() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := make([]Member, 0, len(m.members))
+	for _, entry := range m.members {
+		members = append(members, entry.Member)
+	}
+	sort.Slice(members, func(i, j int) bool { return pidLess(members[i].Pid, members[j].Pid) })
+	return members
+}
+
+// takeChanged says whether the table changed since it was last asked.
+func (m *membership) takeChanged() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := m.changed
+	m.changed = false
+	return changed
+}
+
+func pidLess(a, b string) bool {
+	x, _ := strconv.Atoi(a)
+	y, _ := strconv.Atoi(b)
+	return x < y
+}
+
+func (n *Node) membersMessage() *MembersMessage {
+	return &MembersMessage{
+		Envelope: Envelope{
+			MessageType: "members",
+			EventName:   "members",
+			Round:       n.Round,
+		},
+		Members: n.members.list(),
+	}
+}
+
+// initMembers puts everyone we know of at the start of the game in the table.
+func (n *Node) initMembers() {
+	for address, pid := range n.AddrToPid {
+		if nickname, watching := n.Spectators[pid]; watching {
+			n.members.update(Member{Pid: pid, Nickname: nickname, Address: address, Status: MemberSpectator})
+			continue
+		}
+		n.members.update(Member{Pid: pid, Nickname: n.PidToNickname[pid], Address: address, Status: MemberAlive})
+	}
+}
+
+// markMember gives a member a worse status, and says whether it didn't have it already.
+func (n *Node) markMember(pid, status string) bool {
+	member, ok := n.members.get(pid)
+	if !ok {
+		return false
+	}
+	member.Status = status
+	return n.members.update(member)
+}
+
+// rejoinMember brings a member back at a new address, as its next incarnation.
+func (n *Node) rejoinMember(pid, address string) {
+	member, _ := n.members.get(pid)
+	rejoined := Member{
+		Pid:         pid,
+		Nickname:    n.PidToNickname[pid],
+		Address:     address,
+		Status:      MemberAlive,
+		Incarnation: member.Incarnation + 1,
+	}
+	if nickname, watching := n.Spectators[pid]; watching {
+		rejoined.Nickname, rejoined.Status = nickname, MemberSpectator
+	}
+	n.members.update(rejoined)
+}
+
+// markDeparted puts everyone the game says was dropped or left in the table as such.
+func (n *Node) markDeparted() {
+	for pid, dropped := range n.DroppedForever {
+		if dropped {
+			n.markMember(pid, MemberDropped)
+		}
+	}
+	for pid := range n.Left {
+		n.markMember(pid, MemberLeft)
+	}
+}
+
+// isMember says whether pid is still in the game as far as we know: it wasn't dropped
+// and didn't leave.
+func (n *Node) isMember(pid string) bool {
+	member, ok := n.members.get(pid)
+	return !ok || (member.Status != MemberDropped && member.Status != MemberLeft)
+}
+
+func (n *Node) attachGossip(message Message) {
+	message.header().Gossip = n.members.piggyback()
+}
+
+// mergeGossip takes the entries a message from sender carried into our table, all of
+// them if it came from the leader we follow.
+func (n *Node) mergeGossip(gossip []Member, sender string, fromLeader bool) {
+	me := strconv.Itoa(n.MyPid)
+	for _, member := range gossip {
+		if !fromLeader {
+			if member.Pid == sender {
+				n.gossipAboutItself(member)
+			}
+			continue
+		}
+		if member.Pid == me {
+			n.gossipAboutUs(member)
+			continue
+		}
+		if !n.members.update(member) || n.isLeader {
+			// the leader's own table is what everyone else's comes round to
+			continue
+		}
+		n.logClient(fmt.Sprintf("Player %s is %s (incarnation %d) at %s", member.Pid, member.Status, member.Incarnation, member.Address))
+		if member.Status == MemberDropped || member.Status == MemberLeft {
+			n.DroppedForever[member.Pid] = true
+		} else {
+			delete(n.DroppedForever, member.Pid)
+		}
+		if member.Status == MemberSpectator {
+			// someone started watching after the game started
+			n.Spectators[member.Pid] = member.Nickname
+		}
+		if member.Address != "" && n.AddrToPid[member.Address] != member.Pid {
+			n.moveMember(member.Pid, member.Address)
+		}
+	}
+}
+
+// gossipAboutItself takes a player's next incarnation from the player itself, which
+// clears a suspicion but nothing else.
+func (n *Node) gossipAboutItself(member Member) {
+	ours, known := n.members.get(member.Pid)
+	if !known || member.Incarnation <= ours.Incarnation {
+		return
+	}
+	ours.Incarnation = member.Incarnation
+	if ours.Status == MemberSuspect {
+		ours.Status = MemberAlive
+	}
+	n.members.update(ours)
+}
+
+// moveMember changes the address we know a player by, after it rejoined from another.
+func (n *Node) moveMember(pid, address string) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		n.logClient("Ignoring bad address " + address + " for player " + pid)
+		return
+	}
+	for old, oldPid := range n.AddrToPid {
+		if oldPid == pid {
+			delete(n.AddrToPid, old)
+			delete(n.AddrToAddr, old)
+		}
+	}
+	n.AddrToPid[address] = pid
+	n.AddrToAddr[address] = raddr
+}
+
+// gossipAboutUs refutes a suspicion with our next incarnation, and asks to rejoin if the
+// leader dropped us while we are still here.
+func (n *Node) gossipAboutUs(member Member) {
+	ours, _ := n.members.get(member.Pid)
+	if member.Incarnation < ours.Incarnation || n.isLeader {
+		return
+	}
+	switch member.Status {
+	case MemberSuspect:
+		ours.Status = MemberAlive
+		ours.Incarnation = member.Incarnation + 1
+		n.members.update(ours)
+		n.logClient("Someone suspects we are gone, we aren't (incarnation " + strconv.Itoa(ours.Incarnation) + ")")
+	case MemberDropped:
+		n.members.update(member)
+		if member.Incarnation >= n.rejoinIncarnation && n.SessionToken != "" && n.leaderUDPAddr != nil {
+			n.rejoinIncarnation = member.Incarnation + 1
+			n.logClient("The leader dropped us, asking to rejoin")
+			n.rejoinTries = 0
+			n.askToRejoin()
+		}
+	default:
+		n.members.update(member)
+	}
+}
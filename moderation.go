@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+/*
+* MODERATION
+*
+* The leader's own player can kick a player out, by pid or nickname, or ban it. The java
+* frontend sends the leader's client a kick like its ready and start:
+*
+*   {"eventName":"kick","player":"<pid or nickname>","reason":"...","ban":true}
+*
+* and a node started with -admin also takes "kick <player> [reason]" and "ban <player>
+* [reason]" lines on its stdin. Either way the client passes it on to the leader, which
+* only takes it from its own player.
+*
+* In the lobby the player is turned away and taken off the roster. Once the game is under
+* way it is dropped like a player that left, with the reason, and the leader forgets its
+* address and token so it can't rejoin. A banned player can't join again from the same ip
+* under the same nickname for as long as the lobby is open.
+ */
+
+const (
+	RejectKicked = "kicked"
+	RejectBanned = "banned"
+)
+
+type Kick struct {
+	Player string `json:"player"` // pid or nickname
+	Reason string `json:"reason,omitempty"`
+	Ban    bool   `json:"ban,omitempty"`
+}
+
+type KickMessage struct {
+	Envelope
+	Kick `json:"kick"`
+}
+
+func (m *KickMessage) validate() error {
+	if m.Player == "" {
+		return errors.New("missing player")
+	}
+	return nil
+}
+
+// a banned player, no join from its ip under its nickname gets in
+type Ban struct {
+	IP       string
+	Nickname string
+}
+
+func kickMessage(kick Kick) *KickMessage {
+	return &KickMessage{Envelope: lobbyEnvelope("kick"), Kick: kick}
+}
+
+// decodeKickCommand reads a kick from the frontend, which sends it flat like its moves.
+func decodeKickCommand(buf []byte) (*KickMessage, bool) {
+	var command struct {
+		EventName string `json:"eventName"`
+		Kick
+	}
+	if err := json.Unmarshal(buf, &command); err != nil || command.EventName != "kick" {
+		return nil, false
+	}
+	return kickMessage(command.Kick), true
+}
+
+/*
+* PLAYER SIDE
+ */
+
+// moderate passes a kick on to the leader, however we talk to it at the moment.
+func (n *Node) moderate(message *KickMessage) {
+	switch {
+	case !n.lobby.over.Load() && !n.lobby.joined.Load():
+		n.logClient("Can't kick anyone before the leader let us in")
+	case !n.lobby.over.Load():
+		n.sendToLobby(message)
+	case n.Lockstep:
+		n.logClient("Nobody leads a lockstep game, so nobody can kick anyone out of it")
+	default:
+		n.sendToLeader(message)
+	}
+}
+
+// adminConsole reads kick and ban commands off in, one a line.
+func (n *Node) adminConsole(in io.Reader) {
+	lines := bufio.NewScanner(in)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if (fields[0] != "kick" && fields[0] != "ban") || len(fields) < 2 {
+			fmt.Println("Expected kick <pid or nickname> [reason] or ban <pid or nickname> [reason]")
+			continue
+		}
+		n.moderate(kickMessage(Kick{
+			Player: fields[1],
+			Reason: strings.Join(fields[2:], " "),
+			Ban:    fields[0] == "ban",
+		}))
+	}
+}
+
+/*
+* LEADER SIDE
+ */
+
+// kickTarget works out who a kick is for and why, and records a ban. It says whether
+// there is anyone to kick.
+func (n *Node) kickTarget(kick Kick, sender string) (string, string, bool) {
+	if sender != n.leaderState.Pid {
+		n.logLeader("Ignoring a kick from player " + sender + ", only the leader's player kicks")
+		return "", "", false
+	}
+	pid, found := n.findPlayer(kick.Player)
+	switch {
+	case !found:
+		n.logLeader("Can't kick " + kick.Player + ", there is no such player")
+		return "", "", false
+	case pid == sender:
+		n.logLeader("Not kicking our own player")
+		return "", "", false
+	case n.DroppedForever[pid]:
+		n.logLeader("Player " + pid + " is gone already")
+		return "", "", false
+	}
+	nickname := n.PidToNickname[pid]
+	if n.isSpectator(pid) {
+		nickname = n.Spectators[pid]
+	}
+	reason := RejectKicked
+	if kick.Ban {
+		reason = RejectBanned
+		n.leaderState.Banned = append(n.leaderState.Banned, Ban{IP: n.addrOf(pid).IP.String(), Nickname: nickname})
+	}
+	if kick.Reason != "" {
+		reason += ": " + kick.Reason
+	}
+	n.logLeader("Removing player " + pid + " (" + nickname + "), " + reason)
+	return pid, reason, true
+}
+
+// kickFromLobby turns a player that joined away after all.
+func (n *Node) kickFromLobby(kick Kick, sender string) {
+	pid, reason, ok := n.kickTarget(kick, sender)
+	if !ok {
+		return
+	}
+	addr := n.addrOf(pid)
+	n.unregisterPlayer(pid)
+	n.reject(addr, Reject{Reason: reason})
+	n.broadcastRoster()
+}
+
+// kickFromGame drops a player for good, like one that left.
+func (n *Node) kickFromGame(kick Kick, sender string) {
+	pid, reason, ok := n.kickTarget(kick, sender)
+	if !ok {
+		return
+	}
+	// so it finds out it has to go, before the leader stops talking to it
+	n.sendMessage(n.leaderState.leaderConnection, n.playerLeftMessage(pid, reason), n.addrOf(pid))
+	n.playerLeft(pid, reason)
+	// and can't come back, from where it is or with its token
+	for address, playerPid := range n.AddrToPid {
+		if playerPid == pid {
+			delete(n.AddrToPid, address)
+			delete(n.AddrToAddr, address)
+		}
+	}
+	delete(n.leaderState.Tokens, pid)
+}
+
+// findPlayer looks a player up by pid, or by nickname.
+func (n *Node) findPlayer(player string) (string, bool) {
+	if _, known := n.PidToNickname[player]; known {
+		return player, true
+	}
+	if _, known := n.Spectators[player]; known {
+		return player, true
+	}
+	for _, nicknames := range []map[string]string{n.PidToNickname, n.Spectators} {
+		for pid, nickname := range nicknames {
+			if strings.EqualFold(nickname, player) {
+				return pid, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (n *Node) addrOf(pid string) *net.UDPAddr {
+	for address, playerPid := range n.AddrToPid {
+		if playerPid == pid {
+			return n.AddrToAddr[address]
+		}
+	}
+	return nil
+}
+
+// banned says whether a join comes from the ip of a banned player under its nickname. Others
+// behind the same ip, and players that happen to pick the same nickname, still get in.
+func (n *Node) banned(join Join, raddr *net.UDPAddr) bool {
+	for _, ban := range n.leaderState.Banned {
+		if ban.IP == raddr.IP.String() && strings.EqualFold(ban.Nickname, join.Nickname) {
+			return true
+		}
+	}
+	return false
+}
+
+// unregisterPlayer takes a player back out of the lobby, as if it never joined.
+func (n *Node) unregisterPlayer(pid string) {
+	if move, known := n.getLeaderMoveMap()[pid]; known {
+		n.Grid[move.X][move.Y] = 0
+	}
+	delete(n.getLeaderMoveMap(), pid)
+	delete(n.Alive, pid)
+	for address, playerPid := range n.AddrToPid {
+		if playerPid == pid {
+			delete(n.AddrToPid, address)
+			delete(n.AddrToAddr, address)
+		}
+	}
+	delete(n.PidToNickname, pid)
+	delete(n.Spectators, pid)
+	delete(n.leaderState.Acks, pid)
+	delete(n.leaderState.Tokens, pid)
+	delete(n.leaderState.PublicKeys, pid)
+	delete(n.leaderState.Encodings, pid)
+	delete(n.leaderState.Ready, pid)
+}
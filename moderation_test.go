@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (l *testLobby) kick(from string, kick Kick) {
+	addr, _ := net.ResolveUDPAddr("udp", from)
+	l.leader.lobbyPacket(encodeMessage(kickMessage(kick)), addr)
+}
+
+// only the host kicks, and a ban keeps out the same nickname from the same ip, nobody else
+func TestLobbyBan(t *testing.T) {
+	lobby := newTestLobby(DefaultConfig())
+	onClock(lobby.clock, func() {
+		lobby.join("10.0.0.1:7001", "alice", "", false)
+		lobby.leader.leaderState.Pid = "1"
+		lobby.join("10.0.0.2:7000", "bob", "", false)
+		lobby.join("10.0.0.3:7000", "carol", "", false)
+		lobby.kick("10.0.0.3:7000", Kick{Player: "alice", Ban: true})
+		lobby.kick("10.0.0.1:7001", Kick{Player: "bob", Reason: "spam", Ban: true})
+		lobby.kick("10.0.0.1:7001", Kick{Player: "3"})
+		if _, found := lobby.leader.findPlayer("alice"); !found {
+			t.Errorf("carol kicked the host")
+		}
+		for _, nickname := range []string{"bob", "carol"} {
+			if pid, found := lobby.leader.findPlayer(nickname); found {
+				t.Errorf("%s is still in the lobby as player %s", nickname, pid)
+			}
+		}
+		tests := []struct {
+			name     string
+			addr     string
+			nickname string
+			want     string
+		}{
+			{"banned", "10.0.0.2:7001", "bob", RejectBanned},
+			{"banned in capitals", "10.0.0.2:7002", "BOB", RejectBanned},
+			{"someone else behind the same ip", "10.0.0.2:7003", "dave", "pid 4"},
+			{"banned from another ip", "10.0.0.4:7000", "bob", "pid 5"},
+			{"kicked but not banned", "10.0.0.3:7001", "carol", "pid 6"},
+		}
+		for _, test := range tests {
+			if got := lobby.join(test.addr, test.nickname, "", false); got != test.want {
+				t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+			}
+		}
+	})
+}
+
+// a player kicked during the game is dropped by everyone, and can't come back with its
+// token, from its own address or any other
+func TestKickFromGame(t *testing.T) {
+	config := DefaultConfig()
+	config.Width, config.Height = 60, 60
+	sim := NewSimulation(5, 3, config, Latency{Base: 5 * time.Millisecond, Jitter: 5 * time.Millisecond})
+	sim.Clock.AfterFunc(0, func() {
+		leader, kicked := sim.Nodes[0], sim.Nodes[2]
+		for leader.Round < 3 {
+			sim.Clock.Sleep(10 * time.Millisecond)
+		}
+		oldAddr := leader.addrOf("3")
+		sim.Nodes[0].moderate(kickMessage(Kick{Player: "sim3", Reason: "rude"}))
+		sim.Clock.Sleep(100 * time.Millisecond)
+
+		if reason := leader.Left["3"]; reason != "kicked: rude" {
+			t.Errorf("player 3 left the game with %q, want it kicked", reason)
+		}
+		if _, known := leader.leaderState.Tokens["3"]; known || leader.addrOf("3") != nil {
+			t.Errorf("the leader still knows player 3's token or address")
+		}
+		newAddr, _ := net.ResolveUDPAddr("udp", sim.Host(4)+":7000")
+		for _, keyID := range []int{3, 0} {
+			for _, addr := range []*net.UDPAddr{oldAddr, newAddr} {
+				rejoin := kicked.sign(encodeMessage(&RejoinMessage{Envelope: Envelope{MessageType: "rejoin"}, Pid: "3"}), keyID)
+				if _, _, err := leader.openFromPlayer(rejoin, addr); err == nil {
+					t.Errorf("took a rejoin signed with key %d from %s", keyID, addr)
+				}
+			}
+		}
+		// even with its token back, say from a player that handed it over with its state
+		leader.rejoinPlayer("3", newAddr)
+		if leader.addrOf("3") != nil || !leader.DroppedForever["3"] {
+			t.Errorf("the leader took player 3 back")
+		}
+	})
+	results := sim.Run(2 * time.Minute)
+	if !results[0].Finished || !results[1].Finished || strings.Join(results[0].Finish, " ") != strings.Join(results[1].Finish, " ") {
+		t.Errorf("the players left didn't finish the same game: %v", results)
+	}
+}
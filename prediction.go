@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+* PREDICTION
+*
+* A player doesn't wait a whole round trip to see where its move took it. As soon as the
+* frontend has moved, the client predicts every round the moves of haven't arrived yet:
+* our cycle goes where we steered it, everyone else keeps going the way they were, and a
+* cycle that runs into a trail or into someone else's prediction stops. The frontend gets
+* the prediction right away, next to the confirmed game.
+*
+* When the moves of a round arrive they are the game, whatever we predicted. We roll
+* back to them and predict the rounds that are still unconfirmed again from there.
+ */
+
+type Prediction struct {
+	Confirmed int               `json:"confirmed"` // the newest round we have the moves of
+	Moves     []map[string]Move `json:"moves"`     // what we predict for every round after it, oldest first
+}
+
+type PredictionMessage struct {
+	Envelope
+	Prediction `json:"prediction"`
+}
+
+type predictionState struct {
+	inputs    map[int]string          // our directions for the rounds that aren't confirmed yet, "" to keep going
+	predicted map[int]map[string]Move // what we last predicted for them
+	hits      int                     // rounds we predicted right
+	misses    int
+}
+
+// predictRound notes our move for a round and tells the frontend what we expect to happen.
+func (n *Node) predictRound(round int, direction string) {
+	if n.prediction.inputs == nil {
+		n.prediction.inputs = make(map[int]string)
+		n.prediction.predicted = make(map[int]map[string]Move)
+	}
+	n.prediction.inputs[round] = direction
+	n.recvChan.Put(n.predictionMessage())
+}
+
+// rollback drops the predictions the moves we got have overtaken, and predicts the
+// rounds that are left again from the moves.
+func (n *Node) rollback() {
+	if n.prediction.inputs == nil {
+		return
+	}
+	if predicted, ok := n.prediction.predicted[n.MovesRound]; ok {
+		n.scorePrediction(predicted, n.getCurrentMoveMap())
+	}
+	pending := false
+	for round := range n.prediction.inputs {
+		if round <= n.MovesRound {
+			delete(n.prediction.inputs, round)
+			delete(n.prediction.predicted, round)
+		} else {
+			pending = true
+		}
+	}
+	if pending {
+		n.recvChan.Put(n.predictionMessage())
+	}
+}
+
+func (n *Node) scorePrediction(predicted, confirmed map[string]Move) {
+	for pid, move := range confirmed {
+		if guess, ok := predicted[pid]; ok && guess != move {
+			n.prediction.misses++
+			n.logClient(fmt.Sprintf("Mispredicted player %s in round %d: %d,%d %s instead of %d,%d %s (%d of %d rounds right)",
+				pid, n.MovesRound, guess.X, guess.Y, guess.Direction, move.X, move.Y, move.Direction,
+				n.prediction.hits, n.prediction.hits+n.prediction.misses))
+			return
+		}
+	}
+	n.prediction.hits++
+}
+
+func (n *Node) predictionMessage() *PredictionMessage {
+	moves := n.predict()
+	for i, positions := range moves {
+		n.prediction.predicted[n.MovesRound+1+i] = positions
+	}
+	return &PredictionMessage{
+		Envelope: Envelope{
+			MessageType: "prediction",
+			EventName:   "prediction",
+			Round:       n.MovesRound + len(moves),
+		},
+		Prediction: Prediction{Confirmed: n.MovesRound, Moves: moves},
+	}
+}
+
+// predict plays the unconfirmed rounds forward from the newest moves we have.
+func (n *Node) predict() []map[string]Move {
+	last := n.MovesRound
+	for round := range n.prediction.inputs {
+		last = max(last, round)
+	}
+	me := strconv.Itoa(n.MyPid)
+	positions := n.getCurrentMoveMap()
+	alive := make(map[string]bool)
+	for pid, isAlive := range n.Alive {
+		alive[pid] = isAlive
+	}
+	claimed := make(map[[2]int]bool)
+	var moves []map[string]Move
+	for round := n.MovesRound + 1; round <= last; round++ {
+		next := make(map[string]Move)
+		for _, pid := range n.playerPids() {
+			move, known := positions[pid]
+			if !known {
+				continue
+			}
+			direction := move.Direction
+			if steered := n.prediction.inputs[round]; pid == me && steered != "" {
+				direction = steered
+			}
+			if !alive[pid] || !isDirection(direction) {
+				next[pid] = move
+				continue
+			}
+			step := n.createContinuedMove(direction, move)
+			cell := [2]int{step.X, step.Y}
+			if n.isCollision(step.X, step.Y) || claimed[cell] {
+				alive[pid] = false
+				next[pid] = move
+				continue
+			}
+			claimed[cell] = true
+			next[pid] = step
+		}
+		moves = append(moves, next)
+		positions = next
+	}
+	return moves
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* REJOINING
+*
+* Every player gets a session token with the game start. A player that lost its
+* connection (or restarted with -rejoin pid:token) signs a rejoin with its token (see
+* auth.go), and the leader moves the player to the address it came from and catches it
+* up with a game start and a snapshot. If its cycle died in the meantime it can still watch.
+ */
+
+type RejoinMessage struct {
+	Envelope
+	Pid string `json:"pid"`
+}
+
+func (m *RejoinMessage) validate() error {
+	if m.Pid == "" {
+		return errors.New("missing pid")
+	}
+	return nil
+}
+
+func newSessionToken() string {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	checkError(err)
+	return hex.EncodeToString(token)
+}
+
+// parseSession reads the pid:token a player is given to rejoin a game with.
+func parseSession(session string) (int, string, error) {
+	fields := strings.SplitN(session, ":", 2)
+	if len(fields) != 2 || fields[1] == "" {
+		return 0, "", errors.New("expected pid:token, got " + session)
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || pid <= 0 {
+		return 0, "", errors.New("bad pid in " + session)
+	}
+	return pid, fields[1], nil
+}
+
+func (n *Node) rejoinMessage() *RejoinMessage {
+	return &RejoinMessage{
+		Envelope: Envelope{
+			MessageType: "rejoin",
+			EventName:   "rejoin",
+			Round:       n.Round,
+		},
+		Pid: strconv.Itoa(n.MyPid),
+	}
+}
+
+// sendRejoin asks the leader at addr to take us back, signed with our session token,
+// which is what proves it's us.
+func (n *Node) sendRejoin(addr *net.UDPAddr) {
+	_, err := n.writeSession(n.goConnection, n.Logger.PrepareSend("", n.sign(encodeMessage(n.rejoinMessage()), n.MyPid)), addr, n.MyPid)
+	if err != nil {
+		n.logClient("Couldn't ask " + addr.String() + " to take us back: " + err.Error())
+	}
+}
+
+// rejoinTargets are where the leader may be: the address we were given, and the leader
+// we followed last before a restart, in case the game moved to another leader since.
+func (n *Node) rejoinTargets() []*net.UDPAddr {
+	targets := []*net.UDPAddr{n.leaderUDPAddr}
+	if n.lastLeaderAddr != "" && n.lastLeaderAddr != n.leaderUDPAddr.String() {
+		if addr, err := net.ResolveUDPAddr("udp", n.lastLeaderAddr); err == nil {
+			targets = append(targets, addr)
+		}
+	}
+	return targets
+}
+
+// rejoin gets us back into a game we played before. It asks again every follower
+// response time until a leader answers, and gives up after as many tries as a player
+// may miss, returning nil.
+func (n *Node) rejoin() *GameStartMessage {
+	targets := n.rejoinTargets()
+	for try := 0; try < n.config.MaxAllowableMissedMessages; try++ {
+		for _, addr := range targets {
+			n.sendRejoin(addr)
+		}
+		deadline := n.clock.Now().Add(n.config.FollowerResponseTime)
+		for {
+			buf, raddr, timedout := n.readFromUDPWithTimeout(n.goConnection, deadline)
+			if timedout {
+				break
+			}
+			gameStart, err := n.openGameStart(buf, raddr, targets)
+			if err != nil {
+				n.logClient("Ignoring a message while waiting for the game to start: " + err.Error())
+				continue
+			}
+			if gameStart.Term < n.Term {
+				n.logClient("Ignoring a game start from the leader of term " + strconv.Itoa(gameStart.Term) + ", we are in term " + strconv.Itoa(n.Term))
+				continue
+			}
+			// whoever took us back leads the game now
+			n.leaderAddr = raddr.String()
+			n.initializeLeaderConnection()
+			return gameStart
+		}
+		n.logClient("Nobody answered our rejoin, asking again")
+	}
+	n.logClient("Nobody took us back into the game, giving up")
+	n.recvChan.Put(&RejectMessage{Envelope: lobbyEnvelope("reject"), Reject: Reject{Reason: "nobody took us back into the game"}})
+	return nil
+}
+
+// askToRejoin asks the leader to take us back after it dropped us, see gossipAboutUs.
+func (n *Node) askToRejoin() {
+	n.rejoinTries++
+	n.rejoinRetry = n.clock.Now().Add(n.config.FollowerResponseTime)
+	n.sendRejoin(n.leaderUDPAddr)
+}
+
+// retryRejoin asks again if the leader still hasn't taken us back after a follower
+// response time, up to as many times as a player may miss.
+func (n *Node) retryRejoin() {
+	if n.rejoinRetry.IsZero() || n.clock.Now().Before(n.rejoinRetry) {
+		return
+	}
+	ours, _ := n.members.get(strconv.Itoa(n.MyPid))
+	if ours.Status != MemberDropped || n.rejoinTries >= n.config.MaxAllowableMissedMessages {
+		n.rejoinRetry = time.Time{}
+		return
+	}
+	n.logClient("The leader hasn't taken us back yet, asking again")
+	n.askToRejoin()
+}
+
+// rejoinPlayer takes a player back, openFromPlayer has already checked it signed with its token.
+func (n *Node) rejoinPlayer(pid string, raddr *net.UDPAddr) {
+	if n.revoked(pid) {
+		n.logLeader("Not taking player " + pid + " back, it left the game: " + n.Left[pid])
+		return
+	}
+	for address, playerPid := range n.AddrToPid {
+		if playerPid == pid {
+			delete(n.AddrToPid, address)
+			delete(n.AddrToAddr, address)
+		}
+	}
+	address := raddr.String()
+	n.AddrToPid[address] = pid
+	n.AddrToAddr[address] = raddr
+	delete(n.DroppedForever, pid)
+	n.rejoinMember(pid, address)
+	if pid != n.leaderState.Pid && !n.isSpectator(pid) {
+		n.Succession = append(withoutPid(n.Succession, pid), pid)
+	}
+	n.resetGracePeriod(pid)
+	n.leaderState.Resync[pid] = true
+	if n.isSpectator(pid) {
+		n.logLeader("Spectator " + pid + " rejoined from " + address)
+	} else if n.Alive[pid] {
+		n.logLeader("Player " + pid + " rejoined from " + address)
+	} else {
+		n.logLeader("Player " + pid + " rejoined from " + address + " but their cycle is gone, they can watch")
+	}
+	// where everyone was at the end of the last round, the snapshot at the end of this one does the rest
+	gameStart := n.startGameMessage(pid, n.leaderState.Positions[len(n.leaderState.Positions)-2])
+	// it may not have the game key anymore, but it has its own, and only we know it too
+	pidNumber, _ := strconv.Atoi(pid)
+	buf := n.sign(encodeMessage(gameStart), pidNumber)
+	_, err := n.writeSession(n.leaderState.leaderConnection, n.Logger.PrepareSend("", buf), raddr, pidNumber)
+	n.recordWriteThroughput(len(buf))
+	if err != nil {
+		n.logLeader("Couldn't send player " + pid + " its game start: " + err.Error())
+	}
+}
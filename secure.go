@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+* ENCRYPTION
+*
+* With -encrypt (or a -password) every packet but what players send the lobby (see
+* lobby.go) is sealed with AES-GCM:
+*
+*   magic (1 byte), kind (1 byte), header, nonce (12 bytes), ciphertext
+*
+*   handshake: the header is the sender's X25519 public key. The key is an ECDH with the
+*              public key the player sent in its join, mixed with the password if there
+*              is one. This is how the leader sends the lobby and the game start.
+*   session:   the header is a pid (uint16), the key comes from that player's session
+*              token. A rejoining player and the leader talk this way until it is back
+*              in the game.
+*   game:      no header, the key is the game key every player gets in the game start.
+*
+* With a password, a join also carries an HMAC of the public key with the password, so
+* the leader can turn away players that don't know it. A host with -invite makes up an
+* invite code and uses it as the password. Anyone who sees a join can try passwords
+* against its proof offline, so the code is 20 symbols (100 bits) long, too many to guess.
+* Only the lobby takes anything in
+* the clear, and only until the game starts; a join after that is only told it's too late.
+* A player in the lobby only takes a reject in the clear, everything else the leader sends
+* it there has to be sealed with the handshake key.
+ */
+
+const sealedMagic = 0xE5
+
+const (
+	sealedHandshake = 1
+	sealedSession   = 2
+	sealedGame      = 3
+)
+
+// The keys a node encrypts with, shared by all of its sockets.
+type keyring struct {
+	mu       sync.Mutex
+	private  *ecdh.PrivateKey
+	password []byte // derived from the game password, nil without one
+	game     cipher.AEAD
+	session  func(pid int) ([]byte, bool) // the session token of a player
+}
+
+func newKeyring(password string, session func(pid int) ([]byte, bool)) *keyring {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	checkError(err)
+	k := &keyring{private: private, session: session}
+	if password != "" {
+		k.password = stretchPassword(password)
+	}
+	return k
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// deriveKey is HKDF-SHA256 (RFC 5869) cut to a single 32 byte key.
+func deriveKey(secret, salt []byte, info string) []byte {
+	return hmacSHA256(hmacSHA256(salt, secret), []byte(info), []byte{1})
+}
+
+// stretchPassword is PBKDF2-HMAC-SHA256 (RFC 8018) cut to a single 32 byte key, so
+// guessing the password from a JOIN takes a while.
+func stretchPassword(password string) []byte {
+	u := hmacSHA256([]byte(password), []byte("tron-p2p password"), []byte{0, 0, 0, 1})
+	key := append([]byte(nil), u...)
+	for i := 1; i < 4096; i++ {
+		u = hmacSHA256([]byte(password), u)
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+func newAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	checkError(err)
+	aead, err := cipher.NewGCM(block)
+	checkError(err)
+	return aead
+}
+
+func (k *keyring) publicKey() []byte {
+	return k.private.PublicKey().Bytes()
+}
+
+func (k *keyring) handshakeAEAD(peerKey []byte) (cipher.AEAD, error) {
+	public, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := k.private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(deriveKey(shared, k.password, "tron-p2p handshake")), nil
+}
+
+func (k *keyring) sessionAEAD(pid int) (cipher.AEAD, error) {
+	token, known := k.session(pid)
+	if !known {
+		return nil, errors.New("no session token for player " + strconv.Itoa(pid))
+	}
+	return newAEAD(deriveKey(token, k.password, "tron-p2p session")), nil
+}
+
+func (k *keyring) setGameKey(gameKey string) error {
+	key, err := hex.DecodeString(gameKey)
+	if err != nil || len(key) != 32 {
+		return errors.New("bad game key")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.game = newAEAD(key)
+	return nil
+}
+
+func (k *keyring) gameAEAD() cipher.AEAD {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.game
+}
+
+// joinProof shows the leader we know the password without sending it.
+func (k *keyring) joinProof(publicKey []byte) []byte {
+	return hmacSHA256(k.password, publicKey)
+}
+
+func newGameKey() string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	checkError(err)
+	return hex.EncodeToString(key)
+}
+
+// invite codes leave out letters and digits that are easy to mix up, 32 of them so every
+// symbol is 5 random bits
+const inviteAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const (
+	inviteGroups    = 5
+	inviteGroupSize = 4
+)
+
+// newInviteCode makes up a code like ABCD-EFGH-JKLM-NPQR-STUV, in groups so it can be
+// read out.
+func newInviteCode() string {
+	random := make([]byte, inviteGroups*inviteGroupSize)
+	_, err := rand.Read(random)
+	checkError(err)
+	var code []byte
+	for i, b := range random {
+		if i > 0 && i%inviteGroupSize == 0 {
+			code = append(code, '-')
+		}
+		code = append(code, inviteAlphabet[int(b)%len(inviteAlphabet)])
+	}
+	return string(code)
+}
+
+func seal(aead cipher.AEAD, kind byte, header []byte, plaintext []byte) []byte {
+	frame := append([]byte{sealedMagic, kind}, header...)
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	checkError(err)
+	frame = append(frame, nonce...)
+	return aead.Seal(frame, nonce, plaintext, frame[:2+len(header)])
+}
+
+// secureTransport seals everything written to it with the game key once there is one, and
+// opens whatever it reads. Handshakes and sessions have to be asked for explicitly.
+type secureTransport struct {
+	Transport
+	keys  *keyring
+	mu    sync.Mutex
+	lobby func(buf []byte) bool // what it takes in the clear until the lobby closes
+}
+
+func (t *secureTransport) WriteTo(buf []byte, addr *net.UDPAddr) (int, error) {
+	aead := t.keys.gameAEAD()
+	if aead == nil {
+		// the lobby, before there is anything to encrypt with
+		return t.Transport.WriteTo(buf, addr)
+	}
+	return t.write(seal(aead, sealedGame, nil, buf), len(buf), addr)
+}
+
+func (t *secureTransport) write(frame []byte, size int, addr *net.UDPAddr) (int, error) {
+	if _, err := t.Transport.WriteTo(frame, addr); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (t *secureTransport) writeHandshake(buf []byte, addr *net.UDPAddr, peerKey []byte) (int, error) {
+	aead, err := t.keys.handshakeAEAD(peerKey)
+	if err != nil {
+		return 0, err
+	}
+	return t.write(seal(aead, sealedHandshake, t.keys.publicKey(), buf), len(buf), addr)
+}
+
+func (t *secureTransport) writeSession(buf []byte, addr *net.UDPAddr, pid int) (int, error) {
+	aead, err := t.keys.sessionAEAD(pid)
+	if err != nil {
+		return 0, err
+	}
+	header := binary.BigEndian.AppendUint16(nil, uint16(pid))
+	return t.write(seal(aead, sealedSession, header, buf), len(buf), addr)
+}
+
+func (t *secureTransport) closeLobby() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lobby = nil
+}
+
+func (t *secureTransport) takesInLobby(buf []byte) bool {
+	t.mu.Lock()
+	lobby := t.lobby
+	t.mu.Unlock()
+	return lobby != nil && lobby(buf)
+}
+
+func (t *secureTransport) ReadFrom(deadline time.Time) ([]byte, *net.UDPAddr, error) {
+	for {
+		buf, raddr, err := t.Transport.ReadFrom(deadline)
+		if err != nil {
+			return buf, raddr, err
+		}
+		plaintext, err := t.open(buf)
+		if err == nil {
+			return plaintext, raddr, nil
+		}
+		if t.takesInLobby(buf) || isJoinMessage(buf) {
+			// a join after the lobby closed only gets told it's too late
+			return buf, raddr, nil
+		}
+		fmt.Println("Dropping a packet from", raddr, "we can't decrypt:", err)
+	}
+}
+
+func (t *secureTransport) open(frame []byte) ([]byte, error) {
+	if len(frame) < 2 || frame[0] != sealedMagic {
+		return nil, errors.New("not encrypted")
+	}
+	var aead cipher.AEAD
+	var err error
+	header := 0
+	switch frame[1] {
+	case sealedHandshake:
+		header = 32
+		if len(frame) < 2+header {
+			return nil, errors.New("truncated handshake")
+		}
+		aead, err = t.keys.handshakeAEAD(frame[2 : 2+header])
+	case sealedSession:
+		header = 2
+		if len(frame) < 2+header {
+			return nil, errors.New("truncated session packet")
+		}
+		aead, err = t.keys.sessionAEAD(int(binary.BigEndian.Uint16(frame[2:])))
+	case sealedGame:
+		if aead = t.keys.gameAEAD(); aead == nil {
+			err = errors.New("no game key yet")
+		}
+	default:
+		err = fmt.Errorf("unknown kind %d", frame[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	start := 2 + header
+	if len(frame) < start+aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("truncated packet")
+	}
+	nonce := frame[start : start+aead.NonceSize()]
+	return aead.Open(nil, nonce, frame[start+aead.NonceSize():], frame[:start])
+}
+
+/*
+* NODE SIDE
+ */
+
+func (n *Node) encrypting() bool {
+	return n.keys != nil
+}
+
+// secure wraps a socket of ours in encryption, if the game is encrypted. Until the lobby
+// closes it lets through whatever lobby says in the clear.
+func (n *Node) secure(t Transport, lobby func(buf []byte) bool) Transport {
+	if !n.encrypting() {
+		return t
+	}
+	return &secureTransport{Transport: t, keys: n.keys, lobby: lobby}
+}
+
+// joinKeys adds what a player's join needs in an encrypted game: its public key, and
+// proof it knows the password.
+func (n *Node) joinKeys(join *Join) {
+	if !n.encrypting() {
+		return
+	}
+	join.PublicKey = hex.EncodeToString(n.keys.publicKey())
+	if n.keys.password != nil {
+		join.Proof = hex.EncodeToString(n.keys.joinProof(n.keys.publicKey()))
+	}
+}
+
+var errWrongPassword = errors.New("wrong password")
+
+// checkJoinKeys reads the public key out of a join, making sure the player knows the
+// password if there is one.
+func (n *Node) checkJoinKeys(join Join) ([]byte, error) {
+	if !n.encrypting() {
+		return nil, nil
+	}
+	if join.PublicKey == "" {
+		return nil, errors.New("this game is encrypted, but the player sent no key")
+	}
+	publicKey, err := hex.DecodeString(join.PublicKey)
+	if err != nil {
+		return nil, errors.New("bad public key")
+	}
+	if _, err := ecdh.X25519().NewPublicKey(publicKey); err != nil {
+		return nil, err
+	}
+	if n.keys.password != nil {
+		proof, _ := hex.DecodeString(join.Proof)
+		if !hmac.Equal(proof, n.keys.joinProof(publicKey)) {
+			return nil, errWrongPassword
+		}
+	}
+	return publicKey, nil
+}
+
+// writeHandshake sends a game start to a player sealed with the key from its JOIN.
+func (n *Node) writeHandshake(conn Transport, buf []byte, addr *net.UDPAddr, pid string) (int, error) {
+	if t, ok := conn.(*secureTransport); ok {
+		return t.writeHandshake(buf, addr, n.leaderState.PublicKeys[pid])
+	}
+	return conn.WriteTo(buf, addr)
+}
+
+// writeSession sends a packet sealed with the session token of player pid.
+func (n *Node) writeSession(conn Transport, buf []byte, addr *net.UDPAddr, pid int) (int, error) {
+	if t, ok := conn.(*secureTransport); ok {
+		return t.writeSession(buf, addr, pid)
+	}
+	return conn.WriteTo(buf, addr)
+}
+
+// writeClear sends a packet unsealed, even once there is a game key.
+func (n *Node) writeClear(conn Transport, buf []byte, addr *net.UDPAddr) (int, error) {
+	if t, ok := conn.(*secureTransport); ok {
+		return t.Transport.WriteTo(buf, addr)
+	}
+	return conn.WriteTo(buf, addr)
+}
+
+func (n *Node) closeLobby(conn Transport) {
+	if t, ok := conn.(*secureTransport); ok {
+		t.closeLobby()
+	}
+}
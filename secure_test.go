@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func noSessions(pid int) ([]byte, bool) {
+	return nil, false
+}
+
+// a player only opens what was sealed for it, with the password it knows
+func TestOpen(t *testing.T) {
+	leader := newKeyring("password", noSessions)
+	player := &secureTransport{keys: newKeyring("password", func(pid int) ([]byte, bool) {
+		return []byte("token 2"), pid == 2
+	})}
+	stranger := newKeyring("guess", noSessions)
+	handshake, _ := leader.handshakeAEAD(player.keys.publicKey())
+	foreign, _ := stranger.handshakeAEAD(player.keys.publicKey())
+	session, _ := player.keys.sessionAEAD(2)
+
+	tampered := seal(handshake, sealedHandshake, leader.publicKey(), []byte("game start"))
+	tampered[len(tampered)-1] ^= 1
+	gameKey, otherGameKey := newGameKey(), newGameKey()
+	ours, theirs := newKeyring("", noSessions), newKeyring("", noSessions)
+	ours.setGameKey(gameKey)
+	theirs.setGameKey(otherGameKey)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  string
+	}{
+		{"handshake", seal(handshake, sealedHandshake, leader.publicKey(), []byte("game start")), ""},
+		{"handshake with another password", seal(foreign, sealedHandshake, stranger.publicKey(), []byte("game start")), "message authentication failed"},
+		{"handshake under someone else's key", seal(handshake, sealedHandshake, stranger.publicKey(), []byte("game start")), "message authentication failed"},
+		{"tampered", tampered, "message authentication failed"},
+		{"cleartext", encodeMessage(newMyMoveMessage("UP", "1", 1)), "not encrypted"},
+		{"empty", nil, "not encrypted"},
+		{"unknown kind", []byte{sealedMagic, 9, 0, 0, 0}, "unknown kind"},
+		{"truncated handshake", []byte{sealedMagic, sealedHandshake, 1, 2, 3}, "truncated handshake"},
+		{"truncated session", []byte{sealedMagic, sealedSession, 0}, "truncated session"},
+		{"no nonce", append([]byte{sealedMagic, sealedHandshake}, leader.publicKey()...), "truncated packet"},
+		{"session", seal(session, sealedSession, []byte{0, 2}, []byte("rejoin")), ""},
+		{"session of someone else", seal(session, sealedSession, []byte{0, 3}, []byte("rejoin")), "no session token for player 3"},
+		{"game before the game key", seal(ours.gameAEAD(), sealedGame, nil, []byte("moves")), "no game key yet"},
+	}
+	for _, test := range tests {
+		plaintext, err := player.open(test.frame)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: opened to %q with %v, want an error with %q", test.name, plaintext, err, test.want)
+		}
+	}
+
+	player.keys.setGameKey(gameKey)
+	if _, err := player.open(seal(ours.gameAEAD(), sealedGame, nil, []byte("moves"))); err != nil {
+		t.Errorf("game: %v", err)
+	}
+	if _, err := player.open(seal(theirs.gameAEAD(), sealedGame, nil, []byte("moves"))); err == nil {
+		t.Errorf("opened a packet sealed with another game's key")
+	}
+}
+
+// a player in the lobby takes nothing but a reject in the clear, and nothing at all once
+// the game started
+func TestLobbyInTheClear(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	network := NewSimNetwork(clock, 1)
+	leaderConn, _ := network.Listen("10.0.0.1:7000")
+	playerConn, _ := network.Listen("10.0.0.2:7000")
+	leaderKeys := newKeyring("", noSessions)
+	player := &secureTransport{Transport: playerConn, keys: newKeyring("", noSessions), lobby: isRejectMessage}
+	handshake, _ := leaderKeys.handshakeAEAD(player.keys.publicKey())
+
+	reject := encodeMessage(&RejectMessage{Envelope: lobbyEnvelope("reject"), Reject: Reject{Reason: RejectFull}})
+	roster := encodeMessage(&RosterMessage{Envelope: lobbyEnvelope("roster"), Roster: Roster{Min: 1, Max: 8}})
+	var inLobby, inGame []string
+	read := func() (got []string) {
+		for {
+			buf, _, err := player.ReadFrom(clock.Now().Add(time.Second))
+			if err != nil {
+				return got
+			}
+			message, err := decodeMessage(buf)
+			if err != nil {
+				got = append(got, string(buf))
+				continue
+			}
+			got = append(got, message.header().MessageType)
+		}
+	}
+	clock.AfterFunc(0, func() {
+		leaderConn.WriteTo(reject, player.LocalAddr())
+		leaderConn.WriteTo(roster, player.LocalAddr())
+		leaderConn.WriteTo(seal(handshake, sealedHandshake, leaderKeys.publicKey(), roster), player.LocalAddr())
+		leaderConn.WriteTo([]byte("garbage"), player.LocalAddr())
+		inLobby = read()
+		player.closeLobby()
+		leaderConn.WriteTo(reject, player.LocalAddr())
+		leaderConn.WriteTo(seal(handshake, sealedHandshake, leaderKeys.publicKey(), reject), player.LocalAddr())
+		inGame = read()
+	})
+	clock.mu.Lock()
+	clock.advance()
+	clock.mu.Unlock()
+	<-clock.Stalled()
+
+	if want := []string{"reject", "roster"}; strings.Join(inLobby, " ") != strings.Join(want, " ") {
+		t.Errorf("took %v in the lobby, want %v", inLobby, want)
+	}
+	if want := []string{"reject"}; strings.Join(inGame, " ") != strings.Join(want, " ") {
+		t.Errorf("took %v once the game started, want %v", inGame, want)
+	}
+}
@@ -3,16 +3,19 @@ package main
 import (
 	"bufio"
 	"encoding/csv"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"hash/fnv"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
-//	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"bitbucket.org/bestchai/dinv/govec"
@@ -22,6 +25,7 @@ import (
 type MyMove struct {
 	Direction string `json:"direction"`
 	Pid       string `json:"pid"`
+	Ack       int    `json:"ack"` // every round of moves up to this one has reached the player
 }
 
 type Move struct {
@@ -30,152 +34,313 @@ type Move struct {
 	Direction string `json:"direction"`
 }
 
-//type GameState struct {
-//	//refactor this
-var gameState_LeaderID       int
-var gameState_Round          int
-var gameState_MyPid          int
-var gameState_GridWidth      int
-var gameState_GridHeight     int
-var gameState_Grid           [][]int
-var gameState_Nickname       string
-var gameState_Positions      []map[string]Move
-var gameState_Alive          map[string]bool
-var gameState_Grace          map[string]int
-var gameState_Finish         []string
-var gameState_AddrToPid      map[string]string
-var gameState_AddrToAddr     map[string]*net.UDPAddr
-var gameState_PidToNickname  map[string]string
-var gameState_DroppedForever map[string]bool
-//}
+type GameState struct {
+	LeaderID       int      // the term of the leader we follow, see election.go
+	Term           int      // the newest term we know of
+	VotedFor       string   // who we voted for in Term
+	Succession     []string // who takes over from the leader, in order, see election.go
+	Round          int
+	Encoding       string
+	MyPid          int
+	GridWidth      int
+	GridHeight     int
+	Grid           [][]int
+	Nickname       string
+	SessionToken   string
+	GroupKey       string
+	GameKey        string            // what the game is encrypted with, see secure.go
+	Positions      []map[string]Move // the last few rounds of moves, ending on MovesRound
+	MovesRound     int
+	AckedRound     int // every round up to this one is in Positions, or was before it slid out
+	Alive          map[string]bool
+	Grace          map[string]int
+	Finish         []string
+	AddrToPid      map[string]string
+	AddrToAddr     map[string]*net.UDPAddr
+	PidToNickname  map[string]string
+	DroppedForever map[string]bool
+	Left           map[string]string // why every player that left did, see leave.go
+	Lockstep       bool              // nobody leads the game, see lockstep.go
+	Spectators     map[string]string // pid to nickname of everyone only watching, see spectate.go
+}
 
 type LeaderState struct {
 	Positions        []map[string]Move
-	leaderConnection *net.UDPConn
-}
-
-//type AddressState struct {
-var addressState_LocalIP        string
-var addressState_javaAddr       string
-var addressState_leaderAddr     string
-var addressState_leaderUDPAddr  *net.UDPAddr
-var addressState_isLeader       bool
-var addressState_goConnection   *net.UDPConn
-var addressState_javaConnection net.Conn
-var addressState_connBuf        *bufio.Reader
-var addressState_sendChan       chan []byte
-var addressState_recvChan       chan []byte
-//}
+	Encodings        map[string][]string    // what each player said it speaks when joining
+	Acks             map[string]int         // the last round of moves each player acknowledged
+	Resync           map[string]bool        // players that asked for a snapshot this round
+	Tokens           map[string]string      // session token of every player, to rejoin with
+	PublicKeys       map[string][]byte      // the key each player joined with, to send it the game start encrypted
+	Term             int                    // the term we were elected in
+	Pid              string                 // of our own client
+	nextPing         time.Time              // when the next heartbeats are due, see heartbeat.go
+	nextAnnounce     time.Time              // when the lobby is next announced, see discovery.go
+	Ready            map[string]bool        // players that are ready to start, while the lobby is open
+	starting         bool                   // the host asked to start, see lobby.go
+	countdown        time.Time              // when the game starts, zero unless counting down
+	nextTick         time.Time              // when everyone is next told how long is left
+	failedJoins      map[string][]time.Time // recent joins with the wrong password, by ip
+	Banned           []Ban                  // see moderation.go
+	lastPid          int                    // the last pid handed out, see spectate.go
+	Following        map[string]bool        // players we heard from since we took over, see announceLeader
+	leaderConnection Transport
+}
+
+type AddressState struct {
+	localIP        string
+	javaAddr       string
+	leaderAddr     string
+	leaderUDPAddr  *net.UDPAddr
+	leaderPid      string // the pid the leader signs with, see auth.go
+	isLeader       bool
+	goConnection   Transport
+	javaConnection net.Conn
+	connBuf        *bufio.Reader
+	sendChan       Mailbox
+	recvChan       Mailbox
+	lobbyChan      Mailbox // the frontend's ready and start, until the game starts
+	javaMoves      Mailbox // what the java frontend answers round starts with
+}
+
+// A Node is one peer of a match: the player it represents, its connection to the
+// frontend (java or ai), and the leader it may be running on behalf of everyone else.
+// Several nodes can live in the same process.
+type Node struct {
+	GameState
+	AddressState
+	leaderState       LeaderState
+	electionState     ElectionState
+	votes             map[string]bool // who voted for us, while we are a candidate
+	electionDeadline  time.Time       // when we stand for the next term unless the leader speaks up
+	lastHeard         time.Time       // the last time the leader did
+	quietElections    int             // elections in a row nobody else answered
+	handoffTerm       int             // the last term a leader handed over to its successor
+	quitting          atomic.Bool     // the leader should hand over at the end of the round
+	handedOver        atomic.Bool
+	quitReason        string
+	detector          *failureDetector
+	suspectedAt       time.Time   // when the detector first suspected the leader, see heartbeat.go
+	stopped           atomic.Bool // the game is over for us
+	members           *membership // see membership.go
+	lobby             lobbyState
+	steps             lockstepState
+	prediction        predictionState
+	rejoinIncarnation int       // the incarnation we last asked to rejoin as
+	rejoinRetry       time.Time // when to ask to rejoin again, unless the leader took us back
+	rejoinTries       int
+	lastLeaderAddr    string // the leader we followed before a restart, see saveTerm
+	config            Config
+	auth              authState
+	keys              *keyring // nil unless the game is encrypted
+	lastTime          time.Time
+	divergedRound     int // the round our state didn't match the leader's checksum, until a snapshot fixes it
+	resyncRound       int // the last round we asked the leader for a snapshot
+	ai                bool
+	seed              int64
+	rng               *rand.Rand
+	clock             Clock
+	network           Network
+	Logger            *govec.GoLog
+}
+
+// A NodeOption configures a Node in NewNode.
+type NodeOption func(*Node)
 
 type RoundStart struct {
-	Round int `json:"round"`
+	Round      int      `json:"round"`
+	Succession []string `json:"succession,omitempty"`
+	Dropped    []string `json:"dropped,omitempty"`
 }
 
 type RoundStartMessage struct {
-	MessageType string `json:"messageType"`
-	EventName   string `json:"eventName"`
-	Round       int    `json:"round"`
-	RoundStart  `json:"roundStart"`
+	Envelope
+	RoundStart `json:"roundStart"`
 }
 
 type MyMoveMessage struct {
-	MessageType string `json:"messageType"`
-	EventName   string `json:"eventName"`
-	Round       int    `json:"round"`
-	MyMove      `json:"myMove"`
+	Envelope
+	MyMove `json:"myMove"`
 }
 
 type KillPlayerMessage struct {
-	MessageType string `json:"messageType"`
-	EventName   string `json:"eventName"`
-	PlayerPID   string `json:"playerpid"`
-	Round       int    `json:"round"`
+	Envelope
+	PlayerPID string `json:"playerpid"`
 }
 
 type MovesMessage struct {
-	MessageType string `json:"messageType"`
-	EventName   string `json:"eventName"`
-	Round       int    `json:"round"`
-	Moves       `json:"moves"`
+	Envelope
+	Moves `json:"moves"`
 }
 
 type Moves struct {
-	Moves []map[string]Move `json:"moves"`
-	Round int               `json:"round"`
+	Moves    []map[string]Move `json:"moves"`
+	Round    int               `json:"round"`
+	Checksum uint32            `json:"checksum"` // of the leader's grid and alive set after Round, see stateChecksum
 }
 
 type GameStart struct {
 	Pid               string            `json:"pid"`
+	Encoding          string            `json:"encoding,omitempty"`
+	Token             string            `json:"token,omitempty"`    // our own key, see auth.go
+	GroupKey          string            `json:"groupKey,omitempty"` // the key every player shares
+	GameKey           string            `json:"gameKey,omitempty"`  // the key every packet is encrypted with
+	Succession        []string          `json:"succession"`
 	StartingPositions map[string]Move   `json:"startingPositions"`
 	Nicknames         map[string]string `json:"nicknames"`
 	Addresses         map[string]string `json:"addresses"`
+	Lockstep          bool              `json:"lockstep,omitempty"`   // play without a leader, see lockstep.go
+	Spectators        map[string]string `json:"spectators,omitempty"` // pid to nickname, their addresses are with everyone's
+	Leader            string            `json:"leader"`               // the pid the leader signs with
 }
 
 type GameStartMessage struct {
-	MessageType string `json:"messageType"`
-	EventName   string `json:"eventName"`
-	Round       int    `json:"round"`
-	GameStart   `json:"gameStart"`
+	Envelope
+	GameStart `json:"gameStart"`
 }
 
 type GameOver struct {
-	PidsInOrderOfDeath []string `json:"pidsInOrderOfDeath"`
+	PidsInOrderOfDeath []string          `json:"pidsInOrderOfDeath"`
+	Left               map[string]string `json:"left,omitempty"` // why the players that left did
 }
 
 type GameOverMessage struct {
-	MessageType string `json:"messageType"`
-	EventName   string `json:"eventName"`
-	Round       int    `json:"round"`
-	GameOver    `json:"gameOver"`
+	Envelope
+	GameOver `json:"gameOver"`
 }
 
 type LeaderElectionMessage struct {
-	MessageType string `json:"messageType"`
-	EventName   string `json:"eventName"`
-	Round       int    `json:"round"`
-	LeaderID    int    `json:"leaderid"`
+	Envelope
+	LeaderID int    `json:"leaderid"`
+	Address  string `json:"address,omitempty"` // of the leader socket of a newleader
 }
 
-type ElectionState int
+var DIRECTIONS = [...]string{"DOWN", "LEFT", "UP", "RIGHT"}
 
-const (
-	NORMAL ElectionState = 1 + iota
-	QUORUM
-	NEWLEADER
-)
+/*
+* NODE CONSTRUCTION
+ */
 
-//var gameState GameState
-//var addressState AddressState
-var leaderState LeaderState
-var electionState = NORMAL
-var lastTime time.Time
+func WithConfig(config Config) NodeOption {
+	return func(n *Node) {
+		n.config = config
+	}
+}
 
-var DISABLE_GAME_OVER = false // to allow single player game for debugging
-var COLLISION_IS_DEATH = true
-var MIN_GAME_SPEED = 1000 / 40 * time.Millisecond        // time between every new java move
-var FOLLOWER_RESPONSE_TIME = 500 * 4 * time.Millisecond  // time for followers to respond
-var MAX_ALLOWABLE_MISSED_MESSAGES = 5                    // max number of consecutive missed messages
-var FOLLOWER_RESPONSE_FAIL_RATE = map[string]int{"1": 0} // out of 1000, fail rate for responses not to be received
-var METRICS = false                                       // disable metrics
+func WithGridSize(width, height int) NodeOption {
+	return func(n *Node) {
+		n.GridWidth = width
+		n.GridHeight = height
+	}
+}
 
-var ROUND_LATENCY_FILENAME = ""
-var READ_THROUGHPUT_FILENAME = ""
-var WRITE_THROUGHPUT_FILENAME = ""
+func WithNickname(nickname string) NodeOption {
+	return func(n *Node) {
+		n.Nickname = nickname
+	}
+}
 
+// WithLeader sets the address of the leader to join. If isLeader is set, this node
+// also hosts the lobby on that address.
+func WithLeader(leaderAddr string, isLeader bool) NodeOption {
+	return func(n *Node) {
+		n.leaderAddr = leaderAddr
+		n.isLeader = isLeader
+	}
+}
 
-var DIRECTIONS = [...]string{"DOWN", "LEFT", "UP", "RIGHT"}
+func WithJavaPort(port string) NodeOption {
+	return func(n *Node) {
+		n.javaAddr = "localhost:" + port
+	}
+}
+
+func WithLocalIP(ip string) NodeOption {
+	return func(n *Node) {
+		n.localIP = ip
+	}
+}
+
+// WithSession makes the node rejoin a running game as pid instead of joining the lobby.
+func WithSession(pid int, token string) NodeOption {
+	return func(n *Node) {
+		n.MyPid = pid
+		n.SessionToken = token
+	}
+}
+
+// WithAI replaces the java frontend with the built in ai player.
+func WithAI() NodeOption {
+	return func(n *Node) {
+		n.ai = true
+	}
+}
 
-var Logger *govec.GoLog
+func WithSeed(seed int64) NodeOption {
+	return func(n *Node) {
+		n.seed = seed
+	}
+}
+
+// WithClock and WithNetwork swap the real time and UDP sockets for simulated ones.
+func WithClock(clock Clock) NodeOption {
+	return func(n *Node) {
+		n.clock = clock
+	}
+}
+
+func WithNetwork(network Network) NodeOption {
+	return func(n *Node) {
+		n.network = network
+	}
+}
+
+func WithLogger(logger *govec.GoLog) NodeOption {
+	return func(n *Node) {
+		n.Logger = logger
+	}
+}
+
+func NewNode(opts ...NodeOption) *Node {
+	n := &Node{electionState: FOLLOWER, config: DefaultConfig(), clock: realClock{}, network: udpNetwork{}}
+	n.localIP = "127.0.0.1"
+	for _, opt := range opts {
+		opt(n)
+	}
+	if n.seed == 0 {
+		hash := fnv.New64a()
+		hash.Write([]byte(n.Nickname))
+		n.seed = time.Now().Unix() + int64(hash.Sum64())
+	}
+	n.rng = newLockedRand(n.seed)
+	if n.Logger == nil {
+		name := "server-" + n.Nickname
+		n.Logger = govec.Initialize(name, name+".log")
+	}
+	if n.config.Invite && n.config.Password == "" {
+		// players join with it like with a password
+		n.config.Password = newInviteCode()
+	}
+	if n.config.Encrypt || n.config.Password != "" {
+		n.keys = newKeyring(n.config.Password, func(pid int) ([]byte, bool) {
+			if pid == 0 {
+				return nil, false
+			}
+			return n.keyFor(pid)
+		})
+	}
+	n.detector = newFailureDetector(n.config.HeartbeatInterval)
+	n.members = newMembership()
+	n.initializeGameState()
+	return n
+}
 
 /*
 * READ FROM UDP
  */
 
-func readFromUDPWithTimeout(conn *net.UDPConn, timeoutTime time.Time) ([]byte, *net.UDPAddr, bool) {
+func (n *Node) readFromUDPWithTimeout(conn Transport, timeoutTime time.Time) ([]byte, *net.UDPAddr, bool) {
 	//@dump
-	buf := make([]byte, 4096)
-	conn.SetReadDeadline(timeoutTime)
-	n, raddr, err := conn.ReadFromUDP(buf[0:])
+	buf, raddr, err := conn.ReadFrom(timeoutTime)
 
 	if err != nil {
 		if e, ok := err.(net.Error); !ok || !e.Timeout() {
@@ -183,25 +348,24 @@ func readFromUDPWithTimeout(conn *net.UDPConn, timeoutTime time.Time) ([]byte, *
 			return nil, nil, false
 		} else {
 			// timeout
-			// TODO: how to deal with udp timeout and govec unpack recv? 
+			// TODO: how to deal with udp timeout and govec unpack recv?
 			fmt.Println("timed out")
 			return nil, raddr, true
 		}
 	} else {
-		buf2 := Logger.UnpackReceive("Received", buf[0:])
+		buf2 := n.Logger.UnpackReceive("Received", buf)
 		//@dump
-		recordReadThroughput(n)
+		n.recordReadThroughput(len(buf))
 
 		return buf2, raddr, false
 	}
 }
 
-func readFromUDP(conn *net.UDPConn) ([]byte, *net.UDPAddr) {
-	buf := make([]byte, 4096)
-	n, raddr, err := conn.ReadFromUDP(buf[0:])
-	buf2 := Logger.UnpackReceive("Received", buf[0:])
+func (n *Node) readFromUDP(conn Transport) ([]byte, *net.UDPAddr) {
+	buf, raddr, err := conn.ReadFrom(time.Time{})
 	checkError(err)
-	recordReadThroughput(n)
+	buf2 := n.Logger.UnpackReceive("Received", buf)
+	n.recordReadThroughput(len(buf))
 
 	return buf2, raddr
 }
@@ -209,12 +373,12 @@ func readFromUDP(conn *net.UDPConn) ([]byte, *net.UDPAddr) {
 /*
 * MATH UTILITIES
  */
-func randomDir() string {
-	return DIRECTIONS[randomInt(0, 4)]
+func (n *Node) randomDir() string {
+	return DIRECTIONS[n.randomInt(0, 4)]
 }
 
-func randomInt(min, max int) int {
-	return rand.Intn(max-min) + min
+func (n *Node) randomInt(min, max int) int {
+	return n.rng.Intn(max-min) + min
 }
 
 func max(a, b int) int {
@@ -236,21 +400,21 @@ func min(a, b int) int {
 /*
 * LOG UTILITIES
  */
-func log(message string) {
+func (n *Node) log(message string) {
 	fmt.Println(message)
-	Logger.LogLocalEvent(message)
+	n.Logger.LogLocalEvent(message)
 }
 
-func logJava(message string) {
-	log("GO2Java: " + message)
+func (n *Node) logJava(message string) {
+	n.log("GO2Java: " + message)
 }
 
-func logLeader(message string) {
-	log("GOLEADER: " + message)
+func (n *Node) logLeader(message string) {
+	n.log("GOLEADER: " + message)
 }
 
-func logClient(message string) {
-	log("GOCLIENT: " + message)
+func (n *Node) logClient(message string) {
+	n.log("GOCLIENT: " + message)
 }
 
 /*
@@ -260,51 +424,52 @@ func logClient(message string) {
 
 // what is the smoothness/time delta between consecutive rounds?
 
-func recordRoundLatency() {
-	if !METRICS {
+func (n *Node) recordRoundLatency() {
+	if !n.config.Metrics {
 		return
 	}
-	diff := time.Since(lastTime)
+	diff := n.clock.Now().Sub(n.lastTime)
 
-	csvfile, err := os.OpenFile(ROUND_LATENCY_FILENAME, os.O_APPEND|os.O_WRONLY, 0600)
+	csvfile, err := os.OpenFile(n.config.RoundLatencyFilename, os.O_APPEND|os.O_WRONLY, 0600)
 	checkError(err)
 	defer csvfile.Close()
 	writer := csv.NewWriter(csvfile)
 
-	err = writer.Write([]string{strconv.Itoa(gameState_Round),
-		strconv.Itoa(gameState_LeaderID), strconv.FormatInt(diff.Nanoseconds(), 10)})
+	err = writer.Write([]string{strconv.Itoa(n.Round),
+		strconv.Itoa(n.LeaderID), strconv.FormatInt(diff.Nanoseconds(), 10)})
 	checkError(err)
 	writer.Flush()
 
-	lastTime = time.Now()
+	n.lastTime = n.clock.Now()
 }
 
 // length of messages received by this player by round
-func recordReadThroughput(n int) {
-	if !METRICS {
+func (n *Node) recordReadThroughput(size int) {
+	if !n.config.Metrics {
 		return
 	}
-	csvfile, err := os.OpenFile(READ_THROUGHPUT_FILENAME, os.O_APPEND|os.O_WRONLY, 0600)
+	csvfile, err := os.OpenFile(n.config.ReadThroughputFilename, os.O_APPEND|os.O_WRONLY, 0600)
 	checkError(err)
 	defer csvfile.Close()
 	writer := csv.NewWriter(csvfile)
 
-	err = writer.Write([]string{strconv.Itoa(gameState_Round),
-		strconv.Itoa(gameState_MyPid), strconv.Itoa(n)})
+	err = writer.Write([]string{strconv.Itoa(n.Round),
+		strconv.Itoa(n.MyPid), strconv.Itoa(size)})
 	checkError(err)
 	writer.Flush()
 }
 
-func recordWriteThroughput(n int) {
-	if !METRICS {
+func (n *Node) recordWriteThroughput(size int) {
+	if !n.config.Metrics {
 		return
 	}
-	csvfile, err := os.OpenFile(WRITE_THROUGHPUT_FILENAME, os.O_APPEND|os.O_WRONLY, 0600)
+	csvfile, err := os.OpenFile(n.config.WriteThroughputFilename, os.O_APPEND|os.O_WRONLY, 0600)
+	checkError(err)
 	defer csvfile.Close()
 	writer := csv.NewWriter(csvfile)
 
-	err = writer.Write([]string{strconv.Itoa(gameState_Round),
-		strconv.Itoa(gameState_MyPid), strconv.Itoa(n)})
+	err = writer.Write([]string{strconv.Itoa(n.Round),
+		strconv.Itoa(n.MyPid), strconv.Itoa(size)})
 	checkError(err)
 	writer.Flush()
 }
@@ -313,389 +478,536 @@ func recordWriteThroughput(n int) {
 * MESSAGE UTILITIES
  */
 
-func encodeMessage(message interface{}) []byte {
-	val, e := json.Marshal(message)
-	checkError(e)
-	return val
-}
-
-func decodeMessage(message []byte) map[string]interface{} {
-	var dat map[string]interface{}
-	err := json.Unmarshal(message, &dat)
-	checkError(err)
-	return dat
+// encode a message for the other go peers, in the encoding the game was started with
+func (n *Node) encode(message Message) []byte {
+	return encodeWireMessage(message, n.Encoding)
 }
 
-func parseMessage(buf []byte) (string, string, int) {
-	fmt.Println("Parsing the following message " + string(buf))
-
-	dat := decodeMessage(buf)
-
-	roundString, _ := dat["round"].(float64)
-	round := int(roundString)
-	eventName := dat["eventName"].(string)
-	pid, _ := dat["pid"].(string)
-	var direction string
-	switch eventName {
-	case "myMove":
-		direction, _ = dat["direction"].(string)
-	default:
-		panic("Did not understand event " + eventName)
+func (n *Node) sendMessage(conn Transport, message Message, addr *net.UDPAddr) {
+	n.attachGossip(message)
+	buf := n.sign(n.encode(message), n.keyIDFor(addr))
+	_, err := conn.WriteTo(n.Logger.PrepareSend("", buf), addr)
+	//@dump
+	n.recordWriteThroughput(len(buf))
+	if err != nil {
+		// one player we can't reach, or a message too big to send, is no reason to end the game
+		n.logLeader("Could not send a " + message.header().MessageType + " message to player " + addr.String() + ": " + err.Error())
+		return
 	}
-	logLeader("parsed message: player " + pid + " is going in direction " + direction + " on round " + strconv.Itoa(round))
-	
-	return direction, pid, round
-}
-
-func getPID(buf []byte) (pid string) {
-	dat := decodeMessage(buf)
-	pid = dat["playerpid"].(string)
-	return
-}
-
-func getMessageType(buf []byte) (messageType string) {
-	dat := decodeMessage(buf)
-	messageType = dat["messageType"].(string)
-	return
+	n.logLeader("Sent message " + string(encodeMessage(message)) + " to player " + addr.String())
 }
 
-func getRoundNumber(buf []byte) (round int) {
-	dat := decodeMessage(buf)
-	roundString, _ := dat["round"].(float64)
-	round = int(roundString)
-	return
-}
-
-func getLeaderID(buf []byte) (ID int) {
-	dat := decodeMessage(buf)
-	IDString, _ := dat["leaderid"].(float64)
-	ID = int(IDString)
-	return
-}
-
-func getMoves(buf []byte) (moves []interface{}) {
-	dat := decodeMessage(buf)
-	moves = dat["moves"].(map[string]interface{})["moves"].([]interface{})
-	return
+func (n *Node) broadcastMessage(conn Transport, message Message) {
+	for _, address := range n.addresses() {
+		if n.isMember(n.AddrToPid[address]) {
+			n.sendMessage(conn, message, n.AddrToAddr[address])
+		}
+	}
 }
 
-func broadcastMessage(conn *net.UDPConn, message []byte) {
-	for _, addr := range gameState_AddrToAddr {
-		_, err := conn.WriteToUDP(Logger.PrepareSend("", message), addr)
-		//@dump
-		recordWriteThroughput(len(message))
-		checkError(err)
-		logLeader("Sent message " + string(message) + " to player " + addr.String())
+// addresses lists the players' addresses in a fixed order, so a seeded simulation
+// sends everything in the same order every time
+func (n *Node) addresses() []string {
+	addresses := make([]string, 0, len(n.AddrToAddr))
+	for address := range n.AddrToAddr {
+		addresses = append(addresses, address)
 	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Every player only gets the rounds of moves it hasn't acknowledged yet, or a snapshot
+// if it is further behind than the window or asked for one.
+func (n *Node) broadcastMoves(conn Transport) {
+	var snapshot *SnapshotMessage
+	checksum := n.stateChecksum()
+	for _, address := range n.addresses() {
+		addr := n.AddrToAddr[address]
+		pid := n.AddrToPid[address]
+		missing := max(n.Round-n.leaderState.Acks[pid], 1)
+		if n.isSpectator(pid) {
+			// spectators don't acknowledge anything, they ask for a snapshot if the window isn't enough
+			missing = len(n.leaderState.Positions)
+		}
+		if missing > len(n.leaderState.Positions) || n.leaderState.Resync[pid] {
+			n.logLeader("Player " + pid + " is " + strconv.Itoa(missing) + " rounds behind, sending a snapshot")
+			if snapshot == nil {
+				snapshot = n.snapshotMessage()
+			}
+			n.sendMessage(conn, snapshot, addr)
+			continue
+		}
+		moves := n.movesMessage(missing)
+		moves.Checksum = checksum
+		n.sendMessage(conn, moves, addr)
+	}
+	n.leaderState.Resync = make(map[string]bool)
 }
 
 /*
 * MESSAGE CONSTRUCTORS
  */
-func newRoundMessage() []byte {
-	gameState_Round++
-	message := RoundStartMessage{
-		MessageType: "roundstart",
-		EventName:   "roundStart",
-		Round:       gameState_Round,
+func (n *Node) newRoundMessage() *RoundStartMessage {
+	n.Round++
+	return &RoundStartMessage{
+		Envelope: Envelope{
+			MessageType: "roundstart",
+			EventName:   "roundStart",
+			Round:       n.Round,
+			Term:        n.leaderState.Term,
+		},
 		RoundStart: RoundStart{
-			Round: gameState_Round,
+			Round:      n.Round,
+			Succession: n.Succession,
+			Dropped:    n.droppedPlayers(),
 		},
 	}
-	return encodeMessage(message)
 }
 
-func startGameMessage(pid string, startingPositions map[string]Move) GameStartMessage {
-	return GameStartMessage{
-		MessageType: "startgame",
-		EventName:   "gameStart",
-		Round:       gameState_Round,
+func newMyMoveMessage(direction string, pid string, round int) *MyMoveMessage {
+	return &MyMoveMessage{
+		Envelope: Envelope{
+			MessageType: "mymove",
+			EventName:   "myMove",
+			Round:       round,
+		},
+		MyMove: MyMove{
+			Direction: direction,
+			Pid:       pid,
+		},
+	}
+}
+
+// the moves of the last rounds, up to the current one
+func (n *Node) movesMessage(rounds int) *MovesMessage {
+	return &MovesMessage{
+		Envelope: Envelope{
+			MessageType: "moves",
+			EventName:   "moves",
+			Round:       n.Round,
+			Term:        n.leaderState.Term,
+		},
+		Moves: Moves{
+			Moves: n.leaderState.Positions[len(n.leaderState.Positions)-rounds:],
+			Round: n.Round,
+		},
+	}
+}
+
+func (n *Node) startGameMessage(pid string, startingPositions map[string]Move) *GameStartMessage {
+	return &GameStartMessage{
+		Envelope: Envelope{
+			MessageType: "startgame",
+			EventName:   "gameStart",
+			Round:       n.Round,
+			Term:        n.leaderState.Term,
+		},
 		GameStart: GameStart{
 			Pid:               pid,
+			Encoding:          n.Encoding,
+			Token:             n.leaderState.Tokens[pid],
+			GroupKey:          n.GroupKey,
+			GameKey:           n.GameKey,
+			Succession:        n.Succession,
 			StartingPositions: startingPositions,
-			Nicknames:         gameState_PidToNickname,
-			Addresses:         gameState_AddrToPid,
+			Nicknames:         n.PidToNickname,
+			Addresses:         n.AddrToPid,
+			Lockstep:          n.Lockstep,
+			Spectators:        n.Spectators,
+			Leader:            n.leaderState.Pid,
 		},
 	}
 }
 
-func endGameMessage() GameOverMessage {
-	return GameOverMessage{
-		MessageType: "gameOver",
-		EventName:   "gameOver",
-		Round:       gameState_Round,
+func (n *Node) endGameMessage() *GameOverMessage {
+	return &GameOverMessage{
+		Envelope: Envelope{
+			MessageType: "gameOver",
+			EventName:   "gameOver",
+			Round:       n.Round,
+			Term:        n.leaderState.Term,
+		},
 		GameOver: GameOver{
-			PidsInOrderOfDeath: gameState_Finish,
+			PidsInOrderOfDeath: n.Finish,
+			Left:               n.Left,
 		},
 	}
 }
 
-func newRound(conn *net.UDPConn) (roundMoves MovesMessage) {
-	newRoundMessage := newRoundMessage()
-	broadcastMessage(conn, newRoundMessage)
-	logLeader("Done sending round start messages.")
-	slideWindow()
-	roundMoves = MovesMessage{
-		MessageType: "moves",
-		EventName:   "moves",
-		Round:       gameState_Round,
-		Moves: Moves{
-			Moves: leaderState.Positions,
-			Round: gameState_Round,
+func (n *Node) leaderElectionMessage(messageType string, leaderID int) *LeaderElectionMessage {
+	return &LeaderElectionMessage{
+		Envelope: Envelope{
+			MessageType: messageType,
+			Round:       n.Round,
 		},
+		LeaderID: leaderID,
 	}
-	return
+}
+
+func (n *Node) newRound(conn Transport) {
+	newRoundMessage := n.newRoundMessage()
+	n.broadcastMessage(conn, newRoundMessage)
+	n.logLeader("Done sending round start messages.")
+	n.announceLeader()
+	n.slideWindow()
 }
 
 /*
 * INIT FUNCTIONS
  */
-func CreateInitPlayerPosition() Move {
-	direction := randomDir()
+func (n *Node) CreateInitPlayerPosition() Move {
+	direction := n.randomDir()
 	// Give a small buffer so they don't crash into a wall immediately!
-	if (gameState_GridWidth < 30) || (gameState_GridHeight < 30) {
+	if (n.GridWidth < 30) || (n.GridHeight < 30) {
 		panic("game grid dimensions are too small!")
 	}
 	return Move{
-		X:         randomInt(15, gameState_GridWidth-15),
-		Y:         randomInt(15, gameState_GridHeight-15),
+		X:         n.randomInt(15, max(16, n.GridWidth-15)),
+		Y:         n.randomInt(15, max(16, n.GridHeight-15)),
 		Direction: direction,
 	}
 }
 
-func registerNewPlayer(raddr *net.UDPAddr, buf []byte) {
+func (n *Node) registerNewPlayer(raddr *net.UDPAddr, join Join, publicKey []byte) string {
 	address := raddr.String()
-	pid := strconv.Itoa(len(getLeaderMoveMap()) + 1)
-	getLeaderMoveMap()[pid] = CreateInitPlayerPosition()
-	gameState_Alive[pid] = true
-	gameState_AddrToPid[address] = pid
-	gameState_AddrToAddr[address] = raddr
-	gameState_Alive[pid] = true
-	nickname := strings.Split(string(buf), ":")[1]
-	gameState_PidToNickname[pid] = nickname
-	logLeader("New player named " + nickname + " has joined from address " + address)
-	logLeader("Assigning pid " + pid + " and starting position " + strconv.Itoa(getLeaderMoveMap()[pid].X) +
-		"," + strconv.Itoa(getLeaderMoveMap()[pid].Y))
-	
-}
-
-func initLobby() {
-	for {
-		logLeader("Waiting for a client to join or send a start game message")
-		buf, raddr, timedout := readFromUDPWithTimeout(leaderState.leaderConnection, time.Now().Add(time.Second * 15))
-		if timedout || isStartMessage(buf) {
-			logLeader("Start of the game, sending broadcast")
-			for addr, pid := range gameState_AddrToPid {
-				newGameMsg := encodeMessage(startGameMessage(pid, getLeaderMoveMap()))
-				logLeader("Sending a game start message to " + addr + ". " + string(newGameMsg))
-				_, err := leaderState.leaderConnection.WriteToUDP(Logger.PrepareSend("", newGameMsg), gameState_AddrToAddr[addr])
-				//@dump
-				checkError(err)
-			}
-			break
-		} else if isJoinMessage(buf) {
-			address := raddr.String()
-			if _, knownPlayer := gameState_AddrToPid[address]; !knownPlayer {
-				registerNewPlayer(raddr, buf)
-			}
-		} else {
-			panic("Message not recognized:  " + string(buf))
+	pid := n.nextPid()
+	n.getLeaderMoveMap()[pid] = n.CreateInitPlayerPosition()
+	n.Alive[pid] = true
+	n.AddrToPid[address] = pid
+	n.AddrToAddr[address] = raddr
+	if n.goConnection != nil && address == n.goConnection.LocalAddr().String() {
+		n.leaderState.Pid = pid
+	}
+	// the starting position is part of the trail like any other
+	n.Grid[n.getLeaderMoveMap()[pid].X][n.getLeaderMoveMap()[pid].Y], _ = strconv.Atoi(pid)
+	// everyone gets the starting positions with the game start
+	n.leaderState.Acks[pid] = n.Round
+	n.leaderState.Tokens[pid] = newSessionToken()
+	n.leaderState.PublicKeys[pid] = publicKey
+	nickname := join.Nickname
+	n.PidToNickname[pid] = nickname
+	n.leaderState.Encodings[pid] = []string{JSON_ENCODING}
+	if len(join.Encodings) > 0 {
+		n.leaderState.Encodings[pid] = parseEncodings(strings.Join(join.Encodings, ","))
+	}
+	n.logLeader("New player named " + nickname + " has joined from address " + address)
+	n.logLeader("Assigning pid " + pid + " and starting position " + strconv.Itoa(n.getLeaderMoveMap()[pid].X) +
+		"," + strconv.Itoa(n.getLeaderMoveMap()[pid].Y))
+	return pid
+}
+
+func (n *Node) initLobby() {
+	n.leaderState.Ready = make(map[string]bool)
+	n.leaderState.failedJoins = make(map[string][]time.Time)
+	if n.config.Invite {
+		n.logLeader("Players join with the invite code " + n.config.Password)
+	}
+	n.logLeader("Waiting for players to join and get ready")
+	for !n.tickCountdown() {
+		n.announceLobby()
+		buf, raddr, timedout := n.readFromUDPWithTimeout(n.leaderState.leaderConnection, n.lobbyWakeup())
+		if !timedout {
+			n.lobbyPacket(buf, raddr)
 		}
 	}
+	n.startGame()
 }
 
-func initializeLeader(leaderAddrString string) {
-	leaderState.Positions = make([]map[string]Move, MAX_ALLOWABLE_MISSED_MESSAGES)
-	for i := 0; i < len(leaderState.Positions); i++ {
-		leaderState.Positions[i] = make(map[string]Move)
+func (n *Node) startGame() {
+	n.logLeader("Start of the game, sending broadcast")
+	var encodings [][]string
+	for _, supported := range n.leaderState.Encodings {
+		encodings = append(encodings, supported)
+	}
+	n.Encoding = chooseEncoding(n.config.WireEncoding, encodings)
+	n.logLeader("Playing the game in " + n.Encoding)
+	n.GroupKey = newSessionToken()
+	n.Lockstep = n.config.Lockstep
+	n.initMembers()
+	n.Succession = n.successionOrder()
+	n.logLeader("Succession: " + strings.Join(n.Succession, ", "))
+	if n.encrypting() {
+		n.GameKey = newGameKey()
+	}
+	var unreachable []string
+	for addr, pid := range n.AddrToPid {
+		// the game start is always json, it is what tells everyone the encoding
+		newGameMsg := encodeMessage(n.startGameMessage(pid, n.getLeaderMoveMap()))
+		n.logLeader("Sending a game start message to " + addr + ". " + string(newGameMsg))
+		_, err := n.writeHandshake(n.leaderState.leaderConnection, n.Logger.PrepareSend("", newGameMsg), n.AddrToAddr[addr], pid)
+		//@dump
+		if err != nil {
+			n.logLeader("Can't send player " + pid + " the game start: " + err.Error())
+			unreachable = append(unreachable, pid)
+		}
+	}
+	if n.encrypting() {
+		checkError(n.keys.setGameKey(n.GameKey))
+		n.closeLobby(n.leaderState.leaderConnection)
+	}
+	// everyone else plays on without them
+	for _, pid := range unreachable {
+		n.playerLeft(pid, "never got the game start")
 	}
-	leaderAddr, err := net.ResolveUDPAddr("udp", leaderAddrString)
-	checkError(err)
-	conn, err := net.ListenUDP("udp", leaderAddr)
-	fmt.Println(conn.LocalAddr(), conn.RemoteAddr())
-	checkError(err)
-	leaderState.leaderConnection = conn
 }
 
-func initializeConnection() {
-	addr, err := net.ResolveUDPAddr("udp", addressState_LocalIP+":0")
-	checkError(err)
-	conn, err := net.ListenUDP("udp", addr)
+func (n *Node) initializeLeader(leaderAddrString string) {
+	n.leaderState.Positions = make([]map[string]Move, n.config.MaxAllowableMissedMessages)
+	for i := 0; i < len(n.leaderState.Positions); i++ {
+		n.leaderState.Positions[i] = make(map[string]Move)
+	}
+	n.leaderState.Encodings = make(map[string][]string)
+	n.leaderState.Acks = make(map[string]int)
+	n.leaderState.Resync = make(map[string]bool)
+	n.leaderState.Tokens = make(map[string]string)
+	n.leaderState.Following = make(map[string]bool)
+	n.leaderState.PublicKeys = make(map[string][]byte)
+	conn, err := n.network.Listen(leaderAddrString)
 	checkError(err)
-	addressState_goConnection = conn
+	fmt.Println(conn.LocalAddr())
+	n.leaderState.leaderConnection = n.secure(withFragments(withFaults(conn, n.seed, DropRate{
+		Rates: n.config.FollowerResponseFailRate,
+		Key:   n.pidOfPacket,
+	}), n.clock), anyLobbyMessage)
 }
 
-func initializeLeaderConnection() {
-	leaderUDPAddr, err := net.ResolveUDPAddr("udp", addressState_leaderAddr)
+func (n *Node) initializeConnection() {
+	conn, err := n.network.Listen(n.localIP + ":0")
 	checkError(err)
-	addressState_leaderUDPAddr = leaderUDPAddr
+	// the leader seals all it sends us in the lobby but a reject, which may be because it
+	// can't make out our key
+	n.goConnection = n.secure(withFragments(conn, n.clock), isRejectMessage)
 }
 
-func contactLeader() {
-	initializeConnection()
-	initializeLeaderConnection()
-	fmt.Print("GOCLIENT: ")
-	fmt.Println("Sending a hello message to the leader", addressState_leaderAddr, addressState_goConnection.LocalAddr(), addressState_goConnection.RemoteAddr())
-	_, err := addressState_goConnection.WriteToUDP(Logger.PrepareSend("", []byte("JOIN:"+gameState_Nickname)),
-		addressState_leaderUDPAddr)
-	logClient("hello")
+func (n *Node) initializeLeaderConnection() {
+	leaderUDPAddr, err := net.ResolveUDPAddr("udp", n.leaderAddr)
 	checkError(err)
-	if addressState_isLeader {
-		message := <-addressState_sendChan
-		logClient("Go client got START message. Sending to leader")
-		_, err = addressState_goConnection.WriteToUDP(Logger.PrepareSend("", []byte(message)), addressState_leaderUDPAddr)
-		checkError(err)
-
+	n.leaderUDPAddr = leaderUDPAddr
+}
+
+// contactLeader gets us into the game, through the lobby or by rejoining it. It says
+// whether the leader let us in.
+func (n *Node) contactLeader() bool {
+	n.initializeConnection()
+	n.initializeLeaderConnection()
+	n.clock.Go(n.forwardLobbyCommands)
+	defer n.lobbyChan.Close()
+	var gameStart *GameStartMessage
+	if n.SessionToken != "" {
+		// we have played this game before, the leader knows us by our pid
+		n.lobby.over.Store(true)
+		n.closeLobby(n.goConnection)
+		n.logClient("Rejoining the game as player " + strconv.Itoa(n.MyPid))
+		n.loadTerm()
+		if gameStart = n.rejoin(); gameStart == nil {
+			return false
+		}
+	} else {
+		fmt.Print("GOCLIENT: ")
+		fmt.Println("Joining the lobby of the leader", n.leaderAddr, n.goConnection.LocalAddr())
+		if gameStart = n.joinLobby(); gameStart == nil {
+			return false
+		}
+		n.lobby.over.Store(true)
+		n.closeLobby(n.goConnection)
 	}
-
-	buf, _ := readFromUDP(addressState_goConnection)
-	logClient("Received a game start response from the leader:" + string(buf))
-	fmt.Println("not this one")
-	dat := decodeMessage(buf)["gameStart"].(map[string]interface{})
-	pid, _ := strconv.Atoi(dat["pid"].(string))
-	gameState_MyPid = pid
-	addresses := dat["addresses"].(map[string]interface{})
-	for addr, pid := range addresses {
+	n.logClient("Received a game start response from the leader:" + string(encodeMessage(gameStart)))
+	pid, _ := strconv.Atoi(gameStart.Pid)
+	n.MyPid = pid
+	n.leaderPid = gameStart.Leader
+	n.SessionToken = gameStart.Token
+	n.GroupKey = gameStart.GroupKey
+	n.auth.leaderKnowsMyKey = true
+	n.LeaderID = gameStart.Term
+	n.Term = max(n.Term, gameStart.Term)
+	n.Succession = gameStart.Succession
+	if n.encrypting() {
+		n.GameKey = gameStart.GameKey
+		if err := n.keys.setGameKey(n.GameKey); err != nil {
+			n.logClient("The leader didn't give us a usable game key: " + err.Error())
+		}
+	}
+	n.logClient("If you lose your connection, rejoin with -rejoin " + gameStart.Pid + ":" + gameStart.Token)
+	if _, watching := gameStart.Spectators[gameStart.Pid]; watching {
+		n.logClient("We are only watching the game")
+	}
+	n.Lockstep = gameStart.Lockstep
+	n.Encoding = gameStart.Encoding
+	if n.Encoding == "" {
+		n.Encoding = JSON_ENCODING
+	}
+	// the starting positions are the moves of the first round
+	n.applyMoves(Moves{Moves: []map[string]Move{gameStart.StartingPositions}, Round: 1})
+	for addr, pid := range gameStart.Addresses {
 		raddr, err := net.ResolveUDPAddr("udp", addr)
-		checkError(err)
-		gameState_AddrToPid[addr] = pid.(string)
-		gameState_AddrToAddr[addr] = raddr
-		gameState_Alive[pid.(string)] = true
+		if err != nil {
+			n.logClient("Ignoring bad address " + addr + " for player " + pid)
+			continue
+		}
+		n.AddrToPid[addr] = pid
+		n.AddrToAddr[addr] = raddr
+		if _, watching := gameStart.Spectators[pid]; !watching {
+			n.Alive[pid] = true
+		}
+	}
+	for pid, nickname := range gameStart.Spectators {
+		n.Spectators[pid] = nickname
 	}
-	addressState_recvChan <- buf
+	for pid, nickname := range gameStart.Nicknames {
+		n.PidToNickname[pid] = nickname
+	}
+	n.initMembers()
+	n.saveTerm()
+	n.recvChan.Put(gameStart)
+	return true
 }
 
-func initializeJavaConnection() {
-	logJava("Trying to connect to java on " + addressState_javaAddr)
-	conn, err := net.Dial("tcp", addressState_javaAddr)
-	addressState_connBuf = bufio.NewReader(conn)
-	checkError(err)
-	if addressState_isLeader {
-		str, err := addressState_connBuf.ReadString('\n')
+func (n *Node) initializeJavaConnection() bool {
+	conn := n.javaConnection
+	if conn == nil {
+		// unless we already did to look for a lobby, see discovery.go
+		n.logJava("Trying to connect to java on " + n.javaAddr)
+		var err error
+		conn, err = net.Dial("tcp", n.javaAddr)
 		checkError(err)
-		logJava("Received a start game message from java: " + str)
-		addressState_sendChan <- []byte(str)
-	}
-	logJava("Waiting for the go message to send to java")
-	reply := <-addressState_recvChan
-	logJava("reply " + string(reply))
-	conn.Write(append(reply, '\n'))
-	logJava("Wrote game start message to java. Lobby phase over, entering main loop")
-	addressState_javaConnection = conn
-}
-
-func initializeGameState() {
-	var err error
-	gameState_LeaderID = 0
-	gameState_Round = 1
-	gameState_GridWidth, err = strconv.Atoi(os.Args[4])
-	checkError(err)
-	gameState_GridHeight, err = strconv.Atoi(os.Args[5])
-	checkError(err)
-	gameState_Nickname = os.Args[6]
-	hash := fnv.New64a()
-	hash.Write([]byte(gameState_Nickname))
-	rand.Seed(time.Now().Unix() + int64(hash.Sum64()))
-	gameState_Positions = make([]map[string]Move, MAX_ALLOWABLE_MISSED_MESSAGES)
-	for i := 0; i < len(gameState_Positions); i++ {
-		gameState_Positions[i] = make(map[string]Move)
-	}
-	gameState_Grid = make([][]int, gameState_GridWidth)
-	for i := 0; i < gameState_GridWidth; i++ {
-		gameState_Grid[i] = make([]int, gameState_GridHeight)
-	}
-	// walls
-	for i := 0; i < gameState_GridHeight; i++ {
-		gameState_Grid[i][0] = -1
-		gameState_Grid[i][gameState_GridHeight-1] = -1
-
-	}
-	for j := 0; j < gameState_GridWidth; j++ {
-		gameState_Grid[0][j] = -1
-		gameState_Grid[gameState_GridWidth-1][j] = -1
-	}
-	gameState_Alive = make(map[string]bool)
-	gameState_Grace = make(map[string]int)
-	gameState_AddrToPid = make(map[string]string)
-	gameState_AddrToAddr = make(map[string]*net.UDPAddr)
-	gameState_PidToNickname = make(map[string]string)
-	gameState_DroppedForever = make(map[string]bool)
-
-	isLeader, err := strconv.ParseBool(os.Args[3])
-	checkError(err)
+		n.connBuf = bufio.NewReader(conn)
+	}
+	n.javaConnection = conn
+	n.clock.Go(n.readFrontend)
+	n.logJava("Waiting for the go message to send to java")
+	for {
+		reply, _ := n.recvChan.Get()
+		n.logJava("reply " + string(encodeMessage(reply)))
+		conn.Write(append(encodeMessage(reply), '\n'))
+		switch reply.(type) {
+		case *GameStartMessage:
+			n.logJava("Wrote game start message to java. Lobby phase over, entering main loop")
+			return true
+		case *RejectMessage:
+			n.logJava("The leader turned us away, goodbye")
+			return false
+		}
+	}
+}
 
-	addressState_javaAddr = "localhost:" + os.Args[1]
-	addressState_leaderAddr = os.Args[2]
-	addressState_isLeader = isLeader
-	addressState_sendChan = make(chan []byte, 1)
-	addressState_recvChan = make(chan []byte, 1)
+// readFrontend reads everything the java frontend sends us: its ready and start go to
+// the lobby, anything else answers a round start.
+func (n *Node) readFrontend() {
+	for {
+		line, err := n.connBuf.ReadString('\n')
+		if err != nil {
+			n.logJava("Lost the java frontend: " + err.Error())
+			if !n.lobby.over.Load() {
+				// nobody is there to play the game we are waiting for
+				os.Exit(0)
+			}
+			n.javaMoves.Close()
+			return
+		}
+		if kick, ok := decodeKickCommand([]byte(line)); ok {
+			n.logJava("Received a kick for " + kick.Player + " from java")
+			n.moderate(kick)
+			continue
+		}
+		if command, ok := decodeLobbyCommand([]byte(line)); ok {
+			n.logJava("Received a " + command.header().MessageType + " from java")
+			n.lobbyChan.Put(command)
+			continue
+		}
+		n.javaMoves.Put(line)
+	}
+}
+
+func (n *Node) initializeGameState() {
+	n.LeaderID = 0
+	n.Round = 1
+	n.Positions = make([]map[string]Move, n.config.MaxAllowableMissedMessages)
+	for i := 0; i < len(n.Positions); i++ {
+		n.Positions[i] = make(map[string]Move)
+	}
+	n.Grid = make([][]int, n.GridWidth)
+	for i := 0; i < n.GridWidth; i++ {
+		n.Grid[i] = make([]int, n.GridHeight)
+	}
+	// walls, the grid is indexed by x then y
+	for x := 0; x < n.GridWidth; x++ {
+		n.Grid[x][0] = -1
+		n.Grid[x][n.GridHeight-1] = -1
+	}
+	for y := 0; y < n.GridHeight; y++ {
+		n.Grid[0][y] = -1
+		n.Grid[n.GridWidth-1][y] = -1
+	}
+	n.Alive = make(map[string]bool)
+	n.Grace = make(map[string]int)
+	n.AddrToPid = make(map[string]string)
+	n.AddrToAddr = make(map[string]*net.UDPAddr)
+	n.PidToNickname = make(map[string]string)
+	n.Spectators = make(map[string]string)
+	n.DroppedForever = make(map[string]bool)
+	n.Left = make(map[string]string)
+
+	n.sendChan = n.clock.NewMailbox()
+	n.recvChan = n.clock.NewMailbox()
+	n.lobbyChan = n.clock.NewMailbox()
+	n.javaMoves = n.clock.NewMailbox()
 
 	//@dump
 }
 
-func initializePerformanceMetrics() {
-	if !METRICS {
+func (n *Node) initializePerformanceMetrics() {
+	if !n.config.Metrics {
 		return
 	}
-	latencyFile, err := os.Create(ROUND_LATENCY_FILENAME)
+	latencyFile, err := os.Create(n.config.RoundLatencyFilename)
 	checkError(err)
 	defer latencyFile.Close()
 
-	readFile, err := os.Create(READ_THROUGHPUT_FILENAME)
+	readFile, err := os.Create(n.config.ReadThroughputFilename)
 	checkError(err)
 	defer readFile.Close()
 
-	writeFile, err := os.Create(WRITE_THROUGHPUT_FILENAME)
+	writeFile, err := os.Create(n.config.WriteThroughputFilename)
+	checkError(err)
 	defer writeFile.Close()
 
-	lastTime = time.Now()
+	n.lastTime = n.clock.Now()
 }
 
 /*
 * CHECK FUNCTIONS
  */
-func isAi() bool {
-	return addressState_javaAddr == addressState_LocalIP + ":" || len(os.Args) == 8
+func (n *Node) isAi() bool {
+	return n.ai
 }
 
-func gameOver() bool {
-	if DISABLE_GAME_OVER {
+func (n *Node) gameOver() bool {
+	if n.config.DisableGameOver {
 		return false
 	}
 
-	numDeadToEnd := len(gameState_Alive) - 1
+	numDeadToEnd := len(n.Alive) - 1
 	//numDeadToEnd := 1 // for metric debugging
-	logLeader("There are " + strconv.Itoa(len(gameState_Finish)) + " dead players and we require at least " +
+	n.logLeader("There are " + strconv.Itoa(len(n.Finish)) + " dead players and we require at least " +
 		strconv.Itoa(numDeadToEnd) + " dead players to call it a game")
-	return len(gameState_Finish) >= numDeadToEnd
+	return len(n.Finish) >= numDeadToEnd
 }
 
-func resetGracePeriod(pid string) {
-	gameState_Grace[pid] = 0
+func (n *Node) resetGracePeriod(pid string) {
+	n.Grace[pid] = 0
 }
 
-func countGracePeriod(pid string) {
-	if !gameState_DroppedForever[pid] {
-		gameState_Grace[pid] += 1
-		logLeader("Player " + pid + " grace period = " + strconv.Itoa(gameState_Grace[pid]))
-		if gameState_Grace[pid] >= MAX_ALLOWABLE_MISSED_MESSAGES {
-			logLeader("Grace period for player " + pid + " exceeded. Force dropping them")
-			dropPlayer(pid)
+func (n *Node) countGracePeriod(pid string) {
+	if !n.DroppedForever[pid] {
+		n.Grace[pid] += 1
+		n.logLeader("Player " + pid + " grace period = " + strconv.Itoa(n.Grace[pid]))
+		if n.Grace[pid] >= n.config.MaxAllowableMissedMessages && !n.heartbeatsFine(pid) {
+			n.logLeader("Grace period for player " + pid + " exceeded. Force dropping them")
+			n.dropPlayer(pid)
 		}
 	}
 }
 
-//TODO Those functions are pointless and completely stupid. We have a function to get the message type
-func isJoinMessage(buf []byte) bool {
-	//return getMessageType(message) == "join"
-	return strings.Contains(strings.TrimSpace(string(buf)), "JOIN")
-}
-
-func isStartMessage(buf []byte) bool {
-	//return getMessageType(message) == "start"
-	return strings.TrimSpace(string(buf)) == "START"
-}
-
 /*
 * UTILITY FUNCTIONS
  */
@@ -703,60 +1015,134 @@ func isStartMessage(buf []byte) bool {
 func checkError(err error) {
 	if err != nil {
 		debug.PrintStack()
-		fmt.Fprintf(os.Stderr, "Error ", err.Error())
+		fmt.Fprintf(os.Stderr, "Error %s\n", err.Error())
 		os.Exit(1)
 	}
 }
 
 // Slight difference from killing player; we owe no obligation to respond to dropped players,
-// but we should respond to killed players that are still connected.
-func dropPlayer(pid string) {
-	logLeader("dropping player " + pid)
-	gameState_DroppedForever[pid] = true
-	killPlayer(pid)
-}
-
-func killPlayer(pid string) {
-	if gameState_Alive[pid] {
-		logLeader("killing player " + pid)
-		gameState_Alive[pid] = false
-		gameState_Finish = append(gameState_Finish, pid)
+// but we should respond to killed players that are still connected. A dropped player's
+// cycle keeps going straight until it crashes, so it can take over again if it rejoins.
+func (n *Node) dropPlayer(pid string) {
+	n.logLeader("dropping player " + pid)
+	n.DroppedForever[pid] = true
+	n.markMember(pid, MemberDropped)
+	n.Succession = withoutPid(n.Succession, pid)
+}
+
+func (n *Node) killPlayer(pid string) {
+	if n.Alive[pid] {
+		n.logLeader("killing player " + pid)
+		n.Alive[pid] = false
+		// the winner is already in the order, dropping it after the game doesn't add it twice
+		if !n.finished(pid) {
+			n.Finish = append(n.Finish, pid)
+		}
 	}
-	if gameOver() {
-		for pid, alive := range gameState_Alive {
-			if alive {
-				gameState_Finish = append(gameState_Finish, pid)
-				logLeader("Player " + pid + " is the winner! Congrats!")
+	if n.gameOver() {
+		for _, pid := range n.playerPids() {
+			if n.Alive[pid] && !n.finished(pid) {
+				n.Finish = append(n.Finish, pid)
+				n.logLeader("Player " + pid + " is the winner! Congrats!")
 			}
 		}
 	}
 }
 
-func getCurrentMoveMap() map[string]Move {
-	return gameState_Positions[len(gameState_Positions)-1]
+func (n *Node) finished(pid string) bool {
+	for _, other := range n.Finish {
+		if other == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) getCurrentMoveMap() map[string]Move {
+	return n.Positions[len(n.Positions)-1]
 }
 
-func getLeaderMoveMap() map[string]Move {
-	return leaderState.Positions[len(leaderState.Positions)-1]
+func (n *Node) getLeaderMoveMap() map[string]Move {
+	return n.leaderState.Positions[len(n.leaderState.Positions)-1]
 }
 
-func slideWindow() {
+func (n *Node) slideWindow() {
 	// push everything back
-	for i := 0; i < len(leaderState.Positions)-1; i++ {
-		leaderState.Positions[i] = leaderState.Positions[i+1]
+	for i := 0; i < len(n.leaderState.Positions)-1; i++ {
+		n.leaderState.Positions[i] = n.leaderState.Positions[i+1]
 	}
 	// clear final move
-	leaderState.Positions[len(leaderState.Positions)-1] = make(map[string]Move)
+	n.leaderState.Positions[len(n.leaderState.Positions)-1] = make(map[string]Move)
 }
 
-//TODO Change this name
-func addContinuedMove(pid string) {
+// The leader sends the moves of the last rounds up to moves.Round. Put them in our window,
+// sliding it along if they are newer than anything we have. It returns false if there
+// is a gap between these moves and the ones we had.
+func (n *Node) applyMoves(moves Moves) bool {
+	first := moves.Round - len(moves.Moves) + 1
+	complete := first <= n.AckedRound+1
+	if complete {
+		n.AckedRound = max(n.AckedRound, moves.Round)
+	} else {
+		n.logClient("Missed the moves of rounds " + strconv.Itoa(n.AckedRound+1) + " to " + strconv.Itoa(first-1))
+	}
+	if slide := moves.Round - n.MovesRound; slide > 0 {
+		for i := range n.Positions {
+			if i+slide < len(n.Positions) {
+				n.Positions[i] = n.Positions[i+slide]
+			} else {
+				n.Positions[i] = make(map[string]Move)
+			}
+		}
+		n.MovesRound = moves.Round
+	}
+	for i, roundMoves := range moves.Moves {
+		index := len(n.Positions) - 1 - (n.MovesRound - (first + i))
+		if index < 0 {
+			continue
+		}
+		positions := n.Positions[index]
+		for pid, move := range roundMoves {
+			if !n.onGrid(move.X, move.Y) {
+				n.logClient("Ignoring move off the grid for player " + pid)
+				continue
+			}
+			positions[pid] = move
+			// If you are the leader, you should probably not do this board update (shared state between the leader and client always gets us in to trouble...)
+			if !n.isLeader {
+				n.Grid[move.X][move.Y], _ = strconv.Atoi(pid)
+			}
+		}
+	}
+	return complete
+}
+
+// TODO Change this name
+func (n *Node) addContinuedMove(pid string) {
 	fmt.Println("adding continued move")
-	prevMove := leaderState.Positions[len(leaderState.Positions)-2][pid]
-	makeMove(prevMove.Direction, pid)
+	prevMove, known := n.lastMove(pid)
+	if !known {
+		n.logLeader("Don't know where player " + pid + " is going, not moving them")
+		if n.DroppedForever[pid] {
+			// nobody will ever move it again, so it would never crash
+			n.killPlayer(pid)
+		}
+		return
+	}
+	n.makeMove(prevMove.Direction, pid)
+}
+
+// lastMove is the newest move of pid before this round, however many rounds ago that was.
+func (n *Node) lastMove(pid string) (Move, bool) {
+	for i := len(n.leaderState.Positions) - 2; i >= 0; i-- {
+		if move, ok := n.leaderState.Positions[i][pid]; ok {
+			return move, true
+		}
+	}
+	return Move{}, false
 }
 
-func createContinuedMove(direction string, prevMove Move) Move {
+func (n *Node) createContinuedMove(direction string, prevMove Move) Move {
 	nextMove := Move{
 		Direction: direction,
 		X:         prevMove.X,
@@ -766,11 +1152,11 @@ func createContinuedMove(direction string, prevMove Move) Move {
 	case "DOWN":
 		nextMove.Y = max(0, nextMove.Y-1)
 	case "UP":
-		nextMove.Y = min(gameState_GridHeight-1, nextMove.Y+1)
+		nextMove.Y = min(n.GridHeight-1, nextMove.Y+1)
 	case "LEFT":
 		nextMove.X = max(0, nextMove.X-1)
 	case "RIGHT":
-		nextMove.X = min(gameState_GridWidth-1, nextMove.X+1)
+		nextMove.X = min(n.GridWidth-1, nextMove.X+1)
 	default:
 		panic("Next move direction unknown")
 	}
@@ -779,74 +1165,85 @@ func createContinuedMove(direction string, prevMove Move) Move {
 
 // Attempt to move the player pid one space in given direction. If movement
 // results in collision, the player dies.
-func makeMove(direction string, pid string) Move {
-	prevMove := leaderState.Positions[len(leaderState.Positions)-2][pid]
+func (n *Node) makeMove(direction string, pid string) Move {
+	prevMove, known := n.lastMove(pid)
+	if !known {
+		// nowhere to move from, and a made up position would put the player back on the grid
+		n.logLeader("No earlier move of player " + pid + " in the window, ignoring its move")
+		return prevMove
+	}
 	fmt.Println("Make move", direction, pid, prevMove)
 	var nextMove Move
-	if gameState_Alive[pid] {
-		nextMove = createContinuedMove(direction, prevMove)
-		if isCollision(nextMove.X, nextMove.Y) {
-
-			message := KillPlayerMessage{
-				MessageType: "killplayer",
-				EventName:   "killplayer",
-				PlayerPID:   pid,
-				Round:       gameState_Round,
+	if n.Alive[pid] {
+		nextMove = n.createContinuedMove(direction, prevMove)
+		if n.isCollision(nextMove.X, nextMove.Y) {
+
+			message := &KillPlayerMessage{
+				Envelope: Envelope{
+					MessageType: "killplayer",
+					EventName:   "killplayer",
+					Round:       n.Round,
+					Term:        n.leaderState.Term,
+				},
+				PlayerPID: pid,
 			}
-			broadcastMessage(leaderState.leaderConnection, encodeMessage(message))
+			n.broadcastMessage(n.leaderState.leaderConnection, message)
 			nextMove = prevMove
 		} else {
-			gameState_Grid[nextMove.X][nextMove.Y], _ = strconv.Atoi(pid)
+			n.Grid[nextMove.X][nextMove.Y], _ = strconv.Atoi(pid)
 		}
 	} else { // Player is dead, keep old move.
 		nextMove = prevMove
 	}
 	fmt.Println("done")
 	fmt.Println(nextMove)
-	fmt.Println(getLeaderMoveMap())
-	getLeaderMoveMap()[pid] = nextMove
-	fmt.Println(getLeaderMoveMap())
+	fmt.Println(n.getLeaderMoveMap())
+	n.getLeaderMoveMap()[pid] = nextMove
+	fmt.Println(n.getLeaderMoveMap())
 	return nextMove
 }
 
-func surviveFollowerResponseInjectedFailure(pid string) bool {
-	if val, ok := FOLLOWER_RESPONSE_FAIL_RATE[pid]; ok {
-		p := randomInt(0, 1000)
-		return p >= val
-	}
-	return true
+// files packets from followers under their pid, for FollowerResponseFailRate
+func (n *Node) pidOfPacket(p *Packet) string {
+	return n.AddrToPid[p.From]
 }
 
-func updateGracePeriod() {
+func (n *Node) updateGracePeriod() {
+	n.dropSuspects()
 	// count missed messages for those who did not respond, or reset
-	for pid, alive := range gameState_Alive {
-		_, responded := getLeaderMoveMap()[pid]
+	for _, pid := range n.playerPids() {
+		alive := n.Alive[pid]
+		_, responded := n.getLeaderMoveMap()[pid]
 		if responded {
-			resetGracePeriod(pid)
+			n.resetGracePeriod(pid)
 		} else {
-			countGracePeriod(pid)
+			n.countGracePeriod(pid)
 			if alive {
-				addContinuedMove(pid)
+				n.addContinuedMove(pid)
 			}
 		}
 	}
 }
 
-func timeToRespond() bool {
-	recvCount := len(getLeaderMoveMap())
-	totalNeeded := len(gameState_AddrToPid) - len(gameState_DroppedForever)
-	logLeader("received " + strconv.Itoa(recvCount) + "/" + strconv.Itoa(totalNeeded) + " messages")
+func (n *Node) timeToRespond() bool {
+	recvCount := len(n.getLeaderMoveMap())
+	totalNeeded := n.playersToHear()
+	n.logLeader("received " + strconv.Itoa(recvCount) + "/" + strconv.Itoa(totalNeeded) + " messages")
 	return recvCount == totalNeeded
 }
 
-func isCollision(x, y int) bool {
-	if !COLLISION_IS_DEATH {
+func (n *Node) onGrid(x, y int) bool {
+	return (0 <= x && x < n.GridWidth) && (0 <= y && y < n.GridHeight)
+}
+
+func (n *Node) isCollision(x, y int) bool {
+	if !n.config.CollisionIsDeath {
 		return false
-	} else if (0 <= x && x < gameState_GridWidth) && (0 <= y && y < gameState_GridHeight) {
-		if gameState_Grid[x][y] != 0 {
-			fmt.Println("                      collision at", x, y, gameState_Grid[x][y])
+	} else if n.onGrid(x, y) {
+		if n.Grid[x][y] != 0 {
+			fmt.Println("                      collision at", x, y, n.Grid[x][y])
 		}
-		return gameState_Grid[x][y] != 0
+		return n.Grid[x][y] != 0
 	} else {
 		fmt.Println("                      collision out of bound")
 		return true
@@ -857,373 +1254,493 @@ func isCollision(x, y int) bool {
 * MAIN FUNCTIONS
  */
 func main() {
+	config, err := ParseConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	host, _ := os.Hostname()
-	addrs, _ := net.LookupIP(host)
-
-	gameState_Nickname = os.Args[6]
-	name := "server-" + gameState_Nickname
-	Logger = govec.Initialize(name, name + ".log")
-	//@dump	
-
-	initializePerformanceMetrics()
-	initializeGameState()
-
-	for _, addr := range addrs {
-		if ipv4 := addr.To4(); ipv4 != nil {
-			addressState_LocalIP = ipv4.String()
-			break
+	if config.Simulate > 0 {
+		sim := NewSimulation(config.Seed, config.Simulate, config)
+		for _, result := range sim.Run(time.Hour) {
+			fmt.Println(result)
 		}
+		return
 	}
-	if addressState_LocalIP == "" {
-		panic("No open ipv4 interface")
+
+	localIP := lookupLocalIP()
+	if localIP == "" {
+		fmt.Fprintln(os.Stderr, "No open ipv4 interface")
+		os.Exit(1)
 	}
+
+	node := NewNode(append(config.Options(), WithLocalIP(localIP))...)
+	//@dump
+
+	node.initializePerformanceMetrics()
 	fmt.Println("Go process started")
-	if FOLLOWER_RESPONSE_TIME < MIN_GAME_SPEED {
-		panic("Can't set response time to be less than min game speed")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		node.Quit(sig.String())
+		fmt.Println("GOODBYE")
+		os.Exit(0)
+	}()
+
+	if config.Admin {
+		go node.adminConsole(os.Stdin)
 	}
-	if len(os.Args) < 7 {
-		panic("RTFM")
+	if config.Discover {
+		node.discover()
 	}
+	node.Run()
 
+	fmt.Println("GOODBYE")
+}
 
-
-	if addressState_isLeader {
-		go func() {
-			initializeLeader(addressState_leaderAddr)
-			logLeader("Leader has started")
-			initLobby()
-			go leaderListener()
-		}()
+func lookupLocalIP() string {
+	host, _ := os.Hostname()
+	addrs, _ := net.LookupIP(host)
+	for _, addr := range addrs {
+		if ipv4 := addr.To4(); ipv4 != nil {
+			return ipv4.String()
+		}
+	}
+	return ""
+}
+
+// Run plays one match on this node, hosting the lobby first if it is the leader.
+// It returns once the game is over.
+func (n *Node) Run() {
+	if n.isLeader {
+		n.electionState = LEADER
+		n.clock.Go(func() {
+			n.initializeLeader(n.leaderAddr)
+			n.logLeader("Leader has started")
+			n.initLobby()
+			if n.Lockstep {
+				n.logLeader("Nobody leads a lockstep game, closing the lobby")
+				n.leaderState.leaderConnection.Close()
+				return
+			}
+			n.clock.Go(n.leaderListener)
+		})
 		//TODO i'm pretty sure there's a better way than that
-		time.Sleep(100 * time.Millisecond) // stupid hack to make sure the leader is up before the client
+		n.clock.Sleep(100 * time.Millisecond) // stupid hack to make sure the leader is up before the client
 	}
 
-	goClient()
-	
-	fmt.Println("GOODBYE")
+	n.goClient()
 }
 
 /*
 * Routines
  */
-func leaderListener() {
-	defer leaderState.leaderConnection.Close()
-	var roundMoves MovesMessage
+func (n *Node) leaderListener() {
+	defer n.leaderState.leaderConnection.Close()
 	var timeoutTimeForRound time.Time
 	for {
-		roundMoves = newRound(leaderState.leaderConnection)
-		fmt.Println("newRoundMoves", roundMoves)
-		timeoutTimeForRound = time.Now().Add(FOLLOWER_RESPONSE_TIME)
+		if n.steppedDown() {
+			return
+		}
+		n.newRound(n.leaderState.leaderConnection)
+		timeoutTimeForRound = n.clock.Now().Add(n.config.FollowerResponseTime)
 		for {
-			logLeader("Waiting to receive message from follower...")
-			buf, _, timedout := readFromUDPWithTimeout(leaderState.leaderConnection, timeoutTimeForRound)
+			n.pingPlayers()
+			n.logLeader("Waiting to receive message from follower...")
+			buf, raddr, timedout := n.readFromUDPWithTimeout(n.leaderState.leaderConnection, n.leaderWakeup(timeoutTimeForRound))
 			if timedout {
+				if n.clock.Now().Before(timeoutTimeForRound) {
+					continue
+				}
 				break
 			}
-			direction, pid, round := parseMessage(buf)
-			if round == gameState_Round && !gameState_DroppedForever[pid] {
-				if surviveFollowerResponseInjectedFailure(pid) {
-					logLeader("Received move message " + " from player " + pid)
-					fmt.Println(leaderState.Positions)
-					move := makeMove(direction, pid)
-					fmt.Println("Registered move ", move)
-					if timeToRespond() {
-						break
-					}
+			message, sender, err := n.openFromPlayer(buf, raddr)
+			if err == errUnsigned && n.turnAwayLate(buf, raddr) {
+				continue
+			}
+			if err != nil {
+				n.logLeader("Ignoring message: " + err.Error())
+				continue
+			}
+			if _, ok := message.(*RejoinMessage); ok {
+				n.rejoinPlayer(sender, raddr)
+				continue
+			}
+			if heartbeat, ok := message.(*HeartbeatMessage); ok {
+				n.playerHeartbeat(heartbeat, sender, raddr)
+				continue
+			}
+			if leave, ok := message.(*LeaveMessage); ok {
+				n.playerLeft(sender, leave.Reason)
+				continue
+			}
+			if kick, ok := message.(*KickMessage); ok {
+				n.kickFromGame(kick.Kick, sender)
+				continue
+			}
+			if report, ok := message.(*StateReportMessage); ok {
+				// a player re-keying with us after a handoff that didn't carry its token
+				if _, known := n.leaderState.Tokens[sender]; !known && report.Token != "" && !n.revoked(sender) {
+					n.logLeader("Player " + sender + " told us its session token")
+					n.leaderState.Tokens[sender] = report.Token
+				}
+				continue
+			}
+			if _, ok := message.(*ResyncMessage); ok {
+				n.logLeader("Player " + sender + " asked for a snapshot, it will get one at the end of the round")
+				n.leaderState.Resync[sender] = true
+				continue
+			}
+			move, ok := message.(*MyMoveMessage)
+			if !ok {
+				n.logLeader("Ignoring a " + message.header().MessageType + " message, only moves go to the leader")
+				continue
+			}
+			direction, pid, round := move.Direction, move.Pid, move.Envelope.Round
+			n.logLeader("parsed message: player " + pid + " is going in direction " + direction + " on round " + strconv.Itoa(round))
+			if _, known := n.Alive[pid]; !known {
+				n.logLeader("Ignoring a move message from unknown player " + pid)
+				continue
+			}
+			if move.Ack > n.leaderState.Acks[pid] && move.Ack < n.Round {
+				n.leaderState.Acks[pid] = move.Ack
+			}
+			if _, moved := n.getLeaderMoveMap()[pid]; moved && round == n.Round {
+				n.logLeader("Ignoring a second move message from player " + pid + " this round")
+				continue
+			}
+			if round == n.Round && !n.DroppedForever[pid] {
+				n.logLeader("Received move message " + " from player " + pid)
+				fmt.Println(n.leaderState.Positions)
+				nextMove := n.makeMove(direction, pid)
+				fmt.Println("Registered move ", nextMove)
+				if n.timeToRespond() {
+					break
 				}
 			} else {
-				logLeader("Received a move message from " + pid + " from an old round " +
+				n.logLeader("Received a move message from " + pid + " from an old round " +
 					strconv.Itoa(round) + " but current round is " +
-					strconv.Itoa(gameState_Round) + ". Ignoring message")
+					strconv.Itoa(n.Round) + ". Ignoring message")
 			}
 		}
-		updateGracePeriod()
-		if gameOver() {
-			logLeader("Broadcasting end of game!")
-			broadcastMessage(leaderState.leaderConnection, encodeMessage(endGameMessage()))
+		// the game we share with our own client is the new leader's now
+		if n.steppedDown() {
+			return
+		}
+		n.updateGracePeriod()
+		if n.gameOver() {
+			n.logLeader("Broadcasting end of game!")
+			n.broadcastMessage(n.leaderState.leaderConnection, n.endGameMessage())
+			return
+		}
+		n.broadcastMoves(n.leaderState.leaderConnection)
+		if n.quitting.Load() && n.handOver() {
 			return
 		}
-		byt := encodeMessage(roundMoves)
-		fmt.Println("roundmvoes", roundMoves)
-		broadcastMessage(leaderState.leaderConnection, byt)
 	}
 }
 
-func goClient() {
-	var bufChan chan []byte
+func (n *Node) goClient() {
 	gameOver := false
 
-	logClient("Starting go client")
-	
-	if isAi() {
-		logClient("I'm an AI player named " + gameState_Nickname)
-		go aiGoConnection()
+	n.logClient("Starting go client")
+
+	if n.isAi() {
+		n.logClient("I'm an AI player named " + n.Nickname)
+		n.clock.Go(n.aiGoConnection)
 	} else {
-		logClient("I'm a normal player named " + gameState_Nickname)
-		go javaGoConnection()
+		n.logClient("I'm a normal player named " + n.Nickname)
+		n.clock.Go(n.javaGoConnection)
 	}
 
-	contactLeader()
-	defer addressState_goConnection.Close()
-	logClient("Waiting for leader to respond with game start details")
+	if !n.contactLeader() {
+		n.goConnection.Close()
+		n.logClient("Closing Client")
+		return
+	}
+	defer n.goConnection.Close()
+	defer n.stopped.Store(true)
+	if n.Lockstep {
+		n.playLockstep()
+		return
+	}
+	n.logClient("Waiting for leader to respond with game start details")
+	if n.heartbeating() {
+		n.clock.Go(n.heartbeats)
+	}
 
+	n.heardFromLeader()
 	for !gameOver {
-		fmt.Println("setitng up timeout", time.Now(), FOLLOWER_RESPONSE_TIME)
-		timeoutTimeForRound := time.Now().Add(FOLLOWER_RESPONSE_TIME)
-		fmt.Println(timeoutTimeForRound)
-		leaderID := gameState_LeaderID
-		buf, raddr, timedout := readFromUDPWithTimeout(addressState_goConnection, timeoutTimeForRound)
+		if n.members.takeChanged() {
+			n.recvChan.Put(n.membersMessage())
+		}
+		n.retryRejoin()
+		buf, raddr, timedout := n.readFromUDPWithTimeout(n.goConnection, n.nextWakeup())
 		if timedout {
-			fmt.Println(time.Now())
-			if leaderID != gameState_LeaderID {
-				fmt.Println("$$$$$$$$$$$$$$$$$$")
+			if n.spectating() {
+				if !n.clock.Now().Before(n.electionDeadline) {
+					// spectators don't stand for election, they wait for someone to win one
+					n.quietElections++
+					n.resetElectionTimer()
+				}
+				if n.gameOver() || n.quietElections >= n.config.MaxAllowableMissedMessages {
+					n.logClient("Nobody has led the game for a while, it must be over. Closing Client")
+					n.recvChan.Put(n.endGameMessage())
+					return
+				}
 				continue
 			}
-			fmt.Println("timedout", gameState_LeaderID, leaderID)
-			if electionState == NORMAL {
-				electionState = QUORUM
-				fmt.Println("new election")
-				bufChan = make(chan []byte, 1)
-				go func() {
-					time.Sleep(FOLLOWER_RESPONSE_TIME)
-					electionState = NORMAL
-					close(bufChan)
-				}()
-				go startElection(bufChan)
+			if !n.clock.Now().Before(n.electionDeadline) {
+				if n.gameOver() || n.quietElections >= n.config.MaxAllowableMissedMessages {
+					// the leader's game over went missing, and everyone else has gone home
+					n.logClient("The leader and everyone else went quiet, the game must be over. Closing Client")
+					n.recvChan.Put(n.endGameMessage())
+					return
+				}
+				// the leader has been quiet for a whole election timeout, or our election went nowhere
+				n.startElection()
+			} else if !n.gameOver() && n.suspectLeader() {
+				n.startElection()
 			}
 			continue
 		}
 		//might be usefull to move it to a separate routine? if it gets slow, that is
-		messageType := getMessageType(buf)
-		switch messageType {
-		case "killplayer":
+		message, err := n.openFromPeer(buf, raddr)
+		if err != nil {
+			n.logClient("Ignoring message: " + err.Error())
+			continue
+		}
+		switch message := message.(type) {
+		case *KillPlayerMessage:
 			//check round rumber?
-			killPlayer(getPID(buf))
-		case "roundstart":
-			logClient("Round start message: " + string(buf))
-			recordRoundLatency()
-
-			gameState_Round = getRoundNumber(buf)
-			addressState_recvChan <- buf
-			message := <-addressState_sendChan
-
-			_, err := addressState_goConnection.WriteToUDP(Logger.PrepareSend("", []byte(message)), addressState_leaderUDPAddr)
-			recordWriteThroughput(len(message))
-			checkError(err)
-			break
-		case "moves":
-			logClient("Moves message: " + string(buf))
-			for index, moves := range getMoves(buf) {
-				positions := gameState_Positions[index]
-				for pid, move := range moves.(map[string]interface{}) {
-					castedMove := move.(map[string]interface{})
-					move := Move{
-						Direction: castedMove["direction"].(string),
-						X:         int(castedMove["x"].(float64)),
-						Y:         int(castedMove["y"].(float64)),
-					}
-					positions[pid] = move
-					// If you are the leader, you should probably not do this board update (shared state between the leader and client always gets us in to trouble...)
-					if !addressState_isLeader {
-						gameState_Grid[move.X][move.Y], _ = strconv.Atoi(pid)
-					}
+			n.killPlayer(message.PlayerPID)
+		case *RoundStartMessage:
+			n.logClient("Round start message: " + string(encodeMessage(message)))
+			n.recordRoundLatency()
+
+			n.Round = message.Envelope.Round
+			if message.Succession != nil {
+				n.Succession = message.Succession
+			}
+			if !n.isLeader {
+				// so we can tell the next leader, if it comes to that
+				n.DroppedForever = make(map[string]bool)
+				for _, pid := range message.Dropped {
+					n.DroppedForever[pid] = true
 				}
 			}
-			addressState_recvChan <- buf
-			break
-		case "gameOver":
+			if n.spectating() {
+				// nobody asks a spectator for a move
+				break
+			}
+			n.recvChan.Put(message)
+			reply, _ := n.sendChan.Get()
+			if reply == nil {
+				// the frontend had nothing sensible to say, the leader will keep us going straight
+				n.predictRound(n.Round, "")
+				break
+			}
+			myMove := reply.(*MyMoveMessage)
+			myMove.Ack = n.AckedRound
+			n.sendToLeader(myMove)
+			n.predictRound(n.Round, myMove.Direction)
+		case *MovesMessage:
+			n.logClient("Moves message: " + string(encodeMessage(message)))
+			if !n.applyMoves(message.Moves) {
+				n.requestResync()
+			} else if !n.isLeader && message.Moves.Round == n.MovesRound && n.divergedRound == 0 {
+				if checksum := n.stateChecksum(); checksum != message.Checksum {
+					n.logClient(fmt.Sprintf("Our state diverged from the leader's on round %d (checksum %08x, the leader's is %08x)",
+						message.Moves.Round, checksum, message.Checksum))
+					n.divergedRound = message.Moves.Round
+					n.requestResync()
+				}
+			}
+			n.recvChan.Put(message)
+			n.rollback()
+		case *SnapshotMessage:
+			if n.applySnapshot(message.Snapshot) {
+				// the frontends only know about moves, so tell them where everyone is now
+				n.recvChan.Put(&MovesMessage{
+					Envelope: Envelope{
+						MessageType: "moves",
+						EventName:   "moves",
+						Round:       message.Snapshot.Round,
+					},
+					Moves: Moves{
+						Moves: []map[string]Move{message.Positions},
+						Round: message.Snapshot.Round,
+					},
+				})
+				n.rollback()
+			}
+		case *GameOverMessage:
 			gameOver = true
-			addressState_recvChan <- buf
-			logClient("Closing Client")
+			// the leader's order is the one that counts, it knows of deaths and drops we may have missed
+			n.Finish = message.PidsInOrderOfDeath
+			n.recvChan.Put(message)
+			n.logClient("Closing Client")
 			return
-		case "newleader":
-			fmt.Println("Notified about new leader", raddr.String())
-			addressState_leaderAddr = raddr.String()
-			initializeLeaderConnection()
-			newLeaderId := getLeaderID(buf)
-			addressState_isLeader = newLeaderId == gameState_LeaderID
-			gameState_LeaderID = newLeaderId
-			electionState = NORMAL
-			break
-		case "checkleader":
-			var message LeaderElectionMessage
-			if gameState_Round > getRoundNumber(buf) || gameState_LeaderID > getLeaderID(buf) {
-				message = LeaderElectionMessage{
-					MessageType: "leaderalive",
-					Round:       gameState_Round,
-					LeaderID:    gameState_LeaderID,
+		case *GameStartMessage:
+			n.logClient("Ignoring a duplicate game start message")
+		case *StepDownMessage:
+			n.receiveStepDown(message)
+		case *HeartbeatMessage:
+			if n.leaderUDPAddr != nil && raddr.String() == n.leaderUDPAddr.String() {
+				n.leaderHeartbeat(message)
+			}
+		case *PlayerLeftMessage:
+			if message.Pid == strconv.Itoa(n.MyPid) && !n.isLeader {
+				n.logClient("The leader removed us from the game: " + message.Reason)
+				n.recvChan.Put(message)
+				n.recvChan.Put(n.endGameMessage())
+				return
+			}
+			n.logClient("Player " + message.Pid + " left: " + message.Reason)
+			n.Left[message.Pid] = message.Reason
+			n.markMember(message.Pid, MemberLeft)
+			if !n.isLeader {
+				n.DroppedForever[message.Pid] = true
+			}
+			n.recvChan.Put(message)
+		case *LeaderElectionMessage:
+			switch message.MessageType {
+			case "newleader":
+				if message.LeaderID < n.Term || message.Address == "" {
+					n.logClient("Ignoring the leader of term " + strconv.Itoa(message.LeaderID) + ", we are in term " + strconv.Itoa(n.Term))
+					break
 				}
-			} else {
-				pid, _ := strconv.Atoi(gameState_AddrToPid[raddr.String()])
-				if electionState == QUORUM && pid < gameState_MyPid {
-					electionState = NORMAL
-					close(bufChan)
+				changed := n.LeaderID != message.LeaderID || n.leaderAddr != message.Address
+				n.followLeader(message.LeaderID, message.Address, n.AddrToPid[raddr.String()])
+				// a successor that was handed the game has our state already, and our token if
+				// the game is encrypted, and spectators have none
+				if changed && !n.isLeader && (message.LeaderID != n.handoffTerm || n.keys == nil) && !n.spectating() {
+					n.reportState()
 				}
-				message = LeaderElectionMessage{
-					MessageType: "leaderdead",
-					Round:       gameState_Round,
-					LeaderID:    gameState_LeaderID,
+			case "checkleader":
+				if n.spectating() {
+					break
 				}
+				reply := n.vote(message, n.AddrToPid[raddr.String()])
+				n.attachGossip(reply)
+				byt := n.sign(n.encode(reply), 0)
+				n.logLeader("Sent message " + string(encodeMessage(reply)))
+				_, err := n.goConnection.WriteTo(n.Logger.PrepareSend("", byt), raddr)
+				n.recordWriteThroughput(len(byt))
+				if err != nil {
+					// the candidate asks again if it still needs our vote
+					n.logClient("Failed to send our vote to " + raddr.String() + ": " + err.Error())
+				}
+			case "leaderalive", "leaderdead":
+				if n.spectating() {
+					break
+				}
+				n.receiveVote(message, n.AddrToPid[raddr.String()])
 			}
-			byt := encodeMessage(message)
-			logLeader("Sent message " + string(byt))
-			_, err := addressState_goConnection.WriteToUDP(Logger.PrepareSend("", byt), raddr)
-			recordWriteThroughput(len(byt))
-			checkError(err)
-			break
-		case "leaderalive", "leaderdead":
-			if gameState_LeaderID >= getLeaderID(buf) {
-				bufChan <- buf
-			}
-			break
 		default:
-			panic("Cannot understand message type: " + messageType)
+			n.logClient("Ignoring a " + message.header().MessageType + " message, the leader gets those")
 		}
 	}
-	logClient("Closing Client")
+	n.logClient("Closing Client")
 }
 
-func javaGoConnection() {
-	initializeJavaConnection()
-	defer addressState_javaConnection.Close()
+func (n *Node) javaGoConnection() {
+	if !n.initializeJavaConnection() {
+		n.javaConnection.Close()
+		return
+	}
+	defer n.javaConnection.Close()
 	for {
-		message := <-addressState_recvChan
-		messageType := getMessageType(message)
-		logJava("Sending a " + messageType + " message to java:" + string(message))
-		switch messageType {
-		case "roundstart":
-			addressState_javaConnection.Write(append(message, '\n'))
+		received, _ := n.recvChan.Get()
+		message := received.(Message)
+		messageType := message.header().MessageType
+		buf := encodeMessage(message)
+		n.logJava("Sending a " + messageType + " message to java:" + string(buf))
+		switch message.(type) {
+		case *RoundStartMessage:
+			n.javaConnection.Write(append(buf, '\n'))
 			// read some reply from the java game (update of move, or death)
-			time.Sleep(MIN_GAME_SPEED)
-			status, err := addressState_connBuf.ReadString('\n')
-			checkError(err)
-			logJava("Received from java " + status)
-			addressState_sendChan <- []byte(status)
-			break
-		case "moves":
-			addressState_javaConnection.Write(append(message, '\n'))
-			break
-		case "gameOver":
-			addressState_javaConnection.Write(append(message, '\n'))
-			logJava("A Game Over was sent to java. My work here is done. Goodbye")
+			n.clock.Sleep(n.config.MinGameSpeed)
+			line, ok := n.javaMoves.Get()
+			if !ok {
+				// the player closed the game
+				n.Quit("closed the game")
+				os.Exit(0)
+			}
+			status := line.(string)
+			n.logJava("Received from java " + status)
+			move, err := decodeFrontendMove([]byte(status))
+			if err != nil {
+				n.logJava(err.Error())
+				n.sendChan.Put(nil)
+				break
+			}
+			n.sendChan.Put(move)
+		case *MovesMessage, *PlayerLeftMessage, *MembersMessage, *PredictionMessage:
+			n.javaConnection.Write(append(buf, '\n'))
+		case *GameOverMessage:
+			n.javaConnection.Write(append(buf, '\n'))
+			n.logJava("A Game Over was sent to java. My work here is done. Goodbye")
 			return
 		default:
-			panic("Message to send to java not recognized: " + messageType)
+			n.logJava("Not sending a " + messageType + " message to java, it doesn't know about those")
 		}
 	}
-	fmt.Println("Java connection closed")
 }
 
-func aiGoConnection() {
-	_ = <-addressState_recvChan // drain the first message with the starting positions. We aren't sophisticated enough right now
-	directionShuffleOrder := rand.Perm(len(DIRECTIONS))
+func (n *Node) aiGoConnection() {
+	if !n.config.Spectate {
+		n.lobbyChan.Put(&ReadyMessage{Envelope: lobbyEnvelope("ready"), Ready: true})
+	}
+	if n.isLeader {
+		// nobody is there to press start, so give the other players a moment to join
+		n.clock.Sleep(n.config.AIStartDelay)
+		n.lobbyChan.Put(&StartMessage{Envelope: lobbyEnvelope("start")})
+	}
+	// drain the lobby up to the starting positions. We aren't sophisticated enough right now
 	for {
-		message := <-addressState_recvChan
-		messageType := getMessageType(message)
-		switch messageType {
-		case "roundstart":
-			time.Sleep(MIN_GAME_SPEED)
+		message, _ := n.recvChan.Get()
+		if _, rejected := message.(*RejectMessage); rejected {
+			return
+		} else if _, started := message.(*GameStartMessage); started {
+			break
+		}
+	}
+	directionShuffleOrder := n.rng.Perm(len(DIRECTIONS))
+	for {
+		message, _ := n.recvChan.Get()
+		switch message.(type) {
+		case *RoundStartMessage:
+			n.clock.Sleep(n.config.MinGameSpeed)
 
 			// all AI goes here
 			// Pick a random permutation of the directions ever X moves. Try each direction in order, and pick the first that doesn't give you a collision.
-			direction := randomDir()
-			prevMove := getCurrentMoveMap()[strconv.Itoa(gameState_MyPid)]
-			if gameState_Round%30 == 0 {
+			direction := n.randomDir()
+			prevMove := n.getCurrentMoveMap()[strconv.Itoa(n.MyPid)]
+			if n.Round%30 == 0 {
 				// reshuffle every x moves
-				directionShuffleOrder = rand.Perm(len(DIRECTIONS))
+				directionShuffleOrder = n.rng.Perm(len(DIRECTIONS))
 			}
 			for i := 0; i < len(DIRECTIONS); i++ {
 				dir := DIRECTIONS[directionShuffleOrder[i]]
-				move := createContinuedMove(dir, prevMove)
-				if !isCollision(move.X, move.Y) {
+				move := n.createContinuedMove(dir, prevMove)
+				if !n.isCollision(move.X, move.Y) {
 					direction = dir
 					break
 				}
 			}
 
-			log("AI DECIDED TO MOVE: " + direction)
-			move := map[string]interface{}{"eventName": "myMove", "direction": direction, "pid": strconv.Itoa(gameState_MyPid), "round": gameState_Round}
-			addressState_sendChan <- []byte(encodeMessage(move))
-			break
-		case "moves":
+			n.log("AI DECIDED TO MOVE: " + direction)
+			n.sendChan.Put(newMyMoveMessage(direction, strconv.Itoa(n.MyPid), n.Round))
+		case *MovesMessage:
 			// do nothing, since we aren't adapting our strategy to the state of things
-			break
-		case "gameOver":
-			log("A Game Over was sent to ai player. My work here is done. Goodbye")
+		case *GameOverMessage:
+			n.log("A Game Over was sent to ai player. My work here is done. Goodbye")
 			return
-		default:
-			panic("Message to AI not recognized: " + messageType)
-		}
-	}
-	fmt.Println("AI OVER")
-}
-
-/*
-* Leader election
- */
-
-func startElection(bufChan chan []byte) {
-
-	leaderID := gameState_LeaderID
-
-	message := LeaderElectionMessage{
-		MessageType: "checkleader",
-		Round:       gameState_Round,
-		LeaderID:    leaderID,
-	}
-	byt := encodeMessage(message)
-	broadcastMessage(addressState_goConnection, byt)
-	received := 0
-	positive := 0
-	for {
-		buf, timedout := <-bufChan
-
-		if !timedout {
-			break
-		}
-		fmt.Println(timedout)
-		fmt.Println(buf)
-		fmt.Println(len(buf))
-
-		if getLeaderID(buf) > leaderID {
-			return
-		}
-
-		received++
-		if getMessageType(buf) == "leaderdead" {
-			positive++
-		}
-	}
-
-	if positive > received/2 {
-		if gameState_LeaderID == leaderID {
-			electNewLeader()
-		}
-	}
-}
-
-func electNewLeader() {
-	initializeLeader(":0")
-	//leaderState.Positions = gameState_Positions
-	for index, positions := range gameState_Positions {
-		position := leaderState.Positions[index]
-		for key, value := range positions {
-			position[key] = value
 		}
 	}
-	gameState_LeaderID++
-	message := LeaderElectionMessage{
-		MessageType: "newleader",
-		Round:       gameState_Round,
-		LeaderID:    gameState_LeaderID,
-	}
-	addressState_isLeader = true
-	byt := encodeMessage(message)
-	broadcastMessage(leaderState.leaderConnection, byt)
-	go leaderListener()
-	splitAddress := strings.Split(leaderState.leaderConnection.LocalAddr().String(), ":")
-	addressState_leaderAddr = addressState_LocalIP + ":" + splitAddress[len(splitAddress)-1]
-	initializeLeaderConnection()
-	fmt.Println("New leader elected")
 }
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+* SIMULATED CLOCK
+ */
+
+// SimClock is a virtual clock for running many nodes in one process. Only one goroutine
+// started through it runs at a time: it keeps the cpu until it parks (sleeping, reading a
+// transport or waiting on a mailbox), and then the next pending event decides who runs
+// next. Time only moves to the next event once everyone is parked. Nothing two goroutines
+// do at the same instant can race, so a match runs as fast as the cpu allows and plays
+// out the same for the same seed.
+type SimClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	limit   time.Time
+	running int
+	seq     uint64
+	events  eventQueue
+	stalled chan struct{}
+}
+
+type simEvent struct {
+	at        time.Time
+	key       string // orders events due at the same instant
+	seq       uint64
+	fire      func()
+	cancelled bool
+}
+
+type eventQueue []*simEvent
+
+func (q eventQueue) Len() int      { return len(q) }
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	if q[i].key != q[j].key {
+		return q[i].key < q[j].key
+	}
+	return q[i].seq < q[j].seq
+}
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*simEvent)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	event := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return event
+}
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start, stalled: make(chan struct{})}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *SimClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	wake := make(chan struct{})
+	c.schedule(c.now.Add(d), "~", func() { c.resume(wake) })
+	c.park()
+	c.mu.Unlock()
+	<-wake
+}
+
+func (c *SimClock) Go(f func()) {
+	c.mu.Lock()
+	c.goLocked(f)
+	c.mu.Unlock()
+}
+
+// AfterFunc runs f in its own goroutine once the virtual clock reaches now+d.
+func (c *SimClock) AfterFunc(d time.Duration, f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schedule(c.now.Add(d), "~", func() { c.start(f) })
+}
+
+// Stalled is closed once the clock can not move any more: either every goroutine is
+// parked with nothing scheduled, or the next event is past the limit.
+func (c *SimClock) Stalled() <-chan struct{} {
+	return c.stalled
+}
+
+func (c *SimClock) SetLimit(limit time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = limit
+}
+
+func (c *SimClock) NewMailbox() Mailbox {
+	return &simMailbox{clock: c}
+}
+
+// goLocked starts f once the calling goroutine parks. Must be called with mu held.
+func (c *SimClock) goLocked(f func()) {
+	c.schedule(c.now, "~", func() { c.start(f) })
+}
+
+// start runs f in a goroutine of its own, from an event.
+func (c *SimClock) start(f func()) {
+	c.running++
+	go func() {
+		f()
+		c.mu.Lock()
+		c.running--
+		c.advance()
+		c.mu.Unlock()
+	}()
+}
+
+func (c *SimClock) schedule(at time.Time, key string, fire func()) *simEvent {
+	c.seq++
+	event := &simEvent{at: at, key: key, seq: c.seq, fire: fire}
+	heap.Push(&c.events, event)
+	return event
+}
+
+// wakeup hands the cpu back to a parked goroutine once the calling goroutine parks.
+// Must be called with mu held.
+func (c *SimClock) wakeup(wake chan struct{}) {
+	c.schedule(c.now, "~", func() { c.resume(wake) })
+}
+
+// resume hands the cpu back to a parked goroutine, from an event.
+func (c *SimClock) resume(wake chan struct{}) {
+	c.running++
+	close(wake)
+}
+
+// park marks the calling goroutine as blocked. Must be called with mu held, and the
+// caller must then release mu and wait to be woken.
+func (c *SimClock) park() {
+	c.running--
+	c.advance()
+}
+
+func (c *SimClock) advance() {
+	for c.running == 0 {
+		if len(c.events) == 0 || (!c.limit.IsZero() && c.events[0].at.After(c.limit)) {
+			select {
+			case <-c.stalled:
+			default:
+				close(c.stalled)
+			}
+			return
+		}
+		event := heap.Pop(&c.events).(*simEvent)
+		if event.cancelled {
+			continue
+		}
+		if event.at.After(c.now) {
+			c.now = event.at
+		}
+		event.fire()
+	}
+}
+
+type simMailbox struct {
+	clock   *SimClock
+	queue   []interface{}
+	closed  bool
+	waiting chan struct{}
+}
+
+func (m *simMailbox) Put(message interface{}) {
+	m.clock.mu.Lock()
+	defer m.clock.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.queue = append(m.queue, message)
+	m.wakeWaiting()
+}
+
+func (m *simMailbox) Get() (interface{}, bool) {
+	m.clock.mu.Lock()
+	defer m.clock.mu.Unlock()
+	for len(m.queue) == 0 && !m.closed {
+		wake := make(chan struct{})
+		m.waiting = wake
+		m.clock.park()
+		m.clock.mu.Unlock()
+		<-wake
+		m.clock.mu.Lock()
+	}
+	if len(m.queue) == 0 {
+		return nil, false
+	}
+	message := m.queue[0]
+	m.queue = m.queue[1:]
+	return message, true
+}
+
+func (m *simMailbox) Close() {
+	m.clock.mu.Lock()
+	defer m.clock.mu.Unlock()
+	m.closed = true
+	m.wakeWaiting()
+}
+
+func (m *simMailbox) wakeWaiting() {
+	if m.waiting != nil {
+		wake := m.waiting
+		m.waiting = nil
+		m.clock.wakeup(wake)
+	}
+}
+
+/*
+* SIMULATED NETWORK
+ */
+
+// A Packet is one datagram on its way through the simulated network. Fault models
+// decide its fate by editing Deliveries, the delay of every copy that will arrive:
+// emptying it loses the packet, adding to it duplicates the packet.
+type Packet struct {
+	From       string
+	To         string
+	Data       []byte
+	Deliveries []time.Duration
+}
+
+type FaultModel interface {
+	Apply(p *Packet, rng *rand.Rand)
+}
+
+// Latency delays every copy by Base plus up to Jitter.
+type Latency struct {
+	Base   time.Duration
+	Jitter time.Duration
+}
+
+func (l Latency) Apply(p *Packet, rng *rand.Rand) {
+	for i := range p.Deliveries {
+		p.Deliveries[i] += l.Base
+		if l.Jitter > 0 {
+			p.Deliveries[i] += time.Duration(rng.Int63n(int64(l.Jitter)))
+		}
+	}
+}
+
+// Loss drops packets with probability Rate.
+type Loss struct {
+	Rate float64
+}
+
+func (l Loss) Apply(p *Packet, rng *rand.Rand) {
+	if rng.Float64() < l.Rate {
+		p.Deliveries = nil
+	}
+}
+
+// Duplication delivers a second copy with probability Rate, up to Spread after the first.
+type Duplication struct {
+	Rate   float64
+	Spread time.Duration
+}
+
+func (d Duplication) Apply(p *Packet, rng *rand.Rand) {
+	if rng.Float64() < d.Rate && len(p.Deliveries) > 0 {
+		extra := p.Deliveries[0]
+		if d.Spread > 0 {
+			extra += time.Duration(rng.Int63n(int64(d.Spread)))
+		}
+		p.Deliveries = append(p.Deliveries, extra)
+	}
+}
+
+// Reordering holds packets back by Delay with probability Rate, so later ones overtake them.
+type Reordering struct {
+	Rate  float64
+	Delay time.Duration
+}
+
+func (r Reordering) Apply(p *Packet, rng *rand.Rand) {
+	for i := range p.Deliveries {
+		if rng.Float64() < r.Rate {
+			p.Deliveries[i] += r.Delay
+		}
+	}
+}
+
+// DropRate drops packets out of 1000 per sender; it is how FollowerResponseFailRate
+// drops follower moves at the leader. Key names the sender of a packet; by default it
+// is the host the packet came from.
+type DropRate struct {
+	Rates map[string]int
+	Key   func(p *Packet) string
+}
+
+func (d DropRate) Apply(p *Packet, rng *rand.Rand) {
+	key := hostOf(p.From)
+	if d.Key != nil {
+		key = d.Key(p)
+	}
+	if rate, ok := d.Rates[key]; ok && rng.Intn(1000) < rate {
+		p.Deliveries = nil
+	}
+}
+
+// partition puts hosts in numbered groups. Hosts that were never split off are in group
+// 0, and packets only flow within a group.
+type partition struct {
+	groups map[string]int
+}
+
+func (pt *partition) Apply(p *Packet, rng *rand.Rand) {
+	if pt.groups[hostOf(p.From)] != pt.groups[hostOf(p.To)] {
+		p.Deliveries = nil
+	}
+}
+
+type SimNetwork struct {
+	clock     *SimClock
+	seed      int64
+	faults    []FaultModel
+	partition *partition
+	endpoints map[string]*simEndpoint
+	nextPort  map[string]int
+	links     map[string]*rand.Rand
+}
+
+func NewSimNetwork(clock *SimClock, seed int64, faults ...FaultModel) *SimNetwork {
+	partition := &partition{groups: make(map[string]int)}
+	return &SimNetwork{
+		clock:     clock,
+		seed:      seed,
+		faults:    append([]FaultModel{partition}, faults...),
+		partition: partition,
+		endpoints: make(map[string]*simEndpoint),
+		nextPort:  make(map[string]int),
+		links:     make(map[string]*rand.Rand),
+	}
+}
+
+func (sn *SimNetwork) Listen(addr string) (Transport, error) {
+	sn.clock.mu.Lock()
+	defer sn.clock.mu.Unlock()
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if udpAddr.IP == nil {
+		return nil, errors.New("simulated network needs a host to listen on, got " + addr)
+	}
+	if udpAddr.Port == 0 {
+		host := udpAddr.IP.String()
+		if sn.nextPort[host] == 0 {
+			sn.nextPort[host] = 40000
+		}
+		udpAddr.Port = sn.nextPort[host]
+		sn.nextPort[host]++
+	}
+	if _, taken := sn.endpoints[udpAddr.String()]; taken {
+		return nil, errors.New("address already in use: " + udpAddr.String())
+	}
+	endpoint := &simEndpoint{network: sn, addr: udpAddr}
+	sn.endpoints[udpAddr.String()] = endpoint
+	return endpoint, nil
+}
+
+// Split cuts the network into the given groups of hosts. Hosts not named stay together.
+func (sn *SimNetwork) Split(groups ...[]string) {
+	sn.clock.mu.Lock()
+	defer sn.clock.mu.Unlock()
+	sn.partition.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			sn.partition.groups[host] = i + 1
+		}
+	}
+}
+
+// Isolate cuts a single host off from everyone else, as if it crashed.
+func (sn *SimNetwork) Isolate(host string) {
+	sn.Split([]string{host})
+}
+
+func (sn *SimNetwork) Heal() {
+	sn.Split()
+}
+
+// every link gets its own random stream, so the fate of a packet doesn't depend on
+// what unrelated goroutines happened to send first
+func (sn *SimNetwork) linkRand(from, to string) *rand.Rand {
+	link := from + ">" + to
+	rng, ok := sn.links[link]
+	if !ok {
+		hash := fnv.New64a()
+		hash.Write([]byte(link))
+		rng = rand.New(rand.NewSource(sn.seed ^ int64(hash.Sum64())))
+		sn.links[link] = rng
+	}
+	return rng
+}
+
+func (sn *SimNetwork) send(from *net.UDPAddr, to *net.UDPAddr, buf []byte) {
+	data := make([]byte, len(buf))
+	copy(data, buf)
+	packet := &Packet{From: from.String(), To: to.String(), Data: data, Deliveries: []time.Duration{0}}
+	rng := sn.linkRand(packet.From, packet.To)
+	for _, fault := range sn.faults {
+		fault.Apply(packet, rng)
+	}
+	for _, delay := range packet.Deliveries {
+		sn.clock.schedule(sn.clock.now.Add(delay), packet.From+">"+packet.To, func() {
+			if endpoint, ok := sn.endpoints[packet.To]; ok && !endpoint.closed {
+				endpoint.deliver(datagram{from: from, data: packet.Data})
+			}
+		})
+	}
+}
+
+type datagram struct {
+	from *net.UDPAddr
+	data []byte
+}
+
+type simEndpoint struct {
+	network *SimNetwork
+	addr    *net.UDPAddr
+	inbox   []datagram
+	waiting chan struct{}
+	closed  bool
+}
+
+// the most a real udp socket sends in one datagram
+const maxDatagramSize = 65507
+
+var errDatagramTooBig = errors.New("message too long")
+
+type simTimeout struct{}
+
+func (simTimeout) Error() string   { return "i/o timeout" }
+func (simTimeout) Timeout() bool   { return true }
+func (simTimeout) Temporary() bool { return true }
+
+func (e *simEndpoint) ReadFrom(deadline time.Time) ([]byte, *net.UDPAddr, error) {
+	clock := e.network.clock
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	for {
+		if e.closed {
+			return nil, nil, net.ErrClosed
+		}
+		if len(e.inbox) > 0 {
+			datagram := e.inbox[0]
+			e.inbox = e.inbox[1:]
+			return datagram.data, datagram.from, nil
+		}
+		if !deadline.IsZero() && !clock.now.Before(deadline) {
+			return nil, nil, simTimeout{}
+		}
+		wake := make(chan struct{})
+		e.waiting = wake
+		var timer *simEvent
+		if !deadline.IsZero() {
+			timer = clock.schedule(deadline, "~", func() {
+				if e.waiting == wake {
+					e.waiting = nil
+					clock.resume(wake)
+				}
+			})
+		}
+		clock.park()
+		clock.mu.Unlock()
+		<-wake
+		clock.mu.Lock()
+		if timer != nil {
+			timer.cancelled = true
+		}
+	}
+}
+
+func (e *simEndpoint) deliver(d datagram) {
+	e.inbox = append(e.inbox, d)
+	if e.waiting != nil {
+		wake := e.waiting
+		e.waiting = nil
+		e.network.clock.resume(wake)
+	}
+}
+
+func (e *simEndpoint) WriteTo(buf []byte, addr *net.UDPAddr) (int, error) {
+	e.network.clock.mu.Lock()
+	defer e.network.clock.mu.Unlock()
+	if e.closed {
+		return 0, net.ErrClosed
+	}
+	if len(buf) > maxDatagramSize {
+		return 0, errDatagramTooBig
+	}
+	e.network.send(e.addr, addr, buf)
+	return len(buf), nil
+}
+
+func (e *simEndpoint) LocalAddr() *net.UDPAddr {
+	return e.addr
+}
+
+func (e *simEndpoint) Close() error {
+	e.network.clock.mu.Lock()
+	defer e.network.clock.mu.Unlock()
+	if !e.closed {
+		e.closed = true
+		delete(e.network.endpoints, e.addr.String())
+		if e.waiting != nil {
+			wake := e.waiting
+			e.waiting = nil
+			e.network.clock.wakeup(wake)
+		}
+	}
+	return nil
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+/*
+* SIMULATION
+ */
+
+// A Simulation is a whole match of ai players on a simulated network, run in one process.
+//
+//	sim := NewSimulation(42, 4, DefaultConfig(), Latency{Base: 20 * time.Millisecond}, Loss{Rate: 0.01})
+//	sim.Clock.AfterFunc(10*time.Second, func() { sim.Network.Isolate(sim.Host(1)) })
+//	results := sim.Run(5 * time.Minute)
+type Simulation struct {
+	Clock   *SimClock
+	Network *SimNetwork
+	Nodes   []*Node
+	start   time.Time
+}
+
+type SimulationResult struct {
+	Nickname  string
+	Pid       int
+	Finished  bool // the node saw the game over
+	Round     int
+	LeaderID  int
+	Finish    []string
+	StoppedAt time.Duration
+}
+
+func (s *Simulation) Host(player int) string {
+	return "10.0.0." + strconv.Itoa(player)
+}
+
+// NewSimulation sets up players ai nodes; player 1 hosts the lobby.
+func NewSimulation(seed int64, players int, config Config, faults ...FaultModel) *Simulation {
+	start := time.Date(2015, time.March, 14, 0, 0, 0, 0, time.UTC)
+	clock := NewSimClock(start)
+	s := &Simulation{Clock: clock, Network: NewSimNetwork(clock, seed, faults...), start: start}
+	leaderAddr := s.Host(1) + ":7000"
+	// simulated nodes never restart, so they keep their terms in memory
+	config.TermDir = ""
+	for player := 1; player <= players; player++ {
+		nickname := "sim" + strconv.Itoa(player)
+		s.Nodes = append(s.Nodes, NewNode(
+			WithConfig(config),
+			WithGridSize(config.Width, config.Height),
+			WithNickname(nickname),
+			WithLeader(leaderAddr, player == 1),
+			WithLocalIP(s.Host(player)),
+			WithAI(),
+			WithSeed(seed+int64(player)),
+			WithClock(clock),
+			WithNetwork(s.Network),
+		))
+	}
+	return s
+}
+
+// Run plays the match until every node has seen the game over, nothing is left to
+// happen, or limit of virtual time has passed.
+func (s *Simulation) Run(limit time.Duration) []SimulationResult {
+	s.Clock.SetLimit(s.start.Add(limit))
+	results := make([]SimulationResult, len(s.Nodes))
+	var wg sync.WaitGroup
+	for i, node := range s.Nodes {
+		i, node := i, node
+		wg.Add(1)
+		// followers give the leader a moment to open its lobby
+		s.Clock.AfterFunc(time.Duration(i)*100*time.Millisecond, func() {
+			defer wg.Done()
+			node.Run()
+			results[i].Finished = true
+			results[i].StoppedAt = s.Clock.Now().Sub(s.start)
+		})
+	}
+	// nothing is running yet to move the clock along, so start it off
+	s.Clock.mu.Lock()
+	s.Clock.advance()
+	s.Clock.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-s.Clock.Stalled():
+	}
+
+	s.Clock.mu.Lock()
+	defer s.Clock.mu.Unlock()
+	for i, node := range s.Nodes {
+		results[i].Nickname = node.Nickname
+		results[i].Pid = node.MyPid
+		results[i].Round = node.Round
+		results[i].LeaderID = node.LeaderID
+		results[i].Finish = append([]string(nil), node.Finish...)
+		if !results[i].Finished {
+			results[i].StoppedAt = s.Clock.now.Sub(s.start)
+		}
+	}
+	return results
+}
+
+func (r SimulationResult) String() string {
+	return fmt.Sprintf("%s (pid %d): finished=%t round=%d leader=%d deaths=%v at %v",
+		r.Nickname, r.Pid, r.Finished, r.Round, r.LeaderID, r.Finish, r.StoppedAt)
+}
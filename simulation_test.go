@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// a match of four where the leader drops off the network in the middle of the game
+func playFailover(seed int64) []SimulationResult {
+	config := DefaultConfig()
+	config.Width, config.Height = 60, 60
+	sim := NewSimulation(seed, 4, config, Latency{Base: 5 * time.Millisecond, Jitter: 5 * time.Millisecond}, Loss{Rate: 0.01})
+	sim.Clock.AfterFunc(15*time.Second, func() { sim.Network.Isolate(sim.Host(1)) })
+	return sim.Run(2 * time.Minute)
+}
+
+func TestSimulatedFailover(t *testing.T) {
+	results := playFailover(3)
+	// everyone but the leader that was cut off finishes the same game under a new leader
+	for _, result := range results[1:] {
+		if !result.Finished {
+			t.Errorf("%v never finished", result)
+		}
+		if result.LeaderID == 0 {
+			t.Errorf("%v never followed a new leader", result)
+		}
+		if !reflect.DeepEqual(result.Finish, results[1].Finish) {
+			t.Errorf("%v finished differently from %v", result, results[1])
+		}
+	}
+	if again := playFailover(3); !reflect.DeepEqual(again, results) {
+		t.Errorf("the same seed played out differently:\n%v\n%v", results, again)
+	}
+}
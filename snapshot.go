@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+* SNAPSHOTS
+*
+* The grid of a follower is only ever patched from the moves it receives, so a follower
+* that misses more rounds than the window holds can never catch up from moves alone. The
+* leader sends it the whole state instead, when it asks or when the leader can tell it is
+* too far behind.
+ */
+
+type Snapshot struct {
+	Round     int             `json:"round"`
+	LeaderID  int             `json:"leaderid"`
+	Width     int             `json:"width"`
+	Height    int             `json:"height"`
+	Grid      []int           `json:"grid"` // run-length encoded, see encodeGrid
+	Alive     []string        `json:"alive"`
+	Positions map[string]Move `json:"positions"` // where everyone is on Round
+}
+
+type SnapshotMessage struct {
+	Envelope
+	Snapshot `json:"snapshot"`
+}
+
+// A follower that noticed a gap asks for a snapshot. The round is the last one it has
+// every move of.
+type ResyncMessage struct {
+	Envelope
+}
+
+// encodeGrid flattens the grid column by column into (value, count) pairs. Most of the
+// grid is empty, so a 200x200 grid ends up being a few hundred numbers.
+func encodeGrid(grid [][]int) []int {
+	var runs []int
+	for _, column := range grid {
+		for _, value := range column {
+			if len(runs) > 0 && runs[len(runs)-2] == value {
+				runs[len(runs)-1]++
+			} else {
+				runs = append(runs, value, 1)
+			}
+		}
+	}
+	return runs
+}
+
+func decodeGrid(runs []int, width, height int) ([][]int, error) {
+	if len(runs)%2 != 0 {
+		return nil, errors.New("grid runs don't come in pairs")
+	}
+	total := 0
+	for i := 1; i < len(runs); i += 2 {
+		if runs[i] <= 0 || runs[i] > width*height {
+			return nil, fmt.Errorf("bad grid run length %d", runs[i])
+		}
+		total += runs[i]
+	}
+	if total != width*height {
+		return nil, fmt.Errorf("grid runs cover %d cells, expected %dx%d", total, width, height)
+	}
+	grid := make([][]int, width)
+	cell := 0
+	for i := 0; i < len(runs); i += 2 {
+		for j := 0; j < runs[i+1]; j++ {
+			x := cell / height
+			if grid[x] == nil {
+				grid[x] = make([]int, height)
+			}
+			grid[x][cell%height] = runs[i]
+			cell++
+		}
+	}
+	return grid, nil
+}
+
+// validate only checks the shape of the snapshot. The grid is decoded once the receiver
+// has checked it is the size of its own, a forged size must not get anything allocated.
+func (m *SnapshotMessage) validate() error {
+	if m.Width <= 0 || m.Height <= 0 {
+		return fmt.Errorf("bad grid dimensions %dx%d", m.Width, m.Height)
+	}
+	if len(m.Grid)%2 != 0 {
+		return errors.New("grid runs don't come in pairs")
+	}
+	for pid, move := range m.Positions {
+		if !isDirection(move.Direction) {
+			return errors.New("unknown direction " + move.Direction + " for player " + pid)
+		}
+	}
+	return nil
+}
+
+// the state of the game once the current round is over
+func (n *Node) snapshotMessage() *SnapshotMessage {
+	return &SnapshotMessage{
+		Envelope: Envelope{
+			MessageType: "snapshot",
+			EventName:   "snapshot",
+			Round:       n.Round,
+			Term:        n.leaderState.Term,
+		},
+		Snapshot: Snapshot{
+			Round:     n.Round,
+			LeaderID:  n.LeaderID,
+			Width:     n.GridWidth,
+			Height:    n.GridHeight,
+			Grid:      encodeGrid(n.Grid),
+			Alive:     n.alivePlayers(),
+			Positions: n.getLeaderMoveMap(),
+		},
+	}
+}
+
+func (n *Node) resyncMessage() *ResyncMessage {
+	return &ResyncMessage{
+		Envelope: Envelope{
+			MessageType: "resync",
+			EventName:   "resync",
+			Round:       n.AckedRound,
+		},
+	}
+}
+
+// Ask the leader for a snapshot, at most once a round.
+func (n *Node) requestResync() {
+	if n.resyncRound >= n.Round {
+		return
+	}
+	n.resyncRound = n.Round
+	n.logClient("Asking the leader for a snapshot, the last round I have all the moves of is " + strconv.Itoa(n.AckedRound))
+	n.sendToLeader(n.resyncMessage())
+}
+
+// applySnapshot replaces what we know about the game with the leader's state. It returns
+// false if the snapshot is older than what we have or doesn't fit our game.
+func (n *Node) applySnapshot(snapshot Snapshot) bool {
+	if snapshot.Round < n.AckedRound {
+		n.logClient("Ignoring a snapshot of round " + strconv.Itoa(snapshot.Round) + ", we are already at " + strconv.Itoa(n.AckedRound))
+		return false
+	}
+	if snapshot.Width != n.GridWidth || snapshot.Height != n.GridHeight {
+		n.logClient(fmt.Sprintf("Ignoring a snapshot of a %dx%d grid, ours is %dx%d", snapshot.Width, snapshot.Height, n.GridWidth, n.GridHeight))
+		return false
+	}
+	grid, err := decodeGrid(snapshot.Grid, snapshot.Width, snapshot.Height)
+	if err != nil {
+		n.logClient("Ignoring a bad snapshot: " + err.Error())
+		return false
+	}
+	// the leader's own client shares the grid and the alive set with the leader, which is right by definition
+	if !n.isLeader {
+		if n.divergedRound != 0 {
+			n.logDivergence(snapshot, grid)
+			n.divergedRound = 0
+		}
+		n.Grid = grid
+		alive := make(map[string]bool)
+		for _, pid := range snapshot.Alive {
+			alive[pid] = true
+		}
+		for _, pid := range n.playerPids() {
+			if !alive[pid] {
+				n.killPlayer(pid)
+			}
+		}
+	}
+	n.LeaderID = max(n.LeaderID, snapshot.LeaderID)
+	for i := range n.Positions {
+		n.Positions[i] = make(map[string]Move)
+	}
+	positions := n.Positions[len(n.Positions)-1]
+	for pid, move := range snapshot.Positions {
+		positions[pid] = move
+	}
+	n.MovesRound = snapshot.Round
+	n.AckedRound = snapshot.Round
+	n.logClient("Caught up with the leader's snapshot of round " + strconv.Itoa(snapshot.Round))
+	return true
+}
+
+/*
+* CHECKSUMS
+*
+* The leader puts a checksum of its grid and alive set in every moves message. A follower
+* that has every move up to that round should come out with the same one; if it doesn't,
+* it asks for a snapshot and logs where it went wrong once the snapshot arrives.
+ */
+
+func (n *Node) stateChecksum() uint32 {
+	hash := fnv.New32a()
+	cell := make([]byte, 4)
+	for _, column := range n.Grid {
+		for _, value := range column {
+			cell[0], cell[1], cell[2], cell[3] = byte(value>>24), byte(value>>16), byte(value>>8), byte(value)
+			hash.Write(cell)
+		}
+	}
+	alive := make([]string, 0, len(n.Alive))
+	for pid, isAlive := range n.Alive {
+		if isAlive {
+			alive = append(alive, pid)
+		}
+	}
+	sort.Strings(alive)
+	hash.Write([]byte(strings.Join(alive, ",")))
+	return hash.Sum32()
+}
+
+// Log every cell and player we got wrong, compared to the leader's snapshot.
+func (n *Node) logDivergence(snapshot Snapshot, grid [][]int) {
+	var cells []string
+	for x := range grid {
+		for y := range grid[x] {
+			if grid[x][y] != n.Grid[x][y] {
+				cells = append(cells, fmt.Sprintf("(%d,%d) ours=%d leader's=%d", x, y, n.Grid[x][y], grid[x][y]))
+			}
+		}
+	}
+	alive := make(map[string]bool)
+	for _, pid := range snapshot.Alive {
+		alive[pid] = true
+	}
+	var players []string
+	for pid, isAlive := range n.Alive {
+		if isAlive != alive[pid] {
+			players = append(players, fmt.Sprintf("%s ours=%t leader's=%t", pid, isAlive, alive[pid]))
+		}
+	}
+	sort.Strings(players)
+	n.logClient(fmt.Sprintf("DIVERGENCE on round %d (snapshot of round %d): %d cells differ: %s; alive differs: %s",
+		n.divergedRound, snapshot.Round, len(cells), strings.Join(cells, " "), strings.Join(players, " ")))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+* SPECTATING
+*
+* A player started with -spectate joins only to watch: its join says so, and the leader
+* gives it a pid and a token like anyone else, but no cycle. Spectators don't count
+* towards -min-players or -max-players, don't get ready, aren't asked for moves and never
+* stand for election or vote. They get the game start, every moves (the whole window, since
+* they don't acknowledge any) and the game over, and ask for a snapshot if that wasn't
+* enough.
+*
+* Unlike a player, a spectator can also join once the game is under way. The leader sends it
+* the game start straight away and a snapshot at the end of the round, the same as a player
+* that rejoins. Everyone has spectators in their membership table, so a new leader keeps
+* them in the game. Lockstep games can't be watched, nobody leads them.
+ */
+
+// spectating says whether we only watch the game.
+func (n *Node) spectating() bool {
+	_, watching := n.Spectators[strconv.Itoa(n.MyPid)]
+	return watching
+}
+
+func (n *Node) isSpectator(pid string) bool {
+	_, watching := n.Spectators[pid]
+	return watching
+}
+
+// nextPid is the pid for whoever joins next. A leader elected during the game only knows
+// the pids it has seen, and a player kicked out of the lobby keeps its pid to itself.
+func (n *Node) nextPid() string {
+	for _, pid := range n.AddrToPid {
+		id, _ := strconv.Atoi(pid)
+		n.leaderState.lastPid = max(n.leaderState.lastPid, id)
+	}
+	n.leaderState.lastPid++
+	return strconv.Itoa(n.leaderState.lastPid)
+}
+
+func (n *Node) registerSpectator(raddr *net.UDPAddr, join Join, publicKey []byte) string {
+	address := raddr.String()
+	pid := n.nextPid()
+	n.AddrToPid[address] = pid
+	n.AddrToAddr[address] = raddr
+	n.Spectators[pid] = join.Nickname
+	n.leaderState.Tokens[pid] = newSessionToken()
+	n.leaderState.PublicKeys[pid] = publicKey
+	n.leaderState.Encodings[pid] = []string{JSON_ENCODING}
+	if len(join.Encodings) > 0 {
+		n.leaderState.Encodings[pid] = parseEncodings(strings.Join(join.Encodings, ","))
+	}
+	n.logLeader("Spectator " + join.Nickname + " is watching from " + address + " as " + pid)
+	return pid
+}
+
+// watchLate lets a spectator into a game that is under way, or sends it the game start
+// again if it got in already.
+func (n *Node) watchLate(join Join, raddr *net.UDPAddr) {
+	pid, known := n.AddrToPid[raddr.String()]
+	if known && !n.isSpectator(pid) {
+		n.logLeader("Ignoring a join from player " + pid + ", which is playing already")
+		return
+	}
+	if !known {
+		publicKey, reject := n.screenJoin(join, raddr)
+		if reject.Reason != "" {
+			n.logLeader("Turning away spectator " + join.Nickname + " from " + raddr.String() + ": " + reject.Reason)
+			n.reject(raddr, reject)
+			return
+		}
+		pid = n.registerSpectator(raddr, join, publicKey)
+		n.members.update(Member{Pid: pid, Nickname: join.Nickname, Address: raddr.String(), Status: MemberSpectator})
+	}
+	// where everyone was at the end of the last round, the snapshot at the end of this one does the rest
+	buf := encodeMessage(n.startGameMessage(pid, n.leaderState.Positions[len(n.leaderState.Positions)-2]))
+	if _, err := n.writeHandshake(n.leaderState.leaderConnection, n.Logger.PrepareSend("", buf), raddr, pid); err != nil {
+		n.logLeader("Can't send spectator " + pid + " the game start: " + err.Error())
+	}
+	n.recordWriteThroughput(len(buf))
+	n.leaderState.Resync[pid] = true
+}
+
+// playersToHear is how many moves the leader waits for every round: everyone's who is
+// still in the game and not just watching.
+func (n *Node) playersToHear() int {
+	players := 0
+	for _, pid := range n.AddrToPid {
+		if !n.DroppedForever[pid] && !n.isSpectator(pid) {
+			players++
+		}
+	}
+	return players
+}
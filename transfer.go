@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+* STATE TRANSFER
+*
+* A new leader only has its own view of the game, which can be rounds behind the old
+* leader's. Before it starts a round it asks for everyone else's: every player that
+* follows it sends a state report, and once a majority of the players still in the game
+* have (or a follower response time is up) the leader puts the game back together:
+*
+*   the positions of the newest round anyone has, every trail cell anyone has seen,
+*   every player anyone has seen die (in the order they died), and every player anyone
+*   knows was dropped or left.
+*
+* So a failover never brings a dead cycle back or loses part of a trail. The report also
+* carries the player's session token, so the new leader knows it and the player can keep
+* signing with it. A grid too big to send even in fragments is left out of the report.
+ */
+
+type StateReport struct {
+	Snapshot
+	Finish  []string          `json:"finish"`  // who died, in order
+	Dropped []string          `json:"dropped"` // who the old leader dropped
+	Left    map[string]string `json:"left,omitempty"`
+	Token   string            `json:"token,omitempty"`
+}
+
+type StateReportMessage struct {
+	Envelope
+	StateReport `json:"state"`
+}
+
+func (m *StateReportMessage) validate() error {
+	snapshot := SnapshotMessage{Snapshot: m.Snapshot}
+	return snapshot.validate()
+}
+
+// stateReport is the game as our client knows it.
+func (n *Node) stateReport() *StateReportMessage {
+	positions := make(map[string]Move)
+	for pid, move := range n.getCurrentMoveMap() {
+		positions[pid] = move
+	}
+	return &StateReportMessage{
+		Envelope: Envelope{
+			MessageType: "statereport",
+			EventName:   "stateReport",
+			Round:       n.Round,
+		},
+		StateReport: StateReport{
+			Snapshot: Snapshot{
+				Round:     n.MovesRound,
+				LeaderID:  n.LeaderID,
+				Width:     n.GridWidth,
+				Height:    n.GridHeight,
+				Grid:      encodeGrid(n.Grid),
+				Alive:     n.alivePlayers(),
+				Positions: positions,
+			},
+			Finish:  append([]string(nil), n.Finish...),
+			Dropped: n.droppedPlayers(),
+			Left:    n.Left,
+			Token:   n.SessionToken,
+		},
+	}
+}
+
+func (n *Node) alivePlayers() []string {
+	alive := make([]string, 0, len(n.Alive))
+	for pid, isAlive := range n.Alive {
+		if isAlive {
+			alive = append(alive, pid)
+		}
+	}
+	sort.Strings(alive)
+	return alive
+}
+
+func (n *Node) droppedPlayers() []string {
+	var dropped []string
+	for pid, isDropped := range n.DroppedForever {
+		if isDropped {
+			dropped = append(dropped, pid)
+		}
+	}
+	sort.Strings(dropped)
+	return dropped
+}
+
+// takeOver collects the state reports of a majority of the electorate that voted us in,
+// puts the game together and then leads it.
+func (n *Node) takeOver(electorate map[string]bool) {
+	reports := map[string]StateReport{n.leaderState.Pid: n.stateReport().StateReport}
+	deadline := n.clock.Now().Add(n.config.FollowerResponseTime)
+	for len(reports) <= len(electorate)/2 {
+		buf, raddr, timedout := n.readFromUDPWithTimeout(n.leaderState.leaderConnection, deadline)
+		if timedout {
+			n.logLeader(fmt.Sprintf("Only %d of %d players reported their state, going with that", len(reports), len(electorate)))
+			break
+		}
+		message, sender, err := n.openFromPlayer(buf, raddr)
+		if err != nil {
+			n.logLeader("Ignoring message: " + err.Error())
+			continue
+		}
+		if heartbeat, ok := message.(*HeartbeatMessage); ok {
+			n.playerHeartbeat(heartbeat, sender, raddr)
+			continue
+		}
+		report, ok := message.(*StateReportMessage)
+		if !ok {
+			n.logLeader("Ignoring a " + message.header().MessageType + " message, we are still waiting for state reports")
+			continue
+		}
+		if report.Width != n.GridWidth || report.Height != n.GridHeight {
+			n.logLeader("Ignoring the state report of player " + sender + ", it is for another grid")
+			continue
+		}
+		n.logLeader("Player " + sender + " reported its state of round " + strconv.Itoa(report.Snapshot.Round))
+		reports[sender] = report.StateReport
+	}
+	n.reconcile(reports)
+	n.leaderListener()
+}
+
+// reconcile makes the game the newest one any of the reports has seen.
+func (n *Node) reconcile(reports map[string]StateReport) {
+	reporters := make([]string, 0, len(reports))
+	for pid := range reports {
+		reporters = append(reporters, pid)
+	}
+	// newest first, so the newest report decides everything it can
+	sort.Slice(reporters, func(i, j int) bool {
+		a, b := reports[reporters[i]], reports[reporters[j]]
+		if a.Round != b.Round {
+			return a.Round > b.Round
+		}
+		return reporters[i] < reporters[j]
+	})
+	newest := reports[reporters[0]]
+
+	grid := make([][]int, n.GridWidth)
+	for x := range grid {
+		grid[x] = make([]int, n.GridHeight)
+	}
+	dead := make(map[string]bool)
+	var finish []string
+	dropped := make(map[string]bool)
+	left := make(map[string]string)
+	for _, reporter := range reporters {
+		report := reports[reporter]
+		cells, err := decodeGrid(report.Grid, report.Width, report.Height)
+		if len(report.Grid) == 0 {
+			n.logLeader("Player " + reporter + " reported no grid")
+		} else if err != nil {
+			n.logLeader("Ignoring the grid of player " + reporter + ": " + err.Error())
+		} else {
+			for x := range cells {
+				for y, value := range cells[x] {
+					if grid[x][y] == 0 {
+						grid[x][y] = value
+					}
+				}
+			}
+		}
+		for _, pid := range report.Finish {
+			if !dead[pid] {
+				dead[pid] = true
+				finish = append(finish, pid)
+			}
+		}
+		for _, pid := range report.Dropped {
+			dropped[pid] = true
+		}
+		for pid, reason := range report.Left {
+			if _, known := left[pid]; !known {
+				left[pid] = reason
+			}
+		}
+		if report.Token != "" {
+			n.leaderState.Tokens[reporter] = report.Token
+		}
+	}
+	// dead in any report is dead, even if nobody knows when it happened
+	for _, reporter := range reporters {
+		alive := make(map[string]bool)
+		for _, pid := range reports[reporter].Alive {
+			alive[pid] = true
+		}
+		for _, pid := range n.playerPids() {
+			if !alive[pid] && !dead[pid] {
+				dead[pid] = true
+				finish = append(finish, pid)
+			}
+		}
+	}
+
+	n.Grid = grid
+	for pid := range n.Alive {
+		n.Alive[pid] = !dead[pid]
+	}
+	n.Finish = finish
+	n.DroppedForever = dropped
+	n.Left = left
+	n.markDeparted()
+	// whoever left or was kicked can't come back with a token it still has
+	for pid := range n.Left {
+		delete(n.leaderState.Tokens, pid)
+	}
+	n.Grace = make(map[string]int)
+	n.Succession = n.successionOrder()
+	for i := range n.leaderState.Positions {
+		n.leaderState.Positions[i] = make(map[string]Move)
+	}
+	positions := n.getLeaderMoveMap()
+	for pid, move := range newest.Positions {
+		positions[pid] = move
+	}
+	n.Round = newest.Round
+	// nobody has acknowledged anything of ours, so everyone starts with a snapshot
+	n.leaderState.Acks = make(map[string]int)
+	n.logLeader(fmt.Sprintf("Took over the game at round %d from player %s (%d reports), dead in order: %s, dropped: %s",
+		newest.Round, reporters[0], len(reports), strings.Join(finish, ", "), strings.Join(n.droppedPlayers(), ", ")))
+}
+
+func (n *Node) playerPids() []string {
+	pids := make([]string, 0, len(n.Alive))
+	for pid := range n.Alive {
+		pids = append(pids, pid)
+	}
+	sort.Strings(pids)
+	return pids
+}
+
+// reportState tells the leader we just started following what we know of the game.
+func (n *Node) reportState() {
+	report := n.stateReport()
+	n.logClient("Reporting our state of round " + strconv.Itoa(report.Snapshot.Round) + " to the new leader")
+	if n.sendToLeader(report) == errMessageTooBig {
+		// the others' grids will have most of our trails, the rest of the report still counts
+		n.logClient("Our grid is too big to report, reporting the rest of our state")
+		report.Grid = nil
+		n.sendToLeader(report)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// A Transport sends and receives datagrams for one socket of a node. Addresses stay
+// *net.UDPAddr so the simulated network looks exactly like the real one to the game.
+type Transport interface {
+	// ReadFrom blocks until a datagram arrives or the deadline passes, in which case the
+	// error is a net.Error that reports Timeout(). A zero deadline waits forever.
+	ReadFrom(deadline time.Time) ([]byte, *net.UDPAddr, error)
+	WriteTo(buf []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() *net.UDPAddr
+	Close() error
+}
+
+// A Network hands out transports bound to an ip:port (port 0 picks a free one).
+type Network interface {
+	Listen(addr string) (Transport, error)
+}
+
+type udpNetwork struct{}
+
+func (udpNetwork) Listen(addr string) (Transport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: conn}, nil
+}
+
+type udpTransport struct {
+	conn *net.UDPConn
+}
+
+func (t *udpTransport) ReadFrom(deadline time.Time) ([]byte, *net.UDPAddr, error) {
+	// snapshots of a big grid don't fit in a few kilobytes
+	buf := make([]byte, 65536)
+	t.conn.SetReadDeadline(deadline)
+	size, raddr, err := t.conn.ReadFromUDP(buf[0:])
+	if err != nil {
+		return nil, raddr, err
+	}
+	return buf[:size], raddr, nil
+}
+
+func (t *udpTransport) WriteTo(buf []byte, addr *net.UDPAddr) (int, error) {
+	return t.conn.WriteToUDP(buf, addr)
+}
+
+func (t *udpTransport) LocalAddr() *net.UDPAddr {
+	return t.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// faultyTransport runs the fault models over everything read from a real socket. Only
+// losses can be injected this way; use the simulated network for anything else.
+type faultyTransport struct {
+	Transport
+	faults []FaultModel
+	rng    *rand.Rand
+}
+
+func withFaults(t Transport, seed int64, faults ...FaultModel) Transport {
+	return &faultyTransport{Transport: t, faults: faults, rng: newLockedRand(seed)}
+}
+
+func (t *faultyTransport) ReadFrom(deadline time.Time) ([]byte, *net.UDPAddr, error) {
+	for {
+		buf, raddr, err := t.Transport.ReadFrom(deadline)
+		if err != nil {
+			return buf, raddr, err
+		}
+		packet := &Packet{From: raddr.String(), To: t.LocalAddr().String(), Data: buf, Deliveries: []time.Duration{0}}
+		for _, fault := range t.faults {
+			fault.Apply(packet, t.rng)
+		}
+		if len(packet.Deliveries) > 0 {
+			return buf, raddr, nil
+		}
+	}
+}